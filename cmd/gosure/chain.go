@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+
+	"davidb.org/x/gosure/store"
+	"github.com/spf13/cobra"
+)
+
+var keygenOutput string
+var keygenEncrypt bool
+var verifyKey string
+
+func doKeygen(cmd *cobra.Command, args []string) {
+	if keygenOutput == "" {
+		log.Fatal("Must specify key file with -o")
+	}
+
+	if keygenEncrypt {
+		err := store.GenerateEncryptionKey(keygenOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote encryption key to %s\n", keygenOutput)
+		return
+	}
+
+	err := store.GenerateKey(keygenOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote private key to %s, public key to %s.pub\n",
+		keygenOutput, keygenOutput)
+}
+
+func doVerifyChain(cmd *cobra.Command, args []string) {
+	var key ed25519.PublicKey
+	if verifyKey != "" {
+		var err error
+		key, err = store.LoadPublicKey(verifyKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	hdr, problems, err := storeArg.VerifyChain(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(problems) == 0 {
+		how := "unsigned"
+		if key != nil {
+			how = "signed"
+		}
+		latest := hdr.Deltas[len(hdr.Deltas)-1]
+		fmt.Printf("%s: history intact, %d revisions %s\n", storeArg.String(),
+			len(hdr.Deltas), how)
+		fmt.Printf("latest chain: %s\n", latest.Chain)
+		return
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", storeArg.String(), p)
+	}
+	fmt.Printf("%d problems found\n", len(problems))
+	os.Exit(1)
+}
+
+func doSeal(cmd *cobra.Command, args []string) {
+	err := storeArg.SealChain()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"davidb.org/x/gosure/status"
+	"davidb.org/x/gosure/store"
 	"davidb.org/x/gosure/sure"
 	"github.com/spf13/cobra"
 )
@@ -20,13 +23,28 @@ func doCheck(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
+	// Scan with the same exclude rules as the revision being checked.
+	err = storeArg.LoadScanRules(checkRev)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	meter := st.Meter(250 * time.Millisecond)
-	newTree, err := sure.ScanFs(scanDir, meter)
+	newTree, err := storeArg.Scanner.Scan(scanDir, meter)
 	meter.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Changed ignore files can hide changes to the tree.
+	changes, err := storeArg.CheckScanRules(checkRev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, change := range changes {
+		log.Printf("warning: %s since the revision checked, which can hide changes", change)
+	}
+
 	// TODO: Factor this out between scan.
 	est := newTree.EstimateHashes()
 	meter = st.Meter(250 * time.Millisecond)
@@ -36,4 +54,28 @@ func doCheck(cmd *cobra.Command, args []string) {
 	meter.Close()
 
 	sure.CompareTrees(oldTree, newTree)
+
+	// Show how the files whose contents were kept have changed.
+	num, err := storeArg.GetDelta(checkRev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	older, err := storeArg.DeltaContents(num)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if older == nil {
+		return
+	}
+	names := storeArg.MatchContents(newTree)
+	for name := range older {
+		names = append(names, name)
+	}
+	newer := storeArg.LoadContents(scanDir, names)
+
+	err = store.WriteContentDiffs(os.Stdout, older, newer,
+		fmt.Sprintf("(revision %d)", num), "(current)")
+	if err != nil {
+		log.Fatal(err)
+	}
 }
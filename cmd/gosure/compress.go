@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"davidb.org/x/gosure/weave"
+	"github.com/spf13/cobra"
+)
+
+func doCompress(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Expecting a single compression name")
+	}
+
+	codec, err := weave.CodecByName(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lk, err := storeArg.Lock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lk.Unlock()
+
+	// Fix the source's compression, so that its names don't
+	// change once the new file is written.
+	storeArg.Compression = storeArg.Codec()
+	dest := storeArg
+	dest.Compression = codec
+
+	same := dest.MainFile() == storeArg.MainFile()
+	if !same {
+		if _, err := os.Stat(dest.MainFile()); err == nil {
+			log.Fatalf("%q already exists", dest.MainFile())
+		}
+	}
+
+	err = storeArg.Recompress(&dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var doctorDryRun bool
+
+func doDoctor(cmd *cobra.Command, args []string) {
+	repairs, err := storeArg.Doctor(!doctorDryRun)
+	for _, r := range repairs {
+		fmt.Println(r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(repairs) == 0 {
+		fmt.Println("no problems found")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func doEncrypt(cmd *cobra.Command, args []string) {
+	if storeArg.EncryptKey == nil {
+		log.Fatal("Must give a key with --key-file, --passphrase-file or GOSURE_PASSPHRASE")
+	}
+
+	lk, err := storeArg.Lock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lk.Unlock()
+
+	err = storeArg.Encrypt()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
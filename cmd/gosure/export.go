@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var exportRev int
+var exportOutput string
+
+func doExport(cmd *cobra.Command, args []string) {
+	if exportOutput == "" {
+		log.Fatal("Must specify output file with -o")
+	}
+
+	err := storeArg.Export(exportRev, exportOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func doImport(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("No files given to import")
+	}
+
+	// Import the files oldest first, so that the history is in
+	// order.
+	type source struct {
+		name  string
+		mtime int64
+	}
+	var sources []source
+	for _, name := range args {
+		fi, err := os.Stat(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sources = append(sources, source{name, fi.ModTime().UnixNano()})
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].mtime < sources[j].mtime
+	})
+
+	for _, src := range sources {
+		err := storeArg.Import(src.name)
+		if err != nil {
+			log.Fatalf("%s: %v", src.name, err)
+		}
+		log.Printf("imported %s", src.name)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func doFsck(cmd *cobra.Command, args []string) {
+	problems, err := storeArg.Fsck()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: no problems found\n", storeArg.String())
+		return
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", storeArg.String(), p)
+	}
+	fmt.Printf("%d problems found\n", len(problems))
+	os.Exit(1)
+}
@@ -7,15 +7,27 @@ import (
 	"runtime"
 
 	"davidb.org/x/gosure/store"
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
 	"github.com/spf13/cobra"
 )
 
 var scanDir string
 var storeArg store.Store
 var tags = store.NewTags(&storeArg)
+var signKey = store.NewSignKeyFile(&storeArg)
+var encryptKey = store.NewEncryptKeyFile(&storeArg)
+var passphrase = store.NewPassphraseFile(&storeArg)
 
 var version = "compiled manually"
 
+// The filesystems not scanned with --skip-pseudo, which hold the
+// kernel's view of the system rather than files.
+var pseudoFstypes = []string{"proc", "sysfs", "devpts", "cgroup", "cgroup2",
+	"debugfs", "tracefs", "securityfs", "pstore", "bpf", "configfs", "fusectl",
+	"mqueue", "binfmt_misc", "efivarfs", "autofs"}
+var skipPseudo bool
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -26,11 +38,49 @@ func main() {
 			cmd.Usage()
 			log.Fatal("Invalid usage, TODO")
 		},
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if skipPseudo {
+				storeArg.Scanner.SkipFstypes = append(storeArg.Scanner.SkipFstypes, pseudoFstypes...)
+			}
+		},
 	}
 
 	pf := root.PersistentFlags()
 	pf.VarP(&storeArg, "file", "f", "Surefile to write to")
 	pf.VarP(&tags, "tag", "t", "Tags for new delta")
+	pf.DurationVar(&storeArg.LockWait, "lock-wait", 0,
+		"How long to wait for another gosure to finish with the surefile, negative to wait forever")
+	pf.Var(signKey, "sign-key", "Private key to sign new revisions with")
+	pf.Var(encryptKey, "key-file", "Key to encrypt the surefile with")
+	pf.Var(passphrase, "passphrase-file", "File holding the passphrase to encrypt the surefile with")
+	pf.StringSliceVar(&storeArg.ContentPatterns, "content", nil,
+		"Keep the contents of files matching this pattern, to show diffs of them")
+	pf.Int64Var(&storeArg.ContentLimit, "content-limit", store.DefaultContentLimit,
+		"Largest file whose contents are kept")
+	pf.BoolVar(&storeArg.Scanner.Xattrs, "xattrs", false,
+		"Record extended attributes, such as ACLs, SELinux labels and capabilities")
+	pf.StringSliceVar(&storeArg.Scanner.XattrInclude, "xattr-include", nil,
+		"Only record extended attributes in this namespace, or with this name")
+	pf.StringSliceVar(&storeArg.Scanner.XattrExclude, "xattr-exclude", nil,
+		"Don't record extended attributes in this namespace, or with this name")
+	pf.BoolVarP(&storeArg.Scanner.OneFileSystem, "one-file-system", "x", false,
+		"Don't scan directories on other filesystems")
+	pf.StringSliceVar(&storeArg.Scanner.SkipFstypes, "skip-fstype", nil,
+		"Don't scan directories on filesystems of this type")
+	pf.BoolVar(&skipPseudo, "skip-pseudo", false,
+		"Don't scan directories on the kernel's pseudo filesystems, such as proc and sysfs")
+	pf.StringSliceVar(&storeArg.Scanner.Exclude, "exclude", nil,
+		"Don't scan paths matching this pattern, as in "+sure.IgnoreFile)
+	pf.StringSliceVar(&storeArg.Scanner.Include, "include", nil,
+		"Scan paths matching this pattern, even if excluded")
+	pf.BoolVar(&storeArg.NoExclude, "no-exclude", false,
+		"Don't reuse the exclude and include patterns of the previous scan")
+
+	// The passphrase can also come from the environment, although
+	// the options above take precedence.
+	if pass := os.Getenv("GOSURE_PASSPHRASE"); pass != "" {
+		storeArg.EncryptKey = weave.NewPassphraseKey(pass)
+	}
 
 	scan := &cobra.Command{
 		Use:   "scan",
@@ -43,6 +93,8 @@ func main() {
 
 	pf = scan.PersistentFlags()
 	pf.StringVarP(&scanDir, "dir", "d", ".", "Directory to scan")
+	pf.BoolVar(&storeArg.Segmented, "segmented", false,
+		"Keep each top-level directory in a weave of its own")
 
 	update := &cobra.Command{
 		Use:   "update",
@@ -53,6 +105,8 @@ func main() {
 
 	pf = update.PersistentFlags()
 	pf.StringVarP(&scanDir, "dir", "d", ".", "Directory to scan")
+	pf.BoolVar(&storeArg.Segmented, "segmented", false,
+		"Keep each top-level directory in a weave of its own")
 
 	root.AddCommand(update)
 
@@ -79,11 +133,245 @@ func main() {
 	list := &cobra.Command{
 		Use:   "list",
 		Short: "List revisions in surefile",
-		Run:   doList,
+		Long: "List the revisions in the surefile, most recent first, along with their\n" +
+			"tags, and the statistics recorded when each revision was captured.",
+		Run: doList,
 	}
 
+	pf = list.PersistentFlags()
+	pf.BoolVar(&listJSON, "json", false, "Show the revisions as JSON")
+
 	root.AddCommand(list)
 
+	tag := &cobra.Command{
+		Use:   "tag key=value ...",
+		Short: "Change the tags of an existing revision",
+		Long: "Add or replace tags on a revision that has already been captured.  A \"name\"\n" +
+			"tag renames the revision.  Only the header of the surefile is rewritten.",
+		Run: doTag,
+	}
+
+	pf = tag.PersistentFlags()
+	pf.IntVarP(&tagRev, "rev", "r", -1, "Revision to change")
+	pf.StringSliceVarP(&tagDelete, "delete", "d", nil, "Tag to remove")
+
+	root.AddCommand(tag)
+
+	note := &cobra.Command{
+		Use:   "note text ...",
+		Short: "Add a note to an existing revision",
+		Long: "Set the \"note\" tag of a revision to the given text, replacing any\n" +
+			"existing note.",
+		Run: doNote,
+	}
+
+	pf = note.PersistentFlags()
+	pf.IntVarP(&tagRev, "rev", "r", -1, "Revision to annotate")
+
+	root.AddCommand(note)
+
+	history := &cobra.Command{
+		Use:   "history path",
+		Short: "Show changes to a single path across revisions",
+		Long: "Show each revision in which the given path was added, deleted or had\n" +
+			"its attributes changed.  The path is relative to the top of the scanned tree.",
+		Run: doHistory,
+	}
+
+	root.AddCommand(history)
+
+	prune := &cobra.Command{
+		Use:     "prune",
+		Aliases: []string{"forget"},
+		Short:   "Remove old revisions from surefile",
+		Long: "Remove revisions from the surefile that are not kept by any of the retention\n" +
+			"rules.  The most recent revision, and revisions tagged 'pinned' are always kept.\n" +
+			"The remaining revisions are renumbered.",
+		Run: doPrune,
+	}
+
+	pf = prune.PersistentFlags()
+	pf.IntVar(&retention.Last, "keep-last", 0, "Keep the last N revisions")
+	pf.IntVar(&retention.Daily, "keep-daily", 0, "Keep the last revision of the last N days")
+	pf.IntVar(&retention.Weekly, "keep-weekly", 0, "Keep the last revision of the last N weeks")
+	pf.IntVar(&retention.Monthly, "keep-monthly", 0, "Keep the last revision of the last N months")
+	pf.BoolVarP(&pruneDryRun, "dry-run", "n", false, "Only show what would be removed")
+
+	root.AddCommand(prune)
+
+	revert := &cobra.Command{
+		Use:   "revert --rev N",
+		Short: "Make an older revision current again",
+		Long: "Add a new revision with the same contents as an older one, tagged with\n" +
+			"reverted-from, so that updates and checks compare against it.  With\n" +
+			"--truncate, the revisions after it are removed from the surefile instead.",
+		Run: doRevert,
+	}
+
+	pf = revert.PersistentFlags()
+	pf.IntVarP(&revertRev, "rev", "r", -1, "Revision to revert to")
+	pf.BoolVar(&revertTruncate, "truncate", false, "Remove the later revisions, rather than adding a new one")
+
+	root.AddCommand(revert)
+
+	fsck := &cobra.Command{
+		Use:   "fsck",
+		Short: "Check surefile for corruption",
+		Long: "Check the structure of the surefile, and make sure that every revision\n" +
+			"in it can be decoded.",
+		Run: doFsck,
+	}
+
+	root.AddCommand(fsck)
+
+	doctor := &cobra.Command{
+		Use:   "doctor",
+		Short: "Clean up after an interrupted update",
+		Long: "Remove temporary files left behind by an update (or other change) that was\n" +
+			"interrupted, and restore the surefile from the backup if it is missing.\n" +
+			"This is also done automatically before the surefile is changed.",
+		Run: doDoctor,
+	}
+
+	pf = doctor.PersistentFlags()
+	pf.BoolVarP(&doctorDryRun, "dry-run", "n", false, "Only show what would be repaired")
+
+	root.AddCommand(doctor)
+
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "Write a single revision as a plain surefile",
+		Long: "Write a single revision from the surefile as a plain surefile, that\n" +
+			"doesn't contain any history.  The output is compressed if its name ends in \".gz\".",
+		Run: doExport,
+	}
+
+	pf = export.PersistentFlags()
+	pf.IntVarP(&exportRev, "rev", "r", -1, "Revision to export")
+	pf.StringVarP(&exportOutput, "output", "o", "", "File to write to")
+
+	root.AddCommand(export)
+
+	sccs := &cobra.Command{
+		Use:   "sccs",
+		Short: "Convert between the surefile and SCCS s-files",
+	}
+
+	sccsExport := &cobra.Command{
+		Use:   "export",
+		Short: "Write the surefile, with its history, as an SCCS s-file",
+		Long: "Write the surefile as an SCCS s-file, so that SCCS tools can be used to\n" +
+			"browse the history.  The name and tags of each revision are kept in the\n" +
+			"comments of the SCCS deltas.",
+		Run: doSccsExport,
+	}
+
+	pf = sccsExport.PersistentFlags()
+	pf.StringVarP(&sccsOutput, "output", "o", "", "File to write to")
+
+	sccs.AddCommand(sccsExport)
+
+	sccsImport := &cobra.Command{
+		Use:   "import s-file",
+		Short: "Create the surefile from an SCCS s-file",
+		Long: "Create a new surefile holding the history from an SCCS s-file.  The\n" +
+			"deltas of the s-file must form a single line of history, without branches.",
+		Run: doSccsImport,
+	}
+
+	sccs.AddCommand(sccsImport)
+
+	root.AddCommand(sccs)
+
+	importCmd := &cobra.Command{
+		Use:   "import file ...",
+		Short: "Add plain surefiles as new revisions",
+		Long: "Add the contents of plain (possibly compressed) surefiles to the surefile\n" +
+			"as new revisions, oldest first.  Each revision is named with the\n" +
+			"modification time of the file it came from.",
+		Run: doImport,
+	}
+
+	root.AddCommand(importCmd)
+
+	merge := &cobra.Command{
+		Use:   "merge surefile surefile ... -o output",
+		Short: "Merge the histories of several surefiles into one",
+		Long: "Write a new surefile holding the revisions of all of the given surefiles,\n" +
+			"in order of the time they were captured, and renumbered.  Revisions with\n" +
+			"the same time and contents as another are only written once.",
+		Run: doMerge,
+	}
+
+	pf = merge.PersistentFlags()
+	pf.StringVarP(&mergeOutput, "output", "o", "", "File to write to")
+
+	root.AddCommand(merge)
+
+	keygen := &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate a key for signing or encrypting surefiles",
+		Long: "Generate an Ed25519 key for signing the revisions of surefiles.  The\n" +
+			"private key is written to the given file, and the public key, needed to\n" +
+			"verify the signatures, to the same name with \".pub\" added.  With\n" +
+			"--encryption, generate a key to give to --key-file instead.",
+		Run: doKeygen,
+	}
+
+	pf = keygen.PersistentFlags()
+	pf.StringVarP(&keygenOutput, "output", "o", "", "File to write the private key to")
+	pf.BoolVar(&keygenEncrypt, "encryption", false, "Generate a key for encrypting surefiles instead")
+
+	root.AddCommand(keygen)
+
+	verifyChain := &cobra.Command{
+		Use:   "verify-chain",
+		Short: "Check that the history in the surefile hasn't been changed",
+		Long: "Check the digest of every revision, and that each revision follows from\n" +
+			"the one before it.  With --key, every revision must also be signed with the\n" +
+			"matching private key.  The backup surefile is also checked, and must share\n" +
+			"its history with the surefile.",
+		Run: doVerifyChain,
+	}
+
+	pf = verifyChain.PersistentFlags()
+	pf.StringVarP(&verifyKey, "key", "k", "", "Public key to check the signatures with")
+
+	root.AddCommand(verifyChain)
+
+	seal := &cobra.Command{
+		Use:   "seal",
+		Short: "Add digests to revisions written by older versions",
+		Long: "Record the digest of any revisions that don't have one, and link them\n" +
+			"into the chain.  With --sign-key, every revision is also signed.",
+		Run: doSeal,
+	}
+
+	root.AddCommand(seal)
+
+	compress := &cobra.Command{
+		Use:   "compress {gzip|zstd|xz|none}",
+		Short: "Rewrite surefile with a different compression",
+		Long: "Rewrite the surefile, with all of its history, using the given compression.\n" +
+			"The name of the surefile changes to match the compression.  The segments\n" +
+			"of a segmented surefile are rewritten as well.",
+		Run: doCompress,
+	}
+
+	root.AddCommand(compress)
+
+	encrypt := &cobra.Command{
+		Use:   "encrypt",
+		Short: "Encrypt a surefile written without a key",
+		Long: "Rewrite the surefile, with all of its history, encrypted with the key\n" +
+			"given.  The segments, and the contents kept with --content, are encrypted\n" +
+			"as well.  Once a key is given, surefiles that aren't encrypted are only\n" +
+			"read or written after this has been done.",
+		Run: doEncrypt,
+	}
+
+	root.AddCommand(encrypt)
+
 	version := &cobra.Command{
 		Use:   "version",
 		Short: "Show program version",
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+	"github.com/spf13/cobra"
+)
+
+func doHistory(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Expecting a single path")
+	}
+
+	versions, err := storeArg.PathHistory(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var prior sure.AttMap
+	for _, v := range versions {
+		switch {
+		case v.Atts == nil && prior == nil:
+		case v.Atts == nil:
+			showDelta(v.Delta)
+			fmt.Printf("       deleted\n")
+		case prior == nil:
+			showDelta(v.Delta)
+			atts := sure.AttValues(v.Atts)
+			var names []string
+			for k := range atts {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			fmt.Printf("       added\n")
+			for _, k := range names {
+				fmt.Printf("         %-6s %s\n", k, atts[k])
+			}
+		default:
+			changed := sure.AttDiff(prior, v.Atts)
+			if len(changed) == 0 {
+				break
+			}
+			showDelta(v.Delta)
+			old := sure.AttValues(prior)
+			atts := sure.AttValues(v.Atts)
+			for _, k := range changed {
+				fmt.Printf("       %-6s changed: %s -> %s\n", k,
+					orNone(old[k]), orNone(atts[k]))
+			}
+		}
+		prior = v.Atts
+	}
+}
+
+func showDelta(d *weave.Delta) {
+	fmt.Printf("%4d | %s | %s\n", d.Number,
+		d.Time.Format("2006-01-02 15:04:05"), d.Name)
+}
+
+// orNone shows an attribute that isn't present.
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
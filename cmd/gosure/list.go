@@ -1,25 +1,106 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strings"
 
+	"davidb.org/x/gosure/store"
+	"davidb.org/x/gosure/weave"
 	"github.com/spf13/cobra"
 )
 
+var listJSON bool
+
 func doList(cmd *cobra.Command, args []string) {
 	hdr, err := storeArg.ReadHeader()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("vers | Time captured       | name\n")
-	fmt.Printf("-----+---------------------+----------------\n")
+	// Show the most recent first.
+	var deltas []*weave.Delta
 	for i := len(hdr.Deltas) - 1; i >= 0; i-- {
-		d := hdr.Deltas[i]
+		deltas = append(deltas, hdr.Deltas[i])
+	}
 
+	if listJSON {
+		text, err := json.MarshalIndent(deltas, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(text, '\n'))
+		return
+	}
+
+	fmt.Printf("vers | Time captured       | name\n")
+	fmt.Printf("-----+---------------------+----------------\n")
+	for _, d := range deltas {
 		timeText := d.Time.Format("2006-01-02 15:04:05")
 
 		fmt.Printf("%4d | %-19s | %s\n", d.Number, timeText, d.Name)
+		for _, line := range deltaDetails(d) {
+			fmt.Printf("     | %s\n", line)
+		}
+	}
+}
+
+// deltaDetails returns lines describing the statistics and tags of a
+// delta.  Deltas written by older versions have no statistics.
+func deltaDetails(d *weave.Delta) []string {
+	var lines []string
+
+	if _, ok := d.Stats[store.StatFiles]; ok {
+		text := fmt.Sprintf("%d files, %d dirs, %d symlinks",
+			d.Stats[store.StatFiles], d.Stats[store.StatDirs], d.Stats[store.StatLinks])
+		if n := d.Stats[store.StatOthers]; n > 0 {
+			text += fmt.Sprintf(", %d others", n)
+		}
+		text += ", " + humanBytes(d.Stats[store.StatBytes])
+		lines = append(lines, text)
+	}
+
+	var changes []string
+	if _, ok := d.Stats[store.StatAdded]; ok {
+		changes = append(changes, fmt.Sprintf("%d added, %d removed, %d changed",
+			d.Stats[store.StatAdded], d.Stats[store.StatRemoved], d.Stats[store.StatChanged]))
+	}
+	if _, ok := d.Stats[store.StatHashed]; ok {
+		changes = append(changes, fmt.Sprintf("hashed %s, reused %s",
+			humanBytes(d.Stats[store.StatHashed]), humanBytes(d.Stats[store.StatReused])))
+	}
+	if len(changes) > 0 {
+		lines = append(lines, strings.Join(changes, ", "))
+	}
+
+	if len(d.Tags) > 0 {
+		var tags []string
+		for k, v := range d.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		lines = append(lines, "tags: "+strings.Join(tags, ", "))
+	}
+
+	return lines
+}
+
+// humanBytes shows a size in bytes, in more human-friendly units.
+func humanBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+	v := float64(size)
+	unit := 0
+	for v >= 1024.0 && unit < len(units)-1 {
+		v /= 1024.0
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
 	}
+	return fmt.Sprintf("%.1f%s", v, units[unit])
 }
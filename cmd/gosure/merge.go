@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var mergeOutput string
+
+func doMerge(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatal("Expecting at least two surefiles to merge")
+	}
+	if mergeOutput == "" {
+		log.Fatal("Must specify output file with -o")
+	}
+
+	written, dups, err := storeArg.Merge(mergeOutput, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d deltas written, %d duplicates removed\n", written, dups)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"davidb.org/x/gosure/store"
+	"davidb.org/x/gosure/weave"
+	"github.com/spf13/cobra"
+)
+
+var retention store.Retention
+var pruneDryRun bool
+
+func doPrune(cmd *cobra.Command, args []string) {
+	if retention.IsEmpty() {
+		log.Fatal("No retention rules given, refusing to remove everything but the latest delta")
+	}
+
+	var removed []*weave.Delta
+	if pruneDryRun {
+		hdr, err := storeArg.ReadHeader()
+		if err != nil {
+			log.Fatal(err)
+		}
+		removed = retention.Remove(hdr)
+	} else {
+		var err error
+		removed, err = storeArg.Prune(&retention)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	verb := "removed"
+	if pruneDryRun {
+		verb = "would remove"
+	}
+	for _, d := range removed {
+		fmt.Printf("%s %4d | %s | %s\n", verb, d.Number,
+			d.Time.Format("2006-01-02 15:04:05"), d.Name)
+	}
+	fmt.Printf("%d deltas %s\n", len(removed), verb)
+}
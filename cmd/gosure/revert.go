@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var revertRev int
+var revertTruncate bool
+
+func doRevert(cmd *cobra.Command, args []string) {
+	if !cmd.Flags().Changed("rev") {
+		log.Fatal("Must specify the revision to revert to with --rev")
+	}
+
+	if !revertTruncate {
+		num, err := storeArg.Revert(revertRev)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("reverted to delta %d\n", num)
+		return
+	}
+
+	removed, err := storeArg.Truncate(revertRev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range removed {
+		fmt.Printf("removed %4d | %s | %s\n", d.Number,
+			d.Time.Format("2006-01-02 15:04:05"), d.Name)
+	}
+	fmt.Printf("%d deltas removed\n", len(removed))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+
+	"davidb.org/x/gosure/weave"
+	"github.com/spf13/cobra"
+)
+
+var sccsOutput string
+
+func doSccsExport(cmd *cobra.Command, args []string) {
+	if sccsOutput == "" {
+		log.Fatal("Must specify output file with -o")
+	}
+	if storeArg.IsSegmented() {
+		log.Fatal("Segmented surefiles can't be exported as s-files")
+	}
+
+	file, err := os.Create(sccsOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wr := bufio.NewWriter(file)
+	err = weave.ExportSCCS(&storeArg, wr)
+	if err == nil {
+		err = wr.Flush()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(sccsOutput)
+		log.Fatal(err)
+	}
+}
+
+func doSccsImport(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Expecting a single s-file")
+	}
+
+	lk, err := storeArg.Lock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lk.Unlock()
+
+	if _, err := os.Stat(storeArg.MainFile()); err == nil {
+		log.Fatalf("%q already exists", storeArg.MainFile())
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	err = weave.ImportSCCS(&storeArg, file)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"log"
+	"os"
 
+	"davidb.org/x/gosure/store"
 	"davidb.org/x/gosure/sure"
 	"github.com/spf13/cobra"
 )
@@ -19,4 +21,21 @@ func doSignoff(cmd *cobra.Command, args []string) {
 	}
 
 	sure.CompareTrees(oldTree, newTree)
+
+	older, err := storeArg.DeltaContents(store.DeltaPrior)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newer, err := storeArg.DeltaContents(store.DeltaLatest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if older == nil || newer == nil {
+		return
+	}
+
+	err = store.WriteContentDiffs(os.Stdout, older, newer, "(prior)", "(latest)")
+	if err != nil {
+		log.Fatal(err)
+	}
 }
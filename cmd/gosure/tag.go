@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"davidb.org/x/gosure/store"
+	"github.com/spf13/cobra"
+)
+
+var tagRev int
+var tagDelete []string
+
+func doTag(cmd *cobra.Command, args []string) {
+	if len(args) == 0 && len(tagDelete) == 0 {
+		log.Fatal("No tags given")
+	}
+
+	tags := make(map[string]string)
+	for _, arg := range args {
+		f := strings.SplitN(arg, "=", 2)
+		if len(f) != 2 {
+			log.Fatalf("Tag %q must contain an '='", arg)
+		}
+		tags[f[0]] = f[1]
+	}
+
+	err := storeArg.RetagDelta(tagRev, tags, tagDelete)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func doNote(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("No note given")
+	}
+
+	tags := map[string]string{
+		store.NoteTag: strings.Join(args, " "),
+	}
+	err := storeArg.RetagDelta(tagRev, tags, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
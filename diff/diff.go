@@ -0,0 +1,620 @@
+// Package diff computes the differences between two sequences of
+// lines.
+//
+// The algorithm is the one described by Eugene Myers in "An O(ND)
+// Difference Algorithm and Its Variations", using the linear space
+// refinement.  It follows GNU diff closely, including the heuristics
+// it uses to speed up the comparison, and the way it moves changes
+// around among runs of repeated lines afterwards, so that the changes
+// found are the same as those of "diff".  Lines are compared through
+// a fixed-size summary (a hash), so that very large inputs do not
+// need to be held in memory.  Callers that need certainty should
+// compare the actual text of the lines that the diff claims are
+// common.
+package diff
+
+// A Hunk describes a single change between two sequences.  The lines
+// [ALow, AHigh) of the old sequence are replaced with the lines
+// [BLow, BHigh) of the new sequence.  Lines are numbered from zero.
+// A hunk that only deletes lines will have BLow == BHigh, and one
+// that only adds lines will have ALow == AHigh.
+type Hunk struct {
+	ALow, AHigh int
+	BLow, BHigh int
+}
+
+// Diff computes a set of changes that transform the sequence 'a' into
+// the sequence 'b', the same as the ones "diff" would find.  These
+// are nearly always minimal, but as with "diff", very expensive
+// comparisons settle for an answer that might not be.  The function
+// 'fn' will be called with each hunk, in increasing order.  Any error
+// returned by 'fn' stops the walk, and will be returned by Diff.
+func Diff(a, b []uint64, fn func(h Hunk) error) error {
+	return diffHorizon(a, b, 0, fn)
+}
+
+// diffHorizon computes the changes as Diff does.  Changes can only be
+// moved as far as 'horizon' lines into the common lines at the
+// beginning and end of the sequences, as "diff" does when showing
+// that many lines of context.
+func diffHorizon(a, b []uint64, horizon int, fn func(h Hunk) error) error {
+	d := newDiffer(a, b, horizon)
+	d.discard()
+	d.compareseq(0, len(d.xv), 0, len(d.yv), false)
+	shiftBoundaries(d.aChanged, d.bChanged, d.aEquiv)
+	shiftBoundaries(d.bChanged, d.aChanged, d.bEquiv)
+
+	return d.emit(fn)
+}
+
+// A differ holds the state of a single comparison.  The lines common
+// to the beginning and end of both sequences are set aside first.  Of
+// the rest, the comparison is done on reduced sequences of lines that
+// have a chance of matching, and the results are mapped back to the
+// original lines afterwards.
+type differ struct {
+	// The lines set aside at the beginning of the sequences.
+	prefix int
+
+	// The lines being compared, as the number of their equivalence
+	// class, where lines are in the same class if they are equal.
+	aEquiv, bEquiv []int
+
+	// The reduced sequences, and the index of each of their
+	// elements in the compared lines.
+	xv, yv     []int
+	xIdx, yIdx []int
+
+	// Change markers for the compared lines.  These have an extra
+	// element at each end, so the marker for line i is at i+1.
+	aChanged, bChanged []bool
+
+	// The forward and backward diagonal vectors.  These are
+	// indexed by diagonal (x - y) plus 'offset'.
+	fd, bd []int
+	offset int
+
+	// The cost at which the search for the middle of an edit path
+	// gives up, and settles for a good enough answer.
+	tooExpensive int
+}
+
+func newDiffer(a, b []uint64, horizon int) *differ {
+	// The common prefix, and suffix, leaving 'horizon' lines of
+	// each to be compared.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	prefix -= horizon
+	if prefix < 0 {
+		prefix = 0
+	}
+	suffix := 0
+	for prefix+suffix < len(a) && prefix+suffix < len(b) &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	suffix -= horizon
+	if suffix < 0 {
+		suffix = 0
+	}
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+
+	classes := make(map[uint64]int)
+	equiv := func(lines []uint64) []int {
+		eq := make([]int, len(lines))
+		for i, h := range lines {
+			c, ok := classes[h]
+			if !ok {
+				c = len(classes) + 1
+				classes[h] = c
+			}
+			eq[i] = c
+		}
+		return eq
+	}
+
+	return &differ{
+		prefix:   prefix,
+		aEquiv:   equiv(a),
+		bEquiv:   equiv(b),
+		aChanged: make([]bool, len(a)+2),
+		bChanged: make([]bool, len(b)+2),
+	}
+}
+
+// discard removes lines that only appear in one of the sequences.
+// These lines can never be part of a common subsequence, so they are
+// marked as changed immediately, and the (typically much smaller)
+// remainder is given to the real algorithm.  Lines that match many
+// lines of the other sequence are also removed, when they are among
+// lines that don't match at all, as they are unlikely to match
+// anything useful.
+func (d *differ) discard() {
+	classes := len(d.aEquiv) + len(d.bEquiv) + 1
+	aCount := make([]int, classes)
+	for _, c := range d.aEquiv {
+		aCount[c]++
+	}
+	bCount := make([]int, classes)
+	for _, c := range d.bEquiv {
+		bCount[c]++
+	}
+
+	d.xv, d.xIdx = reduce(d.aEquiv, discards(d.aEquiv, bCount), d.aChanged)
+	d.yv, d.yIdx = reduce(d.bEquiv, discards(d.bEquiv, aCount), d.bChanged)
+
+	size := len(d.xv) + len(d.yv) + 3
+	d.fd = make([]int, size)
+	d.bd = make([]int, size)
+	d.offset = len(d.yv) + 1
+
+	d.tooExpensive = 1
+	for diags := size; diags != 0; diags >>= 2 {
+		d.tooExpensive <<= 1
+	}
+	if d.tooExpensive < 4096 {
+		d.tooExpensive = 4096
+	}
+}
+
+// discards decides which lines of a sequence to discard, given the
+// number of lines of the other sequence in each equivalence class.
+// The result is 1 for each line to discard, and 0 for the rest.
+func discards(equiv []int, counts []int) []byte {
+	end := len(equiv)
+	disc := make([]byte, end)
+
+	// Lines with no match are discarded, and those with more
+	// matches than about the square root of the number of lines are
+	// provisionally discarded (2).
+	many := 5
+	for tem := end / 64 >> 2; tem > 0; tem >>= 2 {
+		many *= 2
+	}
+	for i, c := range equiv {
+		switch n := counts[c]; {
+		case n == 0:
+			disc[i] = 1
+		case n > many:
+			disc[i] = 2
+		}
+	}
+
+	// The provisional lines are only discarded in the middle of a
+	// run of discarded lines, with others at each end.
+	for i := 0; i < end; i++ {
+		if disc[i] == 2 {
+			disc[i] = 0
+			continue
+		}
+		if disc[i] == 0 {
+			continue
+		}
+
+		// Find the end of this run, counting the provisional
+		// lines, and shrink it to end with a line that is
+		// really discarded.
+		provisional := 0
+		j := i
+		for ; j < end && disc[j] != 0; j++ {
+			if disc[j] == 2 {
+				provisional++
+			}
+		}
+		for j > i && disc[j-1] == 2 {
+			j--
+			disc[j] = 0
+			provisional--
+		}
+		length := j - i
+
+		// If a quarter of the run is provisional, none of it is
+		// discarded.
+		if provisional*4 > length {
+			for j > i {
+				j--
+				if disc[j] == 2 {
+					disc[j] = 0
+				}
+			}
+			continue
+		}
+
+		// Keep any run of at least 'minimum' provisional lines,
+		// which is about the square root of a quarter of the
+		// length.
+		minimum := 1
+		for tem := length >> 4; tem > 0; tem >>= 2 {
+			minimum <<= 1
+		}
+		minimum++
+		consec := 0
+		for j := 0; j < length; j++ {
+			if disc[i+j] != 2 {
+				consec = 0
+				continue
+			}
+			consec++
+			if consec == minimum {
+				// Back up to cancel the whole run.
+				j -= consec
+			} else if consec > minimum {
+				disc[i+j] = 0
+			}
+		}
+
+		// Keep the provisional lines at the beginning of the run,
+		// up to the first three discarded lines in a row, or the
+		// first discarded line at least 8 lines in, and the same
+		// at the end.
+		consec = 0
+		for j := 0; j < length; j++ {
+			if j >= 8 && disc[i+j] == 1 {
+				break
+			}
+			switch disc[i+j] {
+			case 2:
+				consec = 0
+				disc[i+j] = 0
+			case 0:
+				consec = 0
+			default:
+				consec++
+			}
+			if consec == 3 {
+				break
+			}
+		}
+		i += length - 1
+		consec = 0
+		for j := 0; j < length; j++ {
+			if j >= 8 && disc[i-j] == 1 {
+				break
+			}
+			switch disc[i-j] {
+			case 2:
+				consec = 0
+				disc[i-j] = 0
+			case 0:
+				consec = 0
+			default:
+				consec++
+			}
+			if consec == 3 {
+				break
+			}
+		}
+	}
+
+	return disc
+}
+
+// reduce returns the lines that aren't discarded, along with their
+// indexes, marking the rest as changed.
+func reduce(equiv []int, disc []byte, changed []bool) ([]int, []int) {
+	var lines, idx []int
+	for i, c := range equiv {
+		if disc[i] == 0 {
+			lines = append(lines, c)
+			idx = append(idx, i)
+		} else {
+			changed[i+1] = true
+		}
+	}
+	return lines, idx
+}
+
+// compareseq compares xv[xoff:xlim] with yv[yoff:ylim], marking the
+// lines that are not part of the common subsequence as changed.  If
+// 'minimal' is set, the middle of the edit path is found even when it
+// is expensive to do so.
+func (d *differ) compareseq(xoff, xlim, yoff, ylim int, minimal bool) {
+	for {
+		// Skip over any common prefix and suffix.
+		for xoff < xlim && yoff < ylim && d.xv[xoff] == d.yv[yoff] {
+			xoff++
+			yoff++
+		}
+		for xoff < xlim && yoff < ylim && d.xv[xlim-1] == d.yv[ylim-1] {
+			xlim--
+			ylim--
+		}
+
+		if xoff == xlim {
+			for ; yoff < ylim; yoff++ {
+				d.bChanged[d.yIdx[yoff]+1] = true
+			}
+			return
+		}
+		if yoff == ylim {
+			for ; xoff < xlim; xoff++ {
+				d.aChanged[d.xIdx[xoff]+1] = true
+			}
+			return
+		}
+
+		// Split the problem at the middle of an edit path.
+		// Recurse on the first half, and loop on the second to
+		// keep the recursion shallow.
+		p := d.midpoint(xoff, xlim, yoff, ylim, minimal)
+		d.compareseq(xoff, p.xmid, yoff, p.ymid, p.loMinimal)
+		xoff, yoff, minimal = p.xmid, p.ymid, p.hiMinimal
+	}
+}
+
+// A partition is a point on an edit path, splitting a comparison in
+// two.  The minimal flags say whether each half should still find a
+// minimal path.
+type partition struct {
+	xmid, ymid           int
+	loMinimal, hiMinimal bool
+}
+
+// midpoint finds the midpoint of the shortest edit script for the
+// given region, returning the coordinates of a point on that path.
+// This searches forward from the start and backward from the end
+// simultaneously until the two searches overlap.  Unless 'minimal' is
+// set, a search that gets too expensive settles for the point that
+// has made the most progress.
+func (d *differ) midpoint(xoff, xlim, yoff, ylim int, minimal bool) partition {
+	const maxInt = int(^uint(0) >> 1)
+
+	fd := d.fd
+	bd := d.bd
+	off := d.offset
+
+	dmin := xoff - ylim // Minimum valid diagonal.
+	dmax := xlim - yoff // Maximum valid diagonal.
+	fmid := xoff - yoff // Center diagonal of forward search.
+	bmid := xlim - ylim // Center diagonal of backward search.
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+	odd := (fmid-bmid)&1 != 0
+
+	fd[off+fmid] = xoff
+	bd[off+bmid] = xlim
+
+	for c := 1; ; c++ {
+		// Extend the forward search by one edit.
+		if fmin > dmin {
+			fmin--
+			fd[off+fmin-1] = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			fd[off+fmax+1] = -1
+		} else {
+			fmax--
+		}
+		for k := fmax; k >= fmin; k -= 2 {
+			tlo := fd[off+k-1]
+			thi := fd[off+k+1]
+			x := thi
+			if tlo >= thi {
+				x = tlo + 1
+			}
+			y := x - k
+			for x < xlim && y < ylim && d.xv[x] == d.yv[y] {
+				x++
+				y++
+			}
+			fd[off+k] = x
+			if odd && bmin <= k && k <= bmax && bd[off+k] <= x {
+				return partition{x, y, true, true}
+			}
+		}
+
+		// Extend the backward search by one edit.
+		if bmin > dmin {
+			bmin--
+			bd[off+bmin-1] = maxInt
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			bd[off+bmax+1] = maxInt
+		} else {
+			bmax--
+		}
+		for k := bmax; k >= bmin; k -= 2 {
+			tlo := bd[off+k-1]
+			thi := bd[off+k+1]
+			x := thi - 1
+			if tlo < thi {
+				x = tlo
+			}
+			y := x - k
+			for x > xoff && y > yoff && d.xv[x-1] == d.yv[y-1] {
+				x--
+				y--
+			}
+			bd[off+k] = x
+			if !odd && fmin <= k && k <= fmax && x <= fd[off+k] {
+				return partition{x, y, true, true}
+			}
+		}
+
+		if minimal || c < d.tooExpensive {
+			continue
+		}
+
+		// Give up, and use whichever of the forward diagonal
+		// that has made the most progress, and the backward one,
+		// has got further.
+		fxybest, fxbest := -1, 0
+		for k := fmax; k >= fmin; k -= 2 {
+			x := fd[off+k]
+			if x > xlim {
+				x = xlim
+			}
+			y := x - k
+			if y > ylim {
+				x = ylim + k
+				y = ylim
+			}
+			if fxybest < x+y {
+				fxybest = x + y
+				fxbest = x
+			}
+		}
+		bxybest, bxbest := maxInt, 0
+		for k := bmax; k >= bmin; k -= 2 {
+			x := bd[off+k]
+			if x < xoff {
+				x = xoff
+			}
+			y := x - k
+			if y < yoff {
+				x = yoff + k
+				y = yoff
+			}
+			if x+y < bxybest {
+				bxybest = x + y
+				bxbest = x
+			}
+		}
+		if (xlim+ylim)-bxybest < fxybest-(xoff+yoff) {
+			return partition{fxbest, fxybest - fxbest, true, false}
+		}
+		return partition{bxbest, bxybest - bxbest, false, true}
+	}
+}
+
+// shiftBoundaries moves each run of changes in one sequence, when
+// the lines around it allow, so that it lines up with a run of
+// changes in the other sequence, or, failing that, as far towards the
+// end as it will go.  Runs that meet are merged.  This doesn't change
+// how many lines are changed, but gives the same changes as "diff"
+// among repeated lines.  The change markers have the extra element at
+// each end, as in differ.
+func shiftBoundaries(changed, otherChanged []bool, equiv []int) {
+	i, j := 0, 0
+	end := len(equiv)
+
+	for {
+		// Find the beginning of the next run of changes, along
+		// with the corresponding point in the other sequence.
+		for i < end && !changed[i+1] {
+			for otherChanged[j+1] {
+				j++
+			}
+			j++
+			i++
+		}
+		if i == end {
+			break
+		}
+		start := i
+
+		// Find the end of the run.
+		i++
+		for changed[i+1] {
+			i++
+		}
+		for otherChanged[j+1] {
+			j++
+		}
+
+		var corresponding int
+		for {
+			runLength := i - start
+
+			// Move the run back, as long as the line before
+			// it matches its last line, merging with any run
+			// before it.
+			for start > 0 && equiv[start-1] == equiv[i-1] {
+				start--
+				changed[start+1] = true
+				i--
+				changed[i+1] = false
+				for changed[start] {
+					start--
+				}
+				j--
+				for otherChanged[j+1] {
+					j--
+				}
+			}
+
+			// The end of the run, at the last point where it
+			// lines up with a run in the other sequence, or
+			// 'end' if it doesn't.
+			corresponding = end
+			if otherChanged[j] {
+				corresponding = i
+			}
+
+			// Move the run forward, as long as its first line
+			// matches the line after it, merging with any run
+			// after it.
+			for i != end && equiv[start] == equiv[i] {
+				changed[start+1] = false
+				start++
+				changed[i+1] = true
+				i++
+				for changed[i+1] {
+					i++
+				}
+				j++
+				for otherChanged[j+1] {
+					corresponding = i
+					j++
+				}
+			}
+
+			if runLength == i-start {
+				break
+			}
+		}
+
+		// Move the merged run back to line up with a run in the
+		// other sequence, if there is one.
+		for corresponding < i {
+			start--
+			changed[start+1] = true
+			i--
+			changed[i+1] = false
+			j--
+			for otherChanged[j+1] {
+				j--
+			}
+		}
+	}
+}
+
+// emit walks through the change markers, and calls 'fn' for each
+// group of changes.
+func (d *differ) emit(fn func(h Hunk) error) error {
+	i, j := 0, 0
+	n, m := len(d.aEquiv), len(d.bEquiv)
+
+	for i < n || j < m {
+		if !d.aChanged[i+1] && !d.bChanged[j+1] {
+			i++
+			j++
+			continue
+		}
+
+		h := Hunk{ALow: d.prefix + i, BLow: d.prefix + j}
+		for d.aChanged[i+1] {
+			i++
+		}
+		for d.bChanged[j+1] {
+			j++
+		}
+		h.AHigh = d.prefix + i
+		h.BHigh = d.prefix + j
+
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,370 @@
+package diff_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"davidb.org/x/gosure/diff"
+)
+
+// Compare random sequences over a small alphabet (so that there are
+// many ambiguous matches), and make sure the result is both correct
+// and minimal.
+func TestMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 2000; i++ {
+		a := randomSeq(r, r.Intn(30), 4)
+		b := randomSeq(r, r.Intn(30), 4)
+
+		hunks := collect(t, a, b)
+
+		got := apply(t, a, b, hunks)
+		if !reflect.DeepEqual(got, b) {
+			t.Fatalf("Diff doesn't apply:\na: %v\nb: %v\nhunks: %v\ngot: %v", a, b, hunks, got)
+		}
+
+		changed := 0
+		for _, h := range hunks {
+			changed += (h.AHigh - h.ALow) + (h.BHigh - h.BLow)
+		}
+		expect := len(a) + len(b) - 2*lcs(a, b)
+		if changed != expect {
+			t.Fatalf("Diff not minimal: %d changes, expect %d\na: %v\nb: %v", changed, expect, a, b)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if hunks := collect(t, nil, nil); len(hunks) != 0 {
+		t.Fatalf("Unexpected hunks: %v", hunks)
+	}
+
+	a := []uint64{1, 2, 3}
+	hunks := collect(t, a, nil)
+	if !reflect.DeepEqual(hunks, []diff.Hunk{{0, 3, 0, 0}}) {
+		t.Fatalf("Unexpected hunks: %v", hunks)
+	}
+
+	hunks = collect(t, nil, a)
+	if !reflect.DeepEqual(hunks, []diff.Hunk{{0, 0, 0, 3}}) {
+		t.Fatalf("Unexpected hunks: %v", hunks)
+	}
+}
+
+// Compare against the system diff program, if there is one.  Both
+// should always come up with the same answer, including where there
+// are several equally good ones.
+func TestAgainstDiff(t *testing.T) {
+	if _, err := exec.LookPath("diff"); err != nil {
+		t.Skip("No diff program")
+	}
+
+	tdir, err := ioutil.TempDir("", "diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	r := rand.New(rand.NewSource(2))
+
+	a := make([]uint64, 500)
+	for i := range a {
+		a[i] = uint64(i)
+	}
+	next := uint64(len(a))
+
+	for i := 0; i < 20; i++ {
+		b := make([]uint64, 0, len(a))
+		for pos := 0; pos < len(a); {
+			n := r.Intn(20) + 1
+			if pos+n > len(a) {
+				n = len(a) - pos
+			}
+			switch r.Intn(6) {
+			case 0: // Delete
+			case 1: // Change
+				for j := r.Intn(10) + 1; j > 0; j-- {
+					b = append(b, next)
+					next++
+				}
+			case 2: // Add
+				for j := r.Intn(10) + 1; j > 0; j-- {
+					b = append(b, next)
+					next++
+				}
+				b = append(b, a[pos:pos+n]...)
+			default:
+				b = append(b, a[pos:pos+n]...)
+			}
+			pos += n
+		}
+
+		checkDiff(t, tdir, a, b)
+		a = b
+	}
+
+	// Repeated lines, where the changes could be placed in many
+	// ways.
+	for i := 0; i < 300; i++ {
+		size := 40
+		if i%10 == 0 {
+			size = 2000
+		}
+		alphabet := r.Intn(6) + 2
+		a := randomSeq(r, r.Intn(size), alphabet)
+		b := randomSeq(r, r.Intn(size), alphabet)
+		checkDiff(t, tdir, a, b)
+
+		// Small edits of mostly repeated lines.
+		b = nil
+		for _, n := range a {
+			switch r.Intn(10) {
+			case 0: // Delete
+			case 1: // Add
+				b = append(b, uint64(r.Intn(alphabet)), n)
+			default:
+				b = append(b, n)
+			}
+		}
+		checkDiff(t, tdir, a, b)
+	}
+}
+
+func checkDiff(t *testing.T, dir string, a, b []uint64) {
+	hunks := collect(t, a, b)
+	expect := runDiff(t, dir, a, b)
+	if !reflect.DeepEqual(hunks, expect) {
+		t.Fatalf("Mismatch with diff:\na: %v\nb: %v\ngot: %v\nexpect: %v", a, b, hunks, expect)
+	}
+}
+
+// The unified output should match that of the system diff.
+func TestUnified(t *testing.T) {
+	if _, err := exec.LookPath("diff"); err != nil {
+		t.Skip("No diff program")
+	}
+
+	tdir, err := ioutil.TempDir("", "diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	r := rand.New(rand.NewSource(3))
+
+	// Lines are never repeated, so the changes are unambiguous.
+	var a []uint64
+	next := uint64(0)
+	for i := 0; i < 40; i++ {
+		var b []uint64
+		for _, n := range a {
+			switch r.Intn(12) {
+			case 0: // Delete
+			case 1: // Change
+				b = append(b, next)
+				next++
+			case 2: // Add
+				b = append(b, next, n)
+				next++
+			default:
+				b = append(b, n)
+			}
+		}
+		for j := r.Intn(4); j > 0; j-- {
+			b = append(b, next)
+			next++
+		}
+
+		checkUnified(t, tdir, a, b, 3)
+		a = b
+	}
+
+	// Repeated lines, where how far the changes can be moved depends
+	// on the amount of context.
+	for i := 0; i < 300; i++ {
+		alphabet := r.Intn(4) + 2
+		a := randomSeq(r, r.Intn(60), alphabet)
+		var b []uint64
+		for _, n := range a {
+			switch r.Intn(8) {
+			case 0: // Delete
+			case 1: // Add
+				b = append(b, uint64(r.Intn(2*alphabet)), n)
+			default:
+				b = append(b, n)
+			}
+		}
+		checkUnified(t, tdir, a, b, r.Intn(4))
+	}
+}
+
+func checkUnified(t *testing.T, dir string, a, b []uint64, context int) {
+	aName := filepath.Join(dir, "a")
+	bName := filepath.Join(dir, "b")
+	writeSeq(t, aName, a)
+	writeSeq(t, bName, b)
+	expect, err := exec.Command("diff", "-U", strconv.Itoa(context),
+		"--label", "a", "--label", "b", aName, bName).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+
+	var buf strings.Builder
+	err = diff.Unified(&buf, "a", "b", seqLines(a), seqLines(b), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(expect) {
+		t.Fatalf("Mismatch with diff:\ngot:\n%s\nexpect:\n%s", buf.String(), expect)
+	}
+}
+
+func seqLines(seq []uint64) []string {
+	var lines []string
+	for _, n := range seq {
+		lines = append(lines, strconv.FormatUint(n, 10))
+	}
+	return lines
+}
+
+func collect(t *testing.T, a, b []uint64) []diff.Hunk {
+	var hunks []diff.Hunk
+	err := diff.Diff(a, b, func(h diff.Hunk) error {
+		hunks = append(hunks, h)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hunks
+}
+
+// apply uses the hunks to build the new sequence out of the old one,
+// checking that the hunks are sane.
+func apply(t *testing.T, a, b []uint64, hunks []diff.Hunk) []uint64 {
+	var result []uint64
+	apos, bpos := 0, 0
+	for _, h := range hunks {
+		if h.ALow < apos || h.BLow < bpos || h.ALow-apos != h.BLow-bpos {
+			t.Fatalf("Misaligned hunk: %v at %d,%d", h, apos, bpos)
+		}
+		if h.ALow == h.AHigh && h.BLow == h.BHigh {
+			t.Fatalf("Empty hunk: %v", h)
+		}
+		result = append(result, a[apos:h.ALow]...)
+		result = append(result, b[h.BLow:h.BHigh]...)
+		apos, bpos = h.AHigh, h.BHigh
+	}
+	if len(a)-apos != len(b)-bpos {
+		t.Fatalf("Misaligned tail at %d,%d", apos, bpos)
+	}
+	result = append(result, a[apos:]...)
+	if result == nil {
+		result = []uint64{}
+	}
+	return result
+}
+
+func randomSeq(r *rand.Rand, size, alphabet int) []uint64 {
+	result := make([]uint64, size)
+	for i := range result {
+		result[i] = uint64(r.Intn(alphabet))
+	}
+	return result
+}
+
+// lcs computes the length of the longest common subsequence the slow
+// way.
+func lcs(a, b []uint64) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+var commandRe = regexp.MustCompile(`^(\d+)(,(\d+))?([acd])(\d+)(,(\d+))?$`)
+
+// runDiff runs the system diff program, and converts its output into
+// hunks.
+func runDiff(t *testing.T, dir string, a, b []uint64) []diff.Hunk {
+	aName := filepath.Join(dir, "a")
+	bName := filepath.Join(dir, "b")
+	writeSeq(t, aName, a)
+	writeSeq(t, bName, b)
+
+	out, err := exec.Command("diff", aName, bName).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+
+	var hunks []diff.Hunk
+	for _, line := range strings.Split(string(out), "\n") {
+		m := commandRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		aLow, aHigh := diffRange(m[1], m[3])
+		bLow, bHigh := diffRange(m[5], m[7])
+		switch m[4] {
+		case "a":
+			// Adds happen after the given line.
+			aHigh = aLow
+			aLow++
+		case "d":
+			bHigh = bLow
+			bLow++
+		}
+		hunks = append(hunks, diff.Hunk{
+			ALow: aLow - 1, AHigh: aHigh,
+			BLow: bLow - 1, BHigh: bHigh,
+		})
+	}
+	return hunks
+}
+
+// diffRange decodes a 1-based inclusive range from diff's output.
+func diffRange(low, high string) (int, int) {
+	l, _ := strconv.Atoi(low)
+	if high == "" {
+		return l, l
+	}
+	h, _ := strconv.Atoi(high)
+	return l, h
+}
+
+func writeSeq(t *testing.T, name string, seq []uint64) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, n := range seq {
+		fmt.Fprintf(f, "%d\n", n)
+	}
+}
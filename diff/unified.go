@@ -0,0 +1,94 @@
+package diff
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"io"
+)
+
+// Unified writes the differences between the lines 'a' and 'b' to
+// 'w' in the unified format of "diff -u", with 'context' lines of
+// unchanged text around each change.  The lines should not include
+// their newlines.  Nothing is written if the lines are the same.
+func Unified(w io.Writer, aName, bName string, a, b []string, context int) error {
+	seed := maphash.MakeSeed()
+	var hunks []Hunk
+	err := diffHorizon(hashLines(seed, a), hashLines(seed, b), context, func(h Hunk) error {
+		hunks = append(hunks, h)
+		return nil
+	})
+	if err != nil || len(hunks) == 0 {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", aName, bName)
+
+	for i := 0; i < len(hunks); {
+		// Changes close enough together to share context are
+		// shown in a single group.
+		j := i
+		for j+1 < len(hunks) && hunks[j+1].ALow-hunks[j].AHigh <= 2*context {
+			j++
+		}
+
+		aLow := hunks[i].ALow - context
+		if aLow < 0 {
+			aLow = 0
+		}
+		aHigh := hunks[j].AHigh + context
+		if aHigh > len(a) {
+			aHigh = len(a)
+		}
+		bLow := hunks[i].BLow - (hunks[i].ALow - aLow)
+		bHigh := hunks[j].BHigh + (aHigh - hunks[j].AHigh)
+
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", unifiedRange(aLow, aHigh), unifiedRange(bLow, bHigh))
+
+		pos := aLow
+		for _, h := range hunks[i : j+1] {
+			writeLines(out, " ", a[pos:h.ALow])
+			writeLines(out, "-", a[h.ALow:h.AHigh])
+			writeLines(out, "+", b[h.BLow:h.BHigh])
+			pos = h.AHigh
+		}
+		writeLines(out, " ", a[pos:aHigh])
+
+		i = j + 1
+	}
+
+	return out.Flush()
+}
+
+// unifiedRange formats the range of lines [low, high) as it appears
+// in the header of a unified hunk.
+func unifiedRange(low, high int) string {
+	switch high - low {
+	case 0:
+		return fmt.Sprintf("%d,0", low)
+	case 1:
+		return fmt.Sprintf("%d", low+1)
+	default:
+		return fmt.Sprintf("%d,%d", low+1, high-low)
+	}
+}
+
+func writeLines(out *bufio.Writer, prefix string, lines []string) {
+	for _, line := range lines {
+		out.WriteString(prefix)
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+}
+
+// hashLines returns the hashes of the lines.  The seed is random, so
+// that two lines that happen to have the same hash in one comparison
+// won't in the next.
+func hashLines(seed maphash.Seed, lines []string) []uint64 {
+	hashes := make([]uint64, len(lines))
+	for i, line := range lines {
+		hashes[i] = maphash.String(seed, line)
+	}
+	return hashes
+}
@@ -14,23 +14,53 @@ import (
 
 // Scan performs a scan or an update.
 func Scan(st *store.Store, dir string, mgr *status.Manager) error {
+	// Hold the lock for the whole scan, so that the surefile can't
+	// change between reading the old tree and writing the new one.
+	lk, err := st.Lock()
+	if err != nil {
+		return err
+	}
+	defer lk.Unlock()
+
 	oldTree, err := st.ReadDat()
 	if err != nil {
 		log.Printf("no prior scan, doing initial scan\n")
+	} else {
+		// Use the same exclude rules as the prior scan, unless
+		// others are given, or they are to be dropped.
+		err = st.LoadScanRules(store.DeltaLatest)
+		if err != nil {
+			return err
+		}
 	}
 
 	meter := mgr.Meter(250 * time.Millisecond)
-	newTree, err := sure.ScanFs(dir, meter)
+	newTree, err := st.Scanner.Scan(dir, meter)
 	meter.Close()
 	if err != nil {
 		return err
 	}
+	st.RecordScanRules()
 
+	stats := make(map[string]int64)
 	if oldTree != nil {
 		sure.MigrateHashes(oldTree, newTree)
+		stats = store.ChangeStats(oldTree, newTree)
 	}
+
+	// Record how much of the tree needed to be hashed, and how
+	// much could use the hashes from the previous scan.
+	est := newTree.EstimateHashes()
+	stats[store.StatHashed] = int64(est.Bytes)
+	stats[store.StatReused] = newTree.Count().Bytes - int64(est.Bytes)
+	st.Stats = stats
+
 	HashUpdate(newTree, dir, mgr)
 
+	if len(st.ContentPatterns) > 0 {
+		st.Contents = st.LoadContents(dir, st.MatchContents(newTree))
+	}
+
 	err = st.Write(newTree)
 	if err != nil {
 		return err
@@ -1,6 +1,10 @@
 module davidb.org/x/gosure
 
+go 1.24
+
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/pflag v1.0.1
+	github.com/ulikunitz/xz v0.5.17
 )
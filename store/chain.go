@@ -0,0 +1,211 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"strings"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// VerifyChain checks that the history in the surefile hasn't been
+// changed (see weave.VerifyChain), and, if a public key is given,
+// that every delta is signed with the matching private key.  The
+// backup file, if present, is checked the same way, and must share
+// its history with the surefile: either the surefile continues from
+// the backup, as after an update, or the surefile's deltas are all in
+// the backup, as after pruning.  A backup with newer deltas than the
+// surefile is only expected after Truncate, which tags the surefile's
+// latest delta to say so; otherwise the deltas missing from the
+// surefile are reported.  The tag isn't covered by the signatures, so
+// this only catches deltas being cut off by something other than
+// gosure.  Returns the header of the surefile,
+// and the problems found.  Problems with the backup file are marked
+// as being in the backup.  The segments of a segmented store each
+// have a chain of their own, which is checked the same way.
+func (s *Store) VerifyChain(key ed25519.PublicKey) (*weave.Header, []weave.Problem, error) {
+	hdr, problems, err := weave.VerifyChain(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segProblems, err := s.segmentProblems(func(nc weave.NamingConvention) ([]weave.Problem, error) {
+		_, probs, err := weave.VerifyChain(nc, key)
+		return probs, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	problems = append(problems, segProblems...)
+
+	bak := backupNaming{s}
+	if _, err := os.Stat(bak.MainFile()); os.IsNotExist(err) {
+		return hdr, problems, nil
+	}
+
+	bhdr, bproblems, err := weave.VerifyChain(bak, key)
+	if err != nil {
+		problems = append(problems, weave.Problem{
+			Msg: err.Error() + " (in backup)",
+		})
+		return hdr, problems, nil
+	}
+	for _, p := range bproblems {
+		p.Msg += " (in backup)"
+		problems = append(problems, p)
+	}
+
+	switch {
+	case continues(bhdr, hdr):
+	case continues(hdr, bhdr):
+		if !truncated(hdr, bhdr) {
+			first := bhdr.Deltas[len(hdr.Deltas)]
+			last := bhdr.Deltas[len(bhdr.Deltas)-1]
+			problems = append(problems, weave.Problem{
+				Msg: fmt.Sprintf("surefile is missing deltas %d to %d of the backup, which weren't removed by truncating",
+					first.Number, last.Number),
+			})
+		}
+	default:
+		same, err := s.samePruned(bak, bhdr, hdr)
+		if err != nil {
+			problems = append(problems, weave.Problem{
+				Msg: err.Error() + " (in backup)",
+			})
+		} else if !same {
+			problems = append(problems, weave.Problem{
+				Msg: "backup history does not match the surefile, it may have been replaced",
+			})
+		}
+	}
+
+	return hdr, problems, nil
+}
+
+// continues reports whether the deltas of 'newer' begin with the
+// deltas of 'older'.
+func continues(older, newer *weave.Header) bool {
+	if len(older.Deltas) > len(newer.Deltas) {
+		return false
+	}
+	for i, d := range older.Deltas {
+		if d.Chain == "" || d.Chain != newer.Deltas[i].Chain {
+			return false
+		}
+	}
+	return true
+}
+
+// truncated reports whether 'newer' is the result of truncating the
+// deltas of 'older' that follow it, which 'newer' begins with.
+func truncated(newer, older *weave.Header) bool {
+	if len(older.Deltas) == len(newer.Deltas) {
+		return true
+	}
+	latest := newer.Deltas[len(newer.Deltas)-1]
+	return latest.Tags[TruncatedTag] == older.Deltas[len(older.Deltas)-1].Chain
+}
+
+// samePruned reports whether the deltas of the surefile could have
+// been left after removing some of the deltas of the backup.  Pruning
+// a segmented store renumbers the deltas of the segments, changing the
+// manifests, so manifests are compared by the ids and digests of their
+// segments instead of their own digests.
+func (s *Store) samePruned(bak weave.NamingConvention, bhdr, hdr *weave.Header) (bool, error) {
+	segmented := s.IsSegmented()
+	bkeys, err := deltaKeys(bak, bhdr, segmented)
+	if err != nil {
+		return false, err
+	}
+	keys, err := deltaKeys(s, hdr, segmented)
+	if err != nil {
+		return false, err
+	}
+	return pruned(bhdr, hdr, bkeys, keys), nil
+}
+
+// deltaKeys returns what must match for each delta of the weave file
+// to be the same as a delta of another: the digest of its contents,
+// or, if 'segmented', for a manifest, the ids and digests of its
+// segments.  Deltas without a digest have an empty key, and never
+// match.
+func deltaKeys(nc weave.NamingConvention, hdr *weave.Header, segmented bool) (map[int]string, error) {
+	keys := make(map[int]string)
+	for _, d := range hdr.Deltas {
+		keys[d.Number] = d.Digest
+	}
+	if !segmented {
+		return keys, nil
+	}
+
+	mans, err := readManifests(nc, nil)
+	if err != nil {
+		return nil, err
+	}
+	for delta, man := range mans {
+		if keys[delta] == "" {
+			continue
+		}
+		var key strings.Builder
+		for _, seg := range man {
+			fmt.Fprintf(&key, "%s %s\n", seg.ID, seg.Digest)
+		}
+		keys[delta] = key.String()
+	}
+	return keys, nil
+}
+
+// pruned reports whether the deltas of 'newer' could have been left
+// after removing some of the deltas of 'older', given the keys of the
+// deltas of each (see deltaKeys).
+func pruned(older, newer *weave.Header, okeys, nkeys map[int]string) bool {
+	i := 0
+	for _, d := range older.Deltas {
+		if i == len(newer.Deltas) {
+			break
+		}
+		nd := newer.Deltas[i]
+		key := okeys[d.Number]
+		if key != "" && key == nkeys[nd.Number] && d.Time.Equal(nd.Time) {
+			i++
+		}
+	}
+	return i == len(newer.Deltas)
+}
+
+// SealChain records the digests of any deltas of the surefile that
+// don't have them, and signs the deltas with s.SignKey, if given.
+// The segments of a segmented store are sealed as well.
+func (s *Store) SealChain() error {
+	return s.locked(func() error {
+		ids, err := s.segmentIDs()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err = weave.SealChain(segmentNaming{s, id})
+			if err != nil {
+				return err
+			}
+		}
+		return weave.SealChain(s)
+	})
+}
+
+// A backupNaming is a naming convention for reading the backup file
+// of a store, as if it were the main file.  It deliberately doesn't
+// implement IndexNaming, as the index describes the main file.
+type backupNaming struct {
+	s *Store
+}
+
+func (b backupNaming) TempFile(num int, compressed bool) string {
+	return b.s.TempFile(num, compressed)
+}
+
+func (b backupNaming) MainFile() string   { return b.s.BackupFile() }
+func (b backupNaming) BackupFile() string { return b.s.BackupFile() }
+func (b backupNaming) IsCompressed() bool { return b.s.IsCompressed() }
+
+func (b backupNaming) EncryptionKey() *weave.Key { return b.s.EncryptKey }
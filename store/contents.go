@@ -0,0 +1,380 @@
+package store
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidb.org/x/gosure/diff"
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+// Besides the attributes and hashes of the files, the store can keep
+// the actual contents of small text files, such as configuration
+// files, so that changes to them can be shown as a diff.  The
+// contents are kept in a companion weave file, next to the surefile,
+// with a delta for each delta of the surefile that was written with
+// contents.  The deltas of the two are matched by their times.
+//
+// The text of each delta of the companion starts with contentsMagic.
+// Each file is then a line "f" followed by its quoted path, and a line
+// for each line of the file, prefixed with "|", so that lines that
+// start with control characters can't be mistaken for the weave's own
+// control lines.  A final line of "\" indicates that the file doesn't
+// end with a newline.
+
+// contentsMagic is the first line of the text of a companion delta.
+const contentsMagic = "asure-contents-1"
+
+// DefaultContentLimit is the size of the largest file whose contents
+// are kept, when the store doesn't give a limit.
+const DefaultContentLimit = 64 * 1024
+
+// Contents holds the text of files, keyed by their path relative to
+// the top of the tree.
+type Contents map[string]string
+
+// A contentsNaming is the naming convention for the companion weave
+// holding file contents.  It shares the compression, keys, and
+// temporary files of the store.  As the contents can be anything in
+// the tree, the files are only readable by their owner.
+type contentsNaming struct {
+	s *Store
+}
+
+func (n contentsNaming) TempFile(num int, compressed bool) string {
+	return n.s.TempFile(num, compressed)
+}
+
+func (n contentsNaming) MainFile() string      { return n.s.makeName("txt", true) }
+func (n contentsNaming) BackupFile() string    { return n.s.makeName("txt.bak", true) }
+func (n contentsNaming) IndexFile() string     { return n.s.makeName("txt.idx", false) }
+func (n contentsNaming) IsCompressed() bool    { return n.s.IsCompressed() }
+func (n contentsNaming) Codec() weave.Codec    { return n.s.Codec() }
+func (n contentsNaming) FileMode() os.FileMode { return 0600 }
+
+func (n contentsNaming) SigningKey() ed25519.PrivateKey { return n.s.SignKey }
+func (n contentsNaming) EncryptionKey() *weave.Key      { return n.s.EncryptKey }
+
+// MatchContents returns the paths of the regular files in the tree
+// whose contents should be kept: those matching one of
+// s.ContentPatterns, and no larger than s.ContentLimit.  A pattern
+// containing a "/" is matched against the whole path, otherwise just
+// against the name of the file.
+func (s *Store) MatchContents(tree *sure.Tree) []string {
+	if len(s.ContentPatterns) == 0 {
+		return nil
+	}
+
+	var names []string
+	var walk func(t *sure.Tree, dir string)
+	walk = func(t *sure.Tree, dir string) {
+		for _, f := range t.Files {
+			atts, ok := f.Atts.(*sure.RegAtts)
+			if !ok || atts.Size > s.contentLimit() {
+				continue
+			}
+			name := path.Join(dir, f.Name)
+			if s.matchContent(name) {
+				names = append(names, name)
+			}
+		}
+		for _, ch := range t.Children {
+			walk(ch, path.Join(dir, ch.Name))
+		}
+	}
+	walk(tree, "")
+
+	return names
+}
+
+func (s *Store) matchContent(name string) bool {
+	for _, pat := range s.ContentPatterns {
+		target := name
+		if !strings.Contains(pat, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pat, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) contentLimit() int64 {
+	if s.ContentLimit > 0 {
+		return s.ContentLimit
+	}
+	return DefaultContentLimit
+}
+
+// LoadContents reads the contents of the named files, relative to
+// 'dir'.  Files that can't be read, that have grown past the limit,
+// or that don't look like text (containing a NUL byte) are left out,
+// with a warning for those that couldn't be read.
+func (s *Store) LoadContents(dir string, names []string) Contents {
+	contents := make(Contents)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("warning: not keeping contents: %v", err)
+			continue
+		}
+		if int64(len(data)) > s.contentLimit() || strings.IndexByte(string(data), 0) >= 0 {
+			continue
+		}
+		contents[name] = string(data)
+	}
+	return contents
+}
+
+// writeContents adds the contents as a new delta of the companion
+// weave, recorded at the same time as the delta of the surefile.
+func (s *Store) writeContents(contents Contents, name string, when time.Time) error {
+	return appendWeave(contentsNaming{s}, name, nil, when, nil, func(w io.Writer) error {
+		return encodeContents(w, contents)
+	})
+}
+
+// encodeContents writes the text of a companion delta.
+func encodeContents(w io.Writer, contents Contents) error {
+	var names []string
+	for name := range contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "%s\n", contentsMagic)
+	for _, name := range names {
+		fmt.Fprintf(out, "f%s\n", strconv.Quote(name))
+
+		text := contents[name]
+		for len(text) > 0 {
+			line := text
+			pos := strings.IndexByte(text, '\n')
+			if pos >= 0 {
+				line = text[:pos]
+				text = text[pos+1:]
+			} else {
+				text = ""
+			}
+			fmt.Fprintf(out, "|%s\n", line)
+			if pos < 0 {
+				fmt.Fprintf(out, "\\\n")
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// A contentsDecoder decodes the text of a companion delta, one line
+// at a time.
+type contentsDecoder struct {
+	contents Contents
+	line     int
+	name     string
+	text     strings.Builder
+}
+
+func (d *contentsDecoder) Add(line string) error {
+	d.line++
+	if d.line == 1 {
+		if line != contentsMagic {
+			return errors.New("invalid magic")
+		}
+		return nil
+	}
+
+	if line == "" {
+		return fmt.Errorf("line %d: blank line", d.line)
+	}
+	switch line[0] {
+	case 'f':
+		d.finish()
+		name, err := strconv.Unquote(line[1:])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid name: %v", d.line, err)
+		}
+		d.name = name
+	case '|':
+		if d.name == "" {
+			return fmt.Errorf("line %d: text outside of a file", d.line)
+		}
+		d.text.WriteString(line[1:])
+		d.text.WriteByte('\n')
+	case '\\':
+		// Remove the newline added above.
+		text := d.text.String()
+		if d.name == "" || !strings.HasSuffix(text, "\n") {
+			return fmt.Errorf("line %d: misplaced end of text", d.line)
+		}
+		d.text.Reset()
+		d.text.WriteString(strings.TrimSuffix(text, "\n"))
+	default:
+		return fmt.Errorf("line %d: unexpected line %q", d.line, line)
+	}
+	return nil
+}
+
+// finish records the file being decoded.
+func (d *contentsDecoder) finish() {
+	if d.name != "" {
+		d.contents[d.name] = d.text.String()
+	}
+	d.name = ""
+	d.text.Reset()
+}
+
+// DeltaContents returns the file contents recorded with the given
+// delta of the surefile.  Returns nil if no contents were recorded.
+func (s *Store) DeltaContents(num int) (Contents, error) {
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	num, err = s.GetDelta(num)
+	if err != nil {
+		return nil, err
+	}
+	var when time.Time
+	for _, d := range hdr.Deltas {
+		if d.Number == num {
+			when = d.Time
+		}
+	}
+
+	nc := contentsNaming{s}
+	chdr, err := weave.ReadHeader(nc)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range chdr.Deltas {
+		if !d.Time.Equal(when) {
+			continue
+		}
+
+		dec := &contentsDecoder{contents: make(Contents)}
+		err := weave.ReadDelta(nc, d.Number, dec.Add)
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("contents of delta %d: %w", num, err)
+		}
+		dec.finish()
+		return dec.contents, nil
+	}
+
+	return nil, nil
+}
+
+// pruneContents removes the deltas of the companion weave that no
+// longer have a delta of the surefile recorded at the same time.
+func (s *Store) pruneContents() error {
+	nc := contentsNaming{s}
+	chdr, err := weave.ReadHeader(nc)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	var remove []int
+	for _, cd := range chdr.Deltas {
+		found := false
+		for _, d := range hdr.Deltas {
+			if d.Time.Equal(cd.Time) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remove = append(remove, cd.Number)
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+
+	return weave.RemoveDeltas(nc, remove)
+}
+
+// WriteContentDiffs writes a unified diff of each file whose contents
+// differ between 'older' and 'newer'.  A file missing from one of them
+// is shown as empty.  The labels describe the two versions in the
+// headers of the diffs.
+func WriteContentDiffs(w io.Writer, older, newer Contents, oldLabel, newLabel string) error {
+	var names []string
+	for name := range older {
+		names = append(names, name)
+	}
+	for name := range newer {
+		if _, ok := older[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a, aok := older[name]
+		b, bok := newer[name]
+		if aok == bok && a == b {
+			continue
+		}
+
+		aName := name + "\t" + oldLabel
+		if !aok {
+			aName = "/dev/null"
+		}
+		bName := name + "\t" + newLabel
+		if !bok {
+			bName = "/dev/null"
+		}
+
+		err := diff.Unified(w, aName, bName, textLines(a), textLines(b), 3)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// textLines splits text into lines for a diff.  If the text doesn't
+// end with a newline, the last line carries diff's usual marker, so
+// that it differs from the same line with a newline.
+func textLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if !strings.HasSuffix(text, "\n") {
+		lines[len(lines)-1] += "\n\\ No newline at end of file"
+	}
+	return lines
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+func TestContents(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	versions := []Contents{
+		{
+			"etc/plain":   "one\ntwo\nthree\n",
+			"etc/weird":   "\x01I 1\n\x01E 1\n|bar\n\\\n",
+			"etc/no-nl":   "last line",
+			"etc/empty":   "",
+			"etc/\"q\"\n": "name with quotes\n",
+		},
+		{
+			"etc/plain": "one\n2\nthree\n",
+			"etc/weird": "\x01I 1\n\x01E 1\n|bar\n\\\n",
+			"etc/no-nl": "last line\n",
+			"etc/new":   "added\n",
+		},
+		nil,
+		{},
+	}
+
+	for _, c := range versions {
+		st.Contents = c
+		err := st.Write(sure.GenerateTree(r, 10, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, c := range versions {
+		got, err := st.DeltaContents(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Fatalf("Delta %d contents: %q, expect %q", i+1, got, c)
+		}
+	}
+
+	// The contents are only readable by their owner, unlike the
+	// surefile.
+	cn := contentsNaming{&st}
+	for _, name := range []string{cn.MainFile(), cn.BackupFile()} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			t.Fatalf("%q has mode %v", name, fi.Mode())
+		}
+	}
+
+	var buf strings.Builder
+	err = WriteContentDiffs(&buf, versions[0], versions[1], "(1)", "(2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "--- etc/no-nl\t(1)\n+++ etc/no-nl\t(2)\n@@ -1 +1 @@\n" +
+		"-last line\n\\ No newline at end of file\n+last line\n"
+	if !strings.Contains(buf.String(), expect) {
+		t.Fatalf("Diff output:\n%s\nmissing:\n%s", buf.String(), expect)
+	}
+	for _, want := range []string{"-two\n+2\n", "--- /dev/null\n+++ etc/new\t(2)\n", "+++ /dev/null\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("Diff output:\n%s\nmissing:\n%s", buf.String(), want)
+		}
+	}
+	if strings.Contains(buf.String(), "etc/weird") {
+		t.Fatalf("Unchanged file in diff:\n%s", buf.String())
+	}
+
+	// Removing deltas removes their contents.
+	_, err = st.Truncate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := st.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chdr, err := weave.ReadHeader(contentsNaming{&st})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.Deltas) != 1 || len(chdr.Deltas) != 1 || !chdr.Deltas[0].Time.Equal(hdr.Deltas[0].Time) {
+		t.Fatalf("Contents not truncated: %d deltas", len(chdr.Deltas))
+	}
+}
+
+func TestMatchContents(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	files := map[string]string{
+		"etc/ssh/sshd_config": "Port 22\n",
+		"etc/app.conf":        "x=1\n",
+		"etc/big.conf":        strings.Repeat("x", 200),
+		"etc/binary.conf":     "a\x00b",
+		"etc/other":           "other\n",
+	}
+	for name, text := range files {
+		name = filepath.Join(tdir, name)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(name, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := sure.ScanFs(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := Store{
+		ContentPatterns: []string{"etc/ssh/*", "*.conf"},
+		ContentLimit:    100,
+	}
+	names := st.MatchContents(tree)
+	got := st.LoadContents(tdir, names)
+	expect := Contents{
+		"etc/ssh/sshd_config": "Port 22\n",
+		"etc/app.conf":        "x=1\n",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Got contents %q, expect %q", got, expect)
+	}
+}
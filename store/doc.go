@@ -21,7 +21,8 @@
 // behind.
 //
 // The options available to the basic store are that the files may or
-// may not be compressed (with or without the .gz suffix), the path
+// may not be compressed (with or without the .gz suffix, or .zst or
+// .xz for the other supported compressors), the path
 // that the files should be stored in (a general default is the base
 // of the tree being scanned), and the prefix ("2sure") part of the
 // name.
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// NoteTag is the tag holding a free-text note about a delta.
+const NoteTag = "note"
+
+// RetagDelta changes the tags of an existing delta.  The given tags
+// are added, replacing any existing values, and the tags named in
+// 'remove' are removed.  As when writing, a "name" tag renames the
+// delta, rather than being kept as a tag.  Only the header of the
+// surefile is rewritten.
+func (s *Store) RetagDelta(num int, tags map[string]string, remove []string) error {
+	lk, err := s.Lock()
+	if err != nil {
+		return err
+	}
+	defer lk.Unlock()
+
+	num, err = s.GetDelta(num)
+	if err != nil {
+		return err
+	}
+
+	return weave.RewriteHeader(s, func(h *weave.Header) error {
+		for _, d := range h.Deltas {
+			if d.Number != num {
+				continue
+			}
+
+			if d.Tags == nil {
+				d.Tags = make(map[string]string)
+			}
+			for _, k := range remove {
+				delete(d.Tags, k)
+			}
+			for k, v := range tags {
+				if k == "name" {
+					d.Name = v
+				} else {
+					d.Tags[k] = v
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("delta %d not present", num)
+	})
+}
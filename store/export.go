@@ -0,0 +1,52 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ImportTag is the tag recording the name of the file a delta was
+// imported from.
+const ImportTag = "imported-from"
+
+// Export writes the given delta out as a plain surefile, that does
+// not contain any of the other deltas.  The file will be compressed
+// if the name ends in ".gz".
+func (s *Store) Export(num int, name string) error {
+	tree, err := s.ReadDelta(num)
+	if err != nil {
+		return err
+	}
+
+	return s.writeNamed(tree, name)
+}
+
+// Import adds the contents of a plain surefile (as written by Export,
+// or by versions of gosure before weave files were used) as a new
+// delta.  The file may be compressed.  The new delta is named, and
+// timestamped with, the modification time of the file, and is tagged
+// with the store's tags, and the name of the file.
+func (s *Store) Import(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	tree, err := s.readNamed(name)
+	if err != nil {
+		return err
+	}
+
+	s.FixTags()
+	tags := make(map[string]string)
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	tags[ImportTag] = filepath.Base(name)
+
+	when := fi.ModTime()
+	return s.locked(func() error {
+		return s.writeTree(tree, when.UTC().Format(time.RFC3339Nano), tags, when, treeStats(tree, nil))
+	})
+}
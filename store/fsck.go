@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// Fsck checks the surefile for problems.  The structure of the weave
+// file is validated, and then the text of every delta is decoded as a
+// tree.  The weave files of the segments of a segmented store are
+// validated as well.  Returns the problems found.  The error result is
+// only set if the surefile could not be read at all.
+func (s *Store) Fsck() ([]weave.Problem, error) {
+	hdr, problems, err := weave.Validate(s)
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil {
+		return problems, nil
+	}
+
+	for _, d := range hdr.Deltas {
+		_, err := s.readTree(d.Number)
+		if err == nil {
+			continue
+		}
+
+		prob := weave.Problem{
+			Delta: d.Number,
+			Msg:   err.Error(),
+		}
+		if de, ok := err.(*DecodeError); ok {
+			prob.Msg = fmt.Sprintf("invalid surefile at end of text: %v", de.Err)
+			if de.Line != 0 {
+				prob.Msg = fmt.Sprintf("invalid surefile at line %d of text: %v",
+					de.Line, de.Err)
+			}
+		}
+		problems = append(problems, prob)
+	}
+
+	segProblems, err := s.segmentProblems(func(nc weave.NamingConvention) ([]weave.Problem, error) {
+		_, probs, err := weave.Validate(nc)
+		return probs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(problems, segProblems...), nil
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+// A PathVersion describes a single path, as recorded in one delta.
+type PathVersion struct {
+	Delta *weave.Delta
+	Atts  sure.AttMap // The attributes, nil if the path isn't present.
+	IsDir bool
+}
+
+// PathHistory returns the attributes of the given path in every delta
+// of the surefile, oldest first.  The path is relative to the top of
+// the scanned tree.  This only requires a single pass through the
+// surefile.
+func (s *Store) PathHistory(name string) ([]PathVersion, error) {
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	decoders := make(map[int]*pathDecoder)
+
+	err = weave.ReadDeltas(s, nil, func(delta int, text string) error {
+		pd, ok := decoders[delta]
+		if !ok {
+			pd = &pathDecoder{pf: sure.NewPathFinder(name)}
+			decoders[delta] = pd
+		}
+
+		pd.line++
+		if pd.line == 1 && text == segmentMagic {
+			pd.isMan = true
+			return nil
+		}
+		if pd.isMan {
+			pd.man = append(pd.man, text)
+			return nil
+		}
+
+		err := pd.pf.Add(text)
+		if err != nil {
+			return &DecodeError{Delta: delta, Line: pd.line, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[segment]*sure.PathFinder)
+	var result []PathVersion
+	for _, d := range hdr.Deltas {
+		pv := PathVersion{Delta: d}
+		if pd, ok := decoders[d.Number]; ok {
+			pf := pd.pf
+			if pd.isMan {
+				pf, err = s.segmentPath(d.Number, pd.man, name, found)
+				if err != nil {
+					return nil, err
+				}
+			}
+			pv.Atts, pv.IsDir = pf.Result()
+		}
+		result = append(result, pv)
+	}
+
+	return result, nil
+}
+
+// A pathDecoder looks for a path in the text of a delta, which can
+// either be a plain tree, or the manifest of a segmented store.
+type pathDecoder struct {
+	line  int
+	pf    *sure.PathFinder
+	man   []string // The lines of a manifest, after the magic.
+	isMan bool
+}
+
+// segmentPath looks for a path in the segments of a manifest.  A
+// top-level name may be either a file in the root segment, or a
+// directory with a segment of its own, so both are looked in.  The
+// finders are kept in 'found', as most segments are shared by many
+// deltas.
+func (s *Store) segmentPath(delta int, lines []string, name string, found map[segment]*sure.PathFinder) (*sure.PathFinder, error) {
+	man, err := parseManifest(lines)
+	if err != nil {
+		return nil, &DecodeError{Delta: delta, Err: err}
+	}
+
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	parts := strings.SplitN(name, "/", 2)
+	rest := "."
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+
+	want := map[string]string{rootSegment: name}
+	if name != "." {
+		want[segmentID(parts[0])] = rest
+	}
+
+	var result *sure.PathFinder
+	for _, seg := range man {
+		target, ok := want[seg.ID]
+		if !ok {
+			continue
+		}
+
+		pf, ok := found[seg]
+		if !ok {
+			pf = sure.NewPathFinder(target)
+			line := 0
+			err := s.readSegment(seg, func(text string) error {
+				line++
+				err := pf.Add(text)
+				if err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			found[seg] = pf
+		}
+
+		if result == nil {
+			result = pf
+		} else if atts, _ := pf.Result(); atts != nil {
+			result = pf
+		}
+	}
+
+	return result, nil
+}
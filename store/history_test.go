@@ -0,0 +1,96 @@
+package store
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+)
+
+func TestPathHistory(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	tr := sure.GenerateTree(r, 10, 2)
+	target := &sure.File{
+		Name: "target",
+		Atts: &sure.RegAtts{
+			BaseAtts: sure.BaseAtts{Perm: 0644},
+			Size:     10,
+			Sha1:     make([]byte, 20),
+		},
+	}
+	files := tr.Files
+
+	// Delta 1: absent, 2: added, 3: unchanged, 4: perm changed, 5:
+	// deleted, 6: added back.
+	steps := []func(){
+		func() {},
+		func() { tr.Files = append(files, target) },
+		func() {},
+		func() { target.Atts.(*sure.RegAtts).Perm = 0600 },
+		func() { tr.Files = files },
+		func() { tr.Files = append(files, target) },
+	}
+	var present []bool
+	var perms []uint32
+	for _, step := range steps {
+		step()
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		present = append(present, len(tr.Files) > len(files))
+		perms = append(perms, target.Atts.(*sure.RegAtts).Perm)
+	}
+
+	versions, err := st.PathHistory("./target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(steps) {
+		t.Fatalf("Got %d versions, expect %d", len(versions), len(steps))
+	}
+
+	var gotPresent []bool
+	for i, v := range versions {
+		if v.Delta.Number != i+1 {
+			t.Fatalf("Version %d is delta %d", i, v.Delta.Number)
+		}
+		gotPresent = append(gotPresent, v.Atts != nil)
+		if v.Atts == nil {
+			continue
+		}
+		if v.IsDir {
+			t.Fatal("File reported as directory")
+		}
+		if perm := v.Atts.(*sure.RegAtts).Perm; perm != perms[i] {
+			t.Fatalf("Delta %d perm %o, expect %o", i+1, perm, perms[i])
+		}
+	}
+	if !reflect.DeepEqual(gotPresent, present) {
+		t.Fatalf("Presence %v, expect %v", gotPresent, present)
+	}
+
+	// The top directory is always present.
+	versions, err = st.PathHistory(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range versions {
+		if v.Atts == nil || !v.IsDir {
+			t.Fatalf("Top directory missing from delta %d", v.Delta.Number)
+		}
+	}
+}
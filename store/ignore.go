@@ -0,0 +1,178 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// The tags recording the exclude and include patterns given for a
+// scan, see sure.Scanner.  Each pattern is escaped as in a URL query,
+// so that it can hold commas, and they are separated by commas.
+const (
+	ExcludeTag = "exclude"
+	IncludeTag = "include"
+)
+
+// IgnoreFilesTag records the IgnoreFiles whose rules a scan used, so
+// that a check can tell when they have changed.  Each is given as its
+// path from the top of the scan, escaped as in a URL query, then '='
+// and the SHA-256 of the file, separated by commas.
+const IgnoreFilesTag = "ignore-files"
+
+// LoadScanRules sets the exclude and include patterns of s.Scanner
+// from those recorded with the given delta, unless some were already
+// given, or s.NoExclude is set.
+func (s *Store) LoadScanRules(num int) error {
+	if s.NoExclude || len(s.Scanner.Exclude) > 0 || len(s.Scanner.Include) > 0 {
+		return nil
+	}
+
+	d, err := s.scanRulesDelta(num)
+	if err != nil {
+		return err
+	}
+	exclude, err := splitPatterns(ExcludeTag, d.Tags[ExcludeTag])
+	if err != nil {
+		return err
+	}
+	include, err := splitPatterns(IncludeTag, d.Tags[IncludeTag])
+	if err != nil {
+		return err
+	}
+	s.Scanner.Exclude = exclude
+	s.Scanner.Include = include
+	return nil
+}
+
+// RecordScanRules sets the tags for the next delta written to record
+// the exclude and include patterns of s.Scanner, and the IgnoreFiles
+// used by its last scan.
+func (s *Store) RecordScanRules() {
+	s.FixTags()
+	for tag, patterns := range map[string][]string{
+		ExcludeTag:     escapePatterns(s.Scanner.Exclude),
+		IncludeTag:     escapePatterns(s.Scanner.Include),
+		IgnoreFilesTag: encodeIgnoreFiles(s.Scanner.IgnoreDigests),
+	} {
+		if len(patterns) > 0 {
+			s.Tags[tag] = strings.Join(patterns, ",")
+		} else {
+			delete(s.Tags, tag)
+		}
+	}
+}
+
+// CheckScanRules compares the IgnoreFiles used by the last scan of
+// s.Scanner with those recorded with the given delta.  Returns a
+// description of each that was added, removed, or changed since.
+func (s *Store) CheckScanRules(num int) ([]string, error) {
+	d, err := s.scanRulesDelta(num)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := decodeIgnoreFiles(d.Tags[IgnoreFilesTag])
+	if err != nil {
+		return nil, err
+	}
+	current := s.Scanner.IgnoreDigests
+
+	var names []string
+	for name := range recorded {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := recorded[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		old, inOld := recorded[name]
+		cur, inNew := current[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("%q added", name))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("%q removed", name))
+		case old != cur:
+			changes = append(changes, fmt.Sprintf("%q changed", name))
+		}
+	}
+	return changes, nil
+}
+
+// scanRulesDelta returns the given delta, from the header.
+func (s *Store) scanRulesDelta(num int) (*weave.Delta, error) {
+	num, err := s.GetDelta(num)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range hdr.Deltas {
+		if d.Number == num {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("delta %d not present", num)
+}
+
+func encodeIgnoreFiles(digests map[string]string) []string {
+	var files []string
+	for name, digest := range digests {
+		files = append(files, url.QueryEscape(name)+"="+digest)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func decodeIgnoreFiles(text string) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, file := range splitTag(text) {
+		escaped, digest, ok := strings.Cut(file, "=")
+		name, err := url.QueryUnescape(escaped)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid %s tag entry %q", IgnoreFilesTag, file)
+		}
+		digests[name] = digest
+	}
+	return digests, nil
+}
+
+func escapePatterns(patterns []string) []string {
+	var escaped []string
+	for _, pattern := range patterns {
+		escaped = append(escaped, url.QueryEscape(pattern))
+	}
+	return escaped
+}
+
+// splitPatterns recovers the patterns recorded in the given tag by
+// RecordScanRules.
+func splitPatterns(tag, text string) ([]string, error) {
+	var patterns []string
+	for _, escaped := range splitTag(text) {
+		pattern, err := url.QueryUnescape(escaped)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag entry %q", tag, escaped)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// splitTag splits a tag holding a list separated by commas.
+func splitTag(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, ",")
+}
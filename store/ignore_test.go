@@ -0,0 +1,100 @@
+package store
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+)
+
+func TestScanRules(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	st := Store{Path: tdir}
+	st.Scanner.Exclude = []string{"*.log", "cache/", "*.{bak,tmp}", "100% done+"}
+	st.Scanner.Include = []string{"keep.log", "a,b"}
+	st.Scanner.IgnoreDigests = map[string]string{
+		"a,b=c/.gosureignore": "1234",
+		".gosureignore":       "5678",
+	}
+	st.RecordScanRules()
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later scan without rules uses the recorded ones.
+	later := Store{Path: tdir}
+	err = later.LoadScanRules(DeltaLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(later.Scanner.Exclude, st.Scanner.Exclude) ||
+		!reflect.DeepEqual(later.Scanner.Include, st.Scanner.Include) {
+		t.Fatalf("Loaded rules %q and %q", later.Scanner.Exclude, later.Scanner.Include)
+	}
+
+	// Rules that are given aren't replaced.
+	given := Store{Path: tdir}
+	given.Scanner.Exclude = []string{"tmp"}
+	err = given.LoadScanRules(DeltaLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(given.Scanner.Exclude, []string{"tmp"}) || given.Scanner.Include != nil {
+		t.Fatalf("Given rules replaced with %q and %q", given.Scanner.Exclude, given.Scanner.Include)
+	}
+
+	// As are they with NoExclude, so that recorded rules can be
+	// dropped.
+	dropped := Store{Path: tdir, NoExclude: true}
+	err = dropped.LoadScanRules(DeltaLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped.Scanner.Exclude != nil || dropped.Scanner.Include != nil {
+		t.Fatalf("Rules loaded with NoExclude: %q and %q", dropped.Scanner.Exclude, dropped.Scanner.Include)
+	}
+
+	// Changes to the ignore files are found.
+	later.Scanner.IgnoreDigests = map[string]string{
+		"a,b=c/.gosureignore": "1234",
+		".gosureignore":       "abcd",
+		"new/.gosureignore":   "ef01",
+	}
+	changes, err := later.CheckScanRules(DeltaLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{`".gosureignore" changed`, `"new/.gosureignore" added`}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Fatalf("Changes %q, expect %q", changes, expect)
+	}
+	later.Scanner.IgnoreDigests = nil
+	changes, err = later.CheckScanRules(DeltaLatest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Removed ignore files not found: %q", changes)
+	}
+
+	// And a scan without any doesn't record them.
+	var none Store
+	none.RecordScanRules()
+	if _, ok := none.Tags[ExcludeTag]; ok {
+		t.Fatal("Empty rules recorded")
+	}
+	if _, ok := none.Tags[IgnoreFilesTag]; ok {
+		t.Fatal("Empty rules recorded")
+	}
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// GenerateKey creates a new Ed25519 key for signing surefiles.  The
+// private key is written to 'name', readable only by the owner, and
+// the public key, which is all that is needed to verify the
+// signatures, to 'name' with ".pub" added.  Neither file may already
+// exist.
+func GenerateKey(name string) error {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(name+".pub", "PUBLIC KEY", pubDER, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeKey(name, "PRIVATE KEY", privDER, 0600)
+	if err != nil {
+		os.Remove(name + ".pub")
+		return err
+	}
+	return nil
+}
+
+// writeKey writes a PEM encoded key to a new file.
+func writeKey(name, kind string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	err = pem.Encode(file, &pem.Block{Type: kind, Bytes: der})
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// readKey reads the PEM encoded key from a file.
+func readKey(name string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: not a PEM encoded key", name)
+	}
+	return block, nil
+}
+
+// LoadSigningKey reads a private key written by GenerateKey.
+func LoadSigningKey(name string) (ed25519.PrivateKey, error) {
+	block, err := readKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not a private key", name)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", name)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads a public key written by GenerateKey.  The
+// private key can also be given, in which case its public part is
+// used.
+func LoadPublicKey(name string) (ed25519.PublicKey, error) {
+	block, err := readKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := LoadSigningKey(name)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	case "PUBLIC KEY":
+	default:
+		return nil, fmt.Errorf("%s: not a public key", name)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", name)
+	}
+	return pub, nil
+}
+
+// The PEM type of encryption key files.
+const encryptionKeyType = "GOSURE ENCRYPTION KEY"
+
+// GenerateEncryptionKey writes a new random key for encrypting
+// surefiles to 'name', readable only by the owner.  The file must not
+// already exist.
+func GenerateEncryptionKey(name string) error {
+	secret, err := weave.GenerateKeyBytes()
+	if err != nil {
+		return err
+	}
+	return writeKey(name, encryptionKeyType, secret, 0600)
+}
+
+// LoadEncryptionKey reads a key written by GenerateEncryptionKey.
+func LoadEncryptionKey(name string) (*weave.Key, error) {
+	block, err := readKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != encryptionKeyType {
+		return nil, fmt.Errorf("%s: not an encryption key", name)
+	}
+
+	key, err := weave.NewKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return key, nil
+}
+
+// LoadPassphrase reads a passphrase from the first line of a file,
+// and makes a key from it.
+func LoadPassphrase(name string) (*weave.Key, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pass := strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	if pass == "" {
+		return nil, fmt.Errorf("%s: passphrase is empty", name)
+	}
+	return weave.NewPassphraseKey(pass), nil
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often to try again for a lock held by another process.
+const lockPoll = 100 * time.Millisecond
+
+// A Lock is an advisory lock on a surefile, held while the surefile
+// is being changed.  Since a change reads the surefile, writes a new
+// one, and renames it into place, two changes made at the same time
+// would otherwise result in one of them being lost.  The lock is a
+// flock on a file next to the surefile, so it is released if the
+// process holding it exits.
+//
+// Locking is recursive, so that a caller can hold the lock across
+// several operations that also lock the store.  The lock is released
+// when Unlock has been called as many times as Lock.
+type Lock struct {
+	file  *os.File
+	store *Store
+	count int
+}
+
+// A LockError indicates that the surefile could not be locked because
+// another process holds the lock.
+type LockError struct {
+	Name   string // The name of the lock file.
+	Holder string // A description of the process holding the lock.
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("surefile is locked by %s (lock file %q)", e.Holder, e.Name)
+}
+
+// Lock acquires the lock on the surefile.  If another process holds
+// the lock, waits up to s.LockWait for it to be released (or forever,
+// if LockWait is negative), before returning a *LockError.  Once the
+// lock is acquired, anything left behind by an earlier write that was
+// interrupted is cleaned up (see Doctor), and logged.
+func (s *Store) Lock() (*Lock, error) {
+	fresh := s.lock == nil
+	lk, err := s.acquire()
+	if err != nil || !fresh {
+		return lk, err
+	}
+
+	repairs, err := s.recover(true)
+	for _, r := range repairs {
+		log.Printf("recovered: %s", r)
+	}
+	if err != nil {
+		lk.Unlock()
+		return nil, err
+	}
+
+	return lk, nil
+}
+
+// acquire acquires the lock, as Lock, without cleaning up.
+func (s *Store) acquire() (*Lock, error) {
+	if s.lock != nil {
+		s.lock.count++
+		return s.lock, nil
+	}
+
+	name := s.LockFile()
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(s.LockWait)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, err
+		}
+		if s.LockWait >= 0 && !time.Now().Before(deadline) {
+			holder := lockHolder(file)
+			file.Close()
+			return nil, &LockError{Name: name, Holder: holder}
+		}
+		time.Sleep(lockPoll)
+	}
+
+	// Record who holds the lock, so that others can report it.
+	host, _ := os.Hostname()
+	info := fmt.Sprintf("process %d on %s (%s)\n", os.Getpid(), host,
+		strings.Join(os.Args, " "))
+	file.Truncate(0)
+	file.WriteAt([]byte(info), 0)
+
+	s.lock = &Lock{
+		file:  file,
+		store: s,
+		count: 1,
+	}
+	return s.lock, nil
+}
+
+// lockHolder returns the description of the process holding the lock,
+// as written in the lock file.
+func lockHolder(file *os.File) string {
+	buf, err := ioutil.ReadAll(file)
+	text := strings.TrimSpace(string(buf))
+	if err != nil || text == "" {
+		return "another process"
+	}
+	return text
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	l.count--
+	if l.count > 0 {
+		return nil
+	}
+	l.store.lock = nil
+
+	l.file.Truncate(0)
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if err2 := l.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// locked calls 'fn' while holding the lock on the surefile.
+func (s *Store) locked(fn func() error) error {
+	lk, err := s.Lock()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err2 := lk.Unlock(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// LockFile returns the name of the lock file.
+func (s *Store) LockFile() string {
+	return s.makeName("lock", false)
+}
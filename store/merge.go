@@ -0,0 +1,125 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// A fileNaming names a weave file by its pathname, for files that
+// aren't part of a store.  The compression is chosen by the name of
+// the file, and the keys are those of the store.
+type fileNaming struct {
+	s    *Store
+	name string
+}
+
+func (n fileNaming) TempFile(num int, compressed bool) string {
+	base := strings.TrimSuffix(n.name, n.Codec().Ext())
+	ext := ""
+	if compressed {
+		ext = n.Codec().Ext()
+	}
+	return base + "." + strconv.Itoa(num) + ext
+}
+
+func (n fileNaming) MainFile() string   { return n.name }
+func (n fileNaming) BackupFile() string { return n.name + ".bak" }
+func (n fileNaming) IsCompressed() bool { return n.Codec() != weave.Plain }
+func (n fileNaming) Codec() weave.Codec { return weave.CodecByExt(n.name) }
+
+func (n fileNaming) SigningKey() ed25519.PrivateKey { return n.s.SignKey }
+func (n fileNaming) EncryptionKey() *weave.Key      { return n.s.EncryptKey }
+
+// A mergeDelta is a delta from one of the weave files being merged,
+// along with the weave it is in, and the name of its file.
+type mergeDelta struct {
+	delta *weave.Delta
+	input *weave.MemWeave
+	name  string
+}
+
+// Merge combines the histories of several weave files of the same
+// tree into a new weave file, 'out', which must not already exist.
+// The deltas of all of the inputs are written in order of their
+// times, keeping their names, tags, and statistics, and renumbered
+// from 1.  Deltas with the same time and contents as one already
+// written are left out.  The keys of the store are used to read the
+// inputs and write the output.  Each input is read into memory in a
+// single pass, as the lines of its weave rather than the text of
+// every delta, and the output is built in memory and written once.
+// Segmented surefiles can't be merged, as their deltas refer to the
+// segments.  Returns the number of deltas written, and the number of
+// duplicates left out.
+func (s *Store) Merge(out string, inputs []string) (int, int, error) {
+	if _, err := os.Stat(out); err == nil {
+		return 0, 0, fmt.Errorf("%q already exists", out)
+	}
+
+	var all []*mergeDelta
+	for _, name := range inputs {
+		input, err := weave.LoadMemWeave(fileNaming{s, name})
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, d := range input.Header.Deltas {
+			all = append(all, &mergeDelta{delta: d, input: input, name: name})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].delta.Time.Before(all[j].delta.Time)
+	})
+
+	merged := weave.NewMemWeave()
+	dups := 0
+	seen := make(map[string]bool)
+	for _, md := range all {
+		d := md.delta
+		lines, err := md.input.Delta(d.Number)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", md.name, err)
+		}
+		if len(lines) > 0 && lines[0] == segmentMagic {
+			return 0, 0, fmt.Errorf("%s: segmented surefiles can't be merged", md.name)
+		}
+
+		key := d.Time.UTC().Format(time.RFC3339Nano) + " " + linesDigest(lines)
+		if seen[key] {
+			dups++
+			continue
+		}
+		seen[key] = true
+
+		_, err = merged.AddDelta(d.Name, d.Tags, d.Time, d.Stats, lines)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// The output is new, so writing it leaves no backup behind.
+	err := merged.Save(fileNaming{s, out})
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(merged.Header.Deltas), dups, nil
+}
+
+// linesDigest returns the digest of the given lines, as they would be
+// written to a file.
+func linesDigest(lines []string) string {
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
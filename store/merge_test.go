@@ -0,0 +1,111 @@
+package store
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+)
+
+func TestMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	a := Store{Path: path.Join(tdir, "a")}
+	b := Store{Path: path.Join(tdir, "b")}
+	for _, dir := range []string{a.Path, b.Path} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The two share their first two deltas, and then alternate.
+	var trees []*sure.Tree
+	write := func(st *Store) {
+		t.Helper()
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&a)
+	write(&a)
+	buf, err := ioutil.ReadFile(a.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(b.MainFile(), buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		write(&a)
+		write(&b)
+	}
+
+	out := path.Join(tdir, "merged.dat.gz")
+	written, dups, err := a.Merge(out, []string{a.MainFile(), b.MainFile()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 6 || dups != 2 {
+		t.Fatalf("Merge wrote %d, skipped %d, expect 6 and 2", written, dups)
+	}
+
+	merged := Store{Path: tdir, Base: "merged"}
+	err = merged.ReadDeltas(nil, func(num int, tree *sure.Tree) error {
+		treesSame(t, trees[num-1], tree)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := merged.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Merged surefile has problems: %v", problems)
+	}
+
+	// Only the new output is written, with no backup or index
+	// beside it.
+	names, err := ioutil.ReadDir(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		switch fi.Name() {
+		case "a", "b", "merged.dat.gz":
+		default:
+			t.Errorf("Merge left %q behind", fi.Name())
+		}
+	}
+
+	_, _, err = a.Merge(out, []string{a.MainFile()})
+	if err == nil {
+		t.Fatal("Merge overwrote an existing file")
+	}
+
+	c := Store{Path: path.Join(tdir, "c"), Segmented: true}
+	err = os.Mkdir(c.Path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(&c)
+	_, _, err = a.Merge(path.Join(tdir, "seg.dat.gz"), []string{c.MainFile()})
+	if err == nil {
+		t.Fatal("Merge accepted a segmented surefile")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"path"
 	"strings"
 	"time"
+
+	"davidb.org/x/gosure/weave"
 )
 
 // Parse attempts to determine the parameters of the Store structure
@@ -25,7 +27,7 @@ func (s *Store) Parse(name string) error {
 		// The path given is a directory, use the defaults.
 		s.Path = name
 		s.Base = ""
-		s.Plain = false
+		s.setCodec(nil)
 		return nil
 	}
 
@@ -36,13 +38,10 @@ func (s *Store) Parse(name string) error {
 		return NotDir(name)
 	}
 
-	plain := true
 	base := path.Base(name)
 
-	if strings.HasSuffix(base, ".gz") {
-		base = base[:len(base)-3]
-		plain = false
-	}
+	codec := weave.CodecByExt(base)
+	base = base[:len(base)-len(codec.Ext())]
 
 	// Strip off the known suffixes.
 	ext := path.Ext(base)
@@ -53,16 +52,16 @@ func (s *Store) Parse(name string) error {
 	case ".dat", ".bak":
 		base = base[:len(base)-4]
 	case "":
-		// If no extension was given, use compression by
-		// default.
-		plain = false
+		// If no extension was given, use the compression of
+		// an existing file, or the default.
+		codec = nil
 	default:
 		return InvalidName(name)
 	}
 
 	s.Path = dir
 	s.Base = base
-	s.Plain = plain
+	s.setCodec(codec)
 
 	return nil
 }
@@ -91,11 +90,7 @@ func (s *Store) String() string {
 	if base == "" {
 		base = "2sure"
 	}
-	ext := ".gz"
-	if s.Plain {
-		ext = ""
-	}
-	return path.Join(s.Path, base+".dat"+ext)
+	return path.Join(s.Path, base+".dat"+s.Codec().Ext())
 }
 
 // Set sets the name of this store.  Used to parse the command line.
@@ -185,3 +180,110 @@ func (s *Store) FixTags() {
 		s.Name = time.Now().UTC().Format(time.RFC3339Nano)
 	}
 }
+
+// SignKeyFile wraps the store as a 'Value' to load the signing key
+// from a file given on the command line.
+type SignKeyFile struct {
+	store *Store
+	name  string
+}
+
+// NewSignKeyFile creates a new SignKeyFile, wrapping a given store.
+func NewSignKeyFile(store *Store) *SignKeyFile {
+	return &SignKeyFile{
+		store: store,
+	}
+}
+
+func (k *SignKeyFile) String() string {
+	return k.name
+}
+
+// Set loads the signing key from the named file, from the command
+// line parsing.
+func (k *SignKeyFile) Set(value string) error {
+	key, err := LoadSigningKey(value)
+	if err != nil {
+		return err
+	}
+	k.store.SignKey = key
+	k.name = value
+	return nil
+}
+
+// Type returns a descriptive name for this type, for help messages.
+func (k *SignKeyFile) Type() string {
+	return "key file"
+}
+
+// EncryptKeyFile wraps the store as a 'Value' to load the encryption
+// key from a key file given on the command line.
+type EncryptKeyFile struct {
+	store *Store
+	name  string
+}
+
+// NewEncryptKeyFile creates a new EncryptKeyFile, wrapping a given
+// store.
+func NewEncryptKeyFile(store *Store) *EncryptKeyFile {
+	return &EncryptKeyFile{
+		store: store,
+	}
+}
+
+func (k *EncryptKeyFile) String() string {
+	return k.name
+}
+
+// Set loads the encryption key from the named file, from the command
+// line parsing.
+func (k *EncryptKeyFile) Set(value string) error {
+	key, err := LoadEncryptionKey(value)
+	if err != nil {
+		return err
+	}
+	k.store.EncryptKey = key
+	k.name = value
+	return nil
+}
+
+// Type returns a descriptive name for this type, for help messages.
+func (k *EncryptKeyFile) Type() string {
+	return "key file"
+}
+
+// PassphraseFile wraps the store as a 'Value' to make the encryption
+// key from a passphrase read from a file given on the command line.
+type PassphraseFile struct {
+	store *Store
+	name  string
+}
+
+// NewPassphraseFile creates a new PassphraseFile, wrapping a given
+// store.
+func NewPassphraseFile(store *Store) *PassphraseFile {
+	return &PassphraseFile{
+		store: store,
+	}
+}
+
+func (p *PassphraseFile) String() string {
+	return p.name
+}
+
+// Set reads the passphrase from the named file, from the command line
+// parsing.
+func (p *PassphraseFile) Set(value string) error {
+	key, err := LoadPassphrase(value)
+	if err != nil {
+		return err
+	}
+	p.store.EncryptKey = key
+	p.name = value
+	return nil
+}
+
+// Type returns a descriptive name for this type, for help messages.
+func (p *PassphraseFile) Type() string {
+	return "file"
+}
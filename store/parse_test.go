@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"davidb.org/x/gosure/store"
+	"davidb.org/x/gosure/weave"
 )
 
 var parseTests = []struct {
@@ -12,40 +13,46 @@ var parseTests = []struct {
 	store store.Store
 }{
 	{"/invalid/path", store.NotDir("/invalid/path"), store.Store{
-		"", "", "", false, simpleTags(), "",
+		Tags: simpleTags(),
 	}},
 	{"/usr/bin", nil, store.Store{
-		"/usr/bin", "", "", false, simpleTags(), "",
+		Path: "/usr/bin", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/2sure.dat.gz", nil, store.Store{
-		"/usr/bin", "2sure", "", false, simpleTags(), "",
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/2sure.bak.gz", nil, store.Store{
-		"/usr/bin", "2sure", "", false, simpleTags(), "",
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/2sure.dat", nil, store.Store{
-		"/usr/bin", "2sure", "", true, simpleTags(), "",
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Plain, Plain: true, Tags: simpleTags(),
 	}},
 	{"/usr/bin/2sure.bak", nil, store.Store{
-		"/usr/bin", "2sure", "", true, simpleTags(), "",
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Plain, Plain: true, Tags: simpleTags(),
 	}},
 	{"/usr/bin/fred.dat.gz", nil, store.Store{
-		"/usr/bin", "fred", "", false, simpleTags(), "",
+		Path: "/usr/bin", Base: "fred", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/fred.dat", nil, store.Store{
-		"/usr/bin", "fred", "", true, simpleTags(), "",
+		Path: "/usr/bin", Base: "fred", Compression: weave.Plain, Plain: true, Tags: simpleTags(),
 	}},
 	{"/usr/bin/fred", nil, store.Store{
-		"/usr/bin", "fred", "", false, simpleTags(), "",
+		Path: "/usr/bin", Base: "fred", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/bogus.ext", store.InvalidName("/usr/bin/bogus.ext"), store.Store{
-		"", "", "", false, simpleTags(), "",
+		Tags: simpleTags(),
 	}},
 	{"/usr/bin/stuff.weave.gz", nil, store.Store{
-		"/usr/bin", "stuff", "weave", false, simpleTags(), "",
+		Path: "/usr/bin", Base: "stuff", Ext: "weave", Compression: weave.Gzip, Tags: simpleTags(),
 	}},
 	{"/usr/bin/stuff.weave", nil, store.Store{
-		"/usr/bin", "stuff", "weave", true, simpleTags(), "",
+		Path: "/usr/bin", Base: "stuff", Ext: "weave", Compression: weave.Plain, Plain: true, Tags: simpleTags(),
+	}},
+	{"/usr/bin/2sure.dat.zst", nil, store.Store{
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Zstd, Tags: simpleTags(),
+	}},
+	{"/usr/bin/2sure.dat.xz", nil, store.Store{
+		Path: "/usr/bin", Base: "2sure", Compression: weave.Xz, Tags: simpleTags(),
 	}},
 }
 
@@ -64,7 +71,8 @@ func TestParse(t *testing.T) {
 			t.Fatalf("Unexpected error, got %v, expect %v", err, pt.err)
 		}
 
-		if st.Path != pt.store.Path || st.Base != pt.store.Base || st.Plain != pt.store.Plain {
+		if st.Path != pt.store.Path || st.Base != pt.store.Base || st.Compression != pt.store.Compression ||
+			st.Plain != pt.store.Plain {
 			t.Fatalf("Store mismatch, got %+v, expect %+v", st, pt.store)
 		}
 	}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// Doctor looks for the remains of writes to the store that were
+// interrupted (see weave.Recover), in the surefile, the weave of file
+// contents, and the segments.  If 'repair' is true, the problems are
+// also repaired.  Since this is done whenever the store is locked,
+// there is normally nothing left to repair, unless 'repair' is false.
+func (s *Store) Doctor(repair bool) ([]weave.Repair, error) {
+	lk, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer lk.Unlock()
+
+	return s.recover(repair)
+}
+
+// recover runs weave.Recover on each of the weave files of the
+// store, and then finishes any prune of the segments that was
+// interrupted (see recoverPrune).  The lock must be held.
+func (s *Store) recover(repair bool) ([]weave.Repair, error) {
+	names := []weave.NamingConvention{s, contentsNaming{s}}
+
+	ids, err := s.segmentFileIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		names = append(names, segmentNaming{s, id})
+	}
+
+	var repairs []weave.Repair
+	seen := make(map[string]bool)
+	for _, nc := range names {
+		reps, err := weave.Recover(nc, repair)
+		for _, r := range reps {
+			// The surefile and the contents share temp files.
+			if !seen[r.Name] {
+				seen[r.Name] = true
+				repairs = append(repairs, r)
+			}
+		}
+		if err != nil {
+			return repairs, err
+		}
+	}
+
+	reps, err := s.recoverPrune(repair)
+	repairs = append(repairs, reps...)
+	return repairs, err
+}
+
+// segmentFileIDs returns the ids of every segment that has any files
+// in the segment directory, even if its weave file is missing.
+func (s *Store) segmentFileIDs() ([]string, error) {
+	dir, err := os.Open(s.segmentDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, name := range names {
+		id := strings.SplitN(name, ".", 2)[0]
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// PinTag is the tag that marks a delta as pinned.  Pinned deltas are
+// never removed by pruning.
+const PinTag = "pinned"
+
+// A Retention describes which deltas to keep when pruning a surefile.
+// Each rule keeps the most recent delta in each of the last N
+// periods (of the given length) that have deltas in them.  The most
+// recent delta, and any pinned deltas are always kept.
+type Retention struct {
+	Last    int // Keep the last N deltas.
+	Daily   int // Keep the last delta of the last N days.
+	Weekly  int // Keep the last delta of the last N weeks.
+	Monthly int // Keep the last delta of the last N months.
+}
+
+// IsEmpty returns true if the retention has no rules.  Pruning with
+// such a policy would only keep the most recent delta.
+func (r *Retention) IsEmpty() bool {
+	return r.Last <= 0 && r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0
+}
+
+// Remove returns the deltas in the header that this policy would
+// remove, oldest first.
+func (r *Retention) Remove(hdr *weave.Header) []*weave.Delta {
+	deltas := make([]*weave.Delta, len(hdr.Deltas))
+	copy(deltas, hdr.Deltas)
+
+	// Newest first.
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].Number > deltas[j].Number
+	})
+
+	keep := make(map[int]bool)
+
+	for i, d := range deltas {
+		if i == 0 || i < r.Last || IsPinned(d) {
+			keep[d.Number] = true
+		}
+	}
+
+	r.keepPeriods(deltas, r.Daily, keep, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	r.keepPeriods(deltas, r.Weekly, keep, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	r.keepPeriods(deltas, r.Monthly, keep, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	var remove []*weave.Delta
+	for i := len(deltas) - 1; i >= 0; i-- {
+		if !keep[deltas[i].Number] {
+			remove = append(remove, deltas[i])
+		}
+	}
+
+	return remove
+}
+
+// keepPeriods marks the newest delta in each of the 'count' most
+// recent periods.  'period' maps a time to a name for the period it
+// is in.  The deltas must be sorted newest first.
+func (r *Retention) keepPeriods(deltas []*weave.Delta, count int, keep map[int]bool, period func(t time.Time) string) {
+	last := ""
+	for _, d := range deltas {
+		if count <= 0 {
+			return
+		}
+
+		p := period(d.Time.Local())
+		if p == last {
+			continue
+		}
+		last = p
+
+		keep[d.Number] = true
+		count--
+	}
+}
+
+// removeDeltas removes the given deltas from the surefile, along with
+// what was recorded only for them: the file contents, and the deltas
+// of the segments of a segmented store.  The 'tags', if any, are added
+// to the latest delta that remains.
+func (s *Store) removeDeltas(nums []int, tags map[string]string) error {
+	var err error
+	if s.IsSegmented() {
+		err = s.removeSegmentedDeltas(nums, tags)
+	} else {
+		err = weave.RemoveDeltasEdit(s, nums, func(h *weave.Header) error {
+			latest := h.Deltas[len(h.Deltas)-1]
+			latest.Tags = addTags(latest.Tags, tags)
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return s.pruneContents()
+}
+
+// addTags returns a copy of 'tags' with 'more' added, or 'tags' itself
+// if there are none to add.
+func addTags(tags, more map[string]string) map[string]string {
+	if len(more) == 0 {
+		return tags
+	}
+	result := make(map[string]string)
+	for k, v := range tags {
+		result[k] = v
+	}
+	for k, v := range more {
+		result[k] = v
+	}
+	return result
+}
+
+// IsPinned returns whether the given delta has been pinned.
+func IsPinned(d *weave.Delta) bool {
+	_, ok := d.Tags[PinTag]
+	return ok
+}
+
+// Prune removes the deltas from the surefile that the retention
+// policy does not keep.  The remaining deltas are renumbered.  File
+// contents recorded with the removed deltas are removed as well, and
+// in a segmented store, so are the deltas of the segments that only
+// the removed deltas used.  Returns the deltas that were removed.
+func (s *Store) Prune(r *Retention) ([]*weave.Delta, error) {
+	lk, err := s.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer lk.Unlock()
+
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	remove := r.Remove(hdr)
+	if len(remove) == 0 {
+		return nil, nil
+	}
+
+	var nums []int
+	for _, d := range remove {
+		nums = append(nums, d.Number)
+	}
+
+	err = s.removeDeltas(nums, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return remove, nil
+}
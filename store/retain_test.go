@@ -0,0 +1,59 @@
+package store_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"davidb.org/x/gosure/store"
+	"davidb.org/x/gosure/weave"
+)
+
+func TestRetention(t *testing.T) {
+	// Make a delta every 12 hours, for 100 days.
+	start := time.Date(2018, 1, 1, 1, 0, 0, 0, time.Local)
+	hdr := weave.NewHeader()
+	for i := 0; i < 200; i++ {
+		tags := map[string]string{}
+		if i == 10 {
+			tags[store.PinTag] = "yes"
+		}
+		num := hdr.AddDelta("delta", tags)
+		hdr.Deltas[num-1].Time = start.Add(time.Duration(i) * 12 * time.Hour)
+	}
+
+	r := store.Retention{
+		Last:    3,
+		Daily:   5,
+		Weekly:  4,
+		Monthly: 3,
+	}
+
+	var kept []int
+	removed := make(map[int]bool)
+	for _, d := range r.Remove(&hdr) {
+		removed[d.Number] = true
+	}
+	for _, d := range hdr.Deltas {
+		if !removed[d.Number] {
+			kept = append(kept, d.Number)
+		}
+	}
+
+	// The last delta of each day is at 13:00.
+	expect := []int{
+		11,       // Pinned.
+		118,      // Monthly: February 28th.
+		168,      // Weekly: March 25th.
+		180,      // Monthly: March 31st.
+		182,      // Weekly: April 1st.
+		192, 194, // Daily: April 6th and 7th.
+		196,      // Daily, weekly: April 8th.
+		198, 199, // Daily, last: April 9th, last.
+		200, // Everything.
+	}
+
+	if !reflect.DeepEqual(kept, expect) {
+		t.Fatalf("Kept %v, expect %v", kept, expect)
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// RevertTag is the tag recording the delta that a reverted delta was
+// copied from.
+const RevertTag = "reverted-from"
+
+// Revert makes an older delta current again, by writing its tree as a
+// new delta, tagged with RevertTag, along with the store's tags.  Any
+// file contents recorded with the older delta are recorded again.  The
+// history after the older delta is kept.  Returns the number of the
+// delta that was reverted to.
+func (s *Store) Revert(num int) (int, error) {
+	s.FixTags()
+	tags := make(map[string]string)
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+
+	err := s.locked(func() error {
+		var err error
+		num, err = s.GetDelta(num)
+		if err != nil {
+			return err
+		}
+		latest, err := s.GetDelta(DeltaLatest)
+		if err != nil {
+			return err
+		}
+		if num == latest {
+			return fmt.Errorf("delta %d is already the latest", num)
+		}
+
+		tree, err := s.readTree(num)
+		if err != nil {
+			return err
+		}
+		current, err := s.readTree(latest)
+		if err != nil {
+			return err
+		}
+
+		contents, err := s.DeltaContents(num)
+		if err != nil {
+			return err
+		}
+
+		tags[RevertTag] = strconv.Itoa(num)
+		when := time.Now()
+		err = s.writeDelta(tree, latest, s.Name, tags, when,
+			treeStats(tree, ChangeStats(current, tree)))
+		if err != nil || contents == nil {
+			return err
+		}
+		return s.writeContents(contents, s.Name, when)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return num, nil
+}
+
+// TruncatedTag is added to the latest delta by Truncate, giving the
+// chain value of the newest delta removed.
+const TruncatedTag = "truncated"
+
+// Truncate removes every delta after the given one, so that it is the
+// latest again.  Unlike Revert, the history after it is lost, although
+// the previous surefile is kept as the backup, as with any other
+// change.  The delta is tagged with TruncatedTag.  In a segmented store, the deltas of the segments that only
+// the removed deltas used are removed too.  Returns the deltas that
+// were removed.
+func (s *Store) Truncate(num int) ([]*weave.Delta, error) {
+	var removed []*weave.Delta
+	err := s.locked(func() error {
+		var err error
+		num, err = s.GetDelta(num)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := s.ReadHeader()
+		if err != nil {
+			return err
+		}
+
+		found := false
+		var nums []int
+		for _, d := range hdr.Deltas {
+			if d.Number == num {
+				found = true
+			} else if found {
+				removed = append(removed, d)
+				nums = append(nums, d.Number)
+			}
+		}
+		if !found {
+			return fmt.Errorf("delta %d not present", num)
+		}
+		if len(nums) == 0 {
+			return nil
+		}
+
+		// Record the removal, so that VerifyChain can tell it
+		// from the newest history having been cut off.
+		newest := removed[len(removed)-1]
+		return s.removeDeltas(nums, map[string]string{TruncatedTag: newest.Chain})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
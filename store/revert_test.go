@@ -0,0 +1,98 @@
+package store
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+func TestRevert(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	var trees []*sure.Tree
+	for i := 0; i < 4; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	num, err := st.Revert(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 2 {
+		t.Fatalf("Reverted to %d, expect 2", num)
+	}
+	tree, err := st.ReadDat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	treesSame(t, trees[1], tree)
+
+	hdr, err := st.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.Deltas) != 5 {
+		t.Fatalf("Expecting 5 deltas, got %d", len(hdr.Deltas))
+	}
+	if hdr.Deltas[4].Tags[RevertTag] != "2" {
+		t.Fatalf("Reverted delta tags: %v", hdr.Deltas[4].Tags)
+	}
+
+	_, err = st.Revert(DeltaLatest)
+	if err == nil {
+		t.Fatal("Reverting to the latest delta should fail")
+	}
+
+	removed, err := st.Truncate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0].Number != 4 || removed[1].Number != 5 {
+		t.Fatalf("Truncate removed %v", removed)
+	}
+	tree, err = st.ReadDat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	treesSame(t, trees[2], tree)
+
+	_, problems, err := st.VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Truncated store has problems: %v", problems)
+	}
+
+	// Cutting off the newest deltas any other way is found.
+	err = weave.RemoveDeltas(&st, []int{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err = st.VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Msg, "missing deltas 3 to 3") {
+		t.Fatalf("Cut off deltas not found: %v", problems)
+	}
+}
@@ -0,0 +1,918 @@
+package store
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+// A segmented store keeps each top-level directory of the tree in a
+// weave file of its own, in a directory next to the surefile.  The
+// attributes of the top directory, and the files directly within it,
+// are kept in the "root" segment.  Each delta of the surefile itself
+// is then a manifest, giving the delta of each segment that makes up
+// the tree.  An update only adds deltas to the segments that have
+// changed, so the rest of the files don't have to be rewritten.
+//
+// The manifest is text, starting with segmentMagic, followed by a
+// line for each segment:
+//
+//	<id> <delta> <digest>
+//
+// where the digest is the SHA-256 of the text of the segment's delta,
+// so that a segment can't be replaced without changing the manifest.
+
+// segmentMagic is the first line of the text of a manifest delta.
+const segmentMagic = "asure-segments-1"
+
+// rootSegment is the id of the segment holding the top directory.
+const rootSegment = "root"
+
+// A segment refers to one delta of a segment weave.
+type segment struct {
+	ID     string
+	Delta  int
+	Digest string
+}
+
+// segmentID returns the id of the segment holding the top-level
+// directory with the given name.  The names can contain anything, so
+// they are hashed to make names for the files.
+func segmentID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// IsSegmented returns whether this store has been written as a
+// segmented store.  Once it has, all new deltas are written that way.
+func (s *Store) IsSegmented() bool {
+	fi, err := os.Stat(s.segmentDir())
+	return err == nil && fi.IsDir()
+}
+
+// segmentDir returns the name of the directory holding the segments.
+func (s *Store) segmentDir() string {
+	return s.makeName("seg", false)
+}
+
+// segmentIDs returns the ids of all of the segments in the segment
+// directory.
+func (s *Store) segmentIDs() ([]string, error) {
+	dir, err := os.Open(s.segmentDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, name := range names {
+		if id := strings.TrimSuffix(name, ".dat"+s.Codec().Ext()); id != name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// A segmentNaming is the naming convention for the weave file of a
+// single segment.  The segments share the compression and keys of the
+// store.
+type segmentNaming struct {
+	s  *Store
+	id string
+}
+
+func (n segmentNaming) name(ext string, compressed bool) string {
+	if compressed {
+		ext += n.s.Codec().Ext()
+	}
+	return path.Join(n.s.segmentDir(), n.id+"."+ext)
+}
+
+func (n segmentNaming) TempFile(num int, compressed bool) string {
+	return n.name(strconv.Itoa(num), compressed)
+}
+
+func (n segmentNaming) MainFile() string   { return n.name("dat", true) }
+func (n segmentNaming) BackupFile() string { return n.name("bak", true) }
+func (n segmentNaming) IndexFile() string  { return n.name("idx", false) }
+func (n segmentNaming) IsCompressed() bool { return n.s.IsCompressed() }
+func (n segmentNaming) Codec() weave.Codec { return n.s.Codec() }
+
+func (n segmentNaming) SigningKey() ed25519.PrivateKey { return n.s.SignKey }
+func (n segmentNaming) EncryptionKey() *weave.Key      { return n.s.EncryptKey }
+
+// writeSegments writes the tree as a new delta of a segmented store.
+// 'base' is the previous delta of the surefile, or 0 if there is
+// none.  Segments that are the same as in the base are not written
+// again.
+func (s *Store) writeSegments(tree *sure.Tree, base int, name string, tags map[string]string, when time.Time, stats map[string]int64) error {
+	prev := make(map[string]segment)
+	if base > 0 {
+		man, err := s.readManifest(base)
+		if err != nil {
+			return err
+		}
+		for _, seg := range man {
+			prev[seg.ID] = seg
+		}
+	}
+
+	err := os.MkdirAll(s.segmentDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	root := &sure.Tree{
+		Name:  tree.Name,
+		Atts:  tree.Atts,
+		Files: tree.Files,
+	}
+	seg, err := s.writeSegment(rootSegment, root, prev, name, when)
+	if err != nil {
+		return err
+	}
+	man := []segment{seg}
+
+	seen := make(map[string]string)
+	for _, child := range tree.Children {
+		id := segmentID(child.Name)
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("directories %q and %q have the same segment id", other, child.Name)
+		}
+		seen[id] = child.Name
+
+		seg, err := s.writeSegment(id, child, prev, name, when)
+		if err != nil {
+			return err
+		}
+		man = append(man, seg)
+	}
+
+	var wr io.WriteCloser
+	if base > 0 {
+		wr, err = weave.NewDeltaWriterAt(s, base, name, tags, when, stats)
+	} else {
+		wr, err = weave.NewNewWeaveAt(s, name, tags, when, stats)
+	}
+	if err != nil {
+		return err
+	}
+	// As above, don't close this if there is a problem.
+
+	err = encodeManifest(wr, man)
+	if err != nil {
+		return err
+	}
+
+	return wr.Close()
+}
+
+// writeSegment writes a tree as a new delta of a segment, unless it is
+// the same as the segment's delta in 'prev'.  Returns the manifest
+// entry for the segment.
+func (s *Store) writeSegment(id string, tree *sure.Tree, prev map[string]segment, name string, when time.Time) (segment, error) {
+	h := sha256.New()
+	err := tree.Encode(h)
+	if err != nil {
+		return segment{}, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	if old, ok := prev[id]; ok && old.Digest == digest {
+		return old, nil
+	}
+
+	nc := segmentNaming{s, id}
+	err = appendWeave(nc, name, nil, when, nil, tree.Encode)
+	if err != nil {
+		return segment{}, err
+	}
+
+	hdr, err := weave.ReadHeader(nc)
+	if err != nil {
+		return segment{}, err
+	}
+
+	return segment{ID: id, Delta: hdr.LatestDelta(), Digest: digest}, nil
+}
+
+// encodeManifest writes the text of a manifest.
+func encodeManifest(w io.Writer, man []segment) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "%s\n", segmentMagic)
+	for _, seg := range man {
+		fmt.Fprintf(out, "%s %d %s\n", seg.ID, seg.Delta, seg.Digest)
+	}
+	return out.Flush()
+}
+
+// parseManifest decodes the lines of a manifest, after the magic
+// line.
+func parseManifest(lines []string) ([]segment, error) {
+	var man []segment
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: invalid manifest entry %q", i+2, line)
+		}
+		num, err := strconv.Atoi(fields[1])
+		if err != nil || num < 1 {
+			return nil, fmt.Errorf("line %d: invalid segment delta %q", i+2, fields[1])
+		}
+		man = append(man, segment{ID: fields[0], Delta: num, Digest: fields[2]})
+	}
+	if len(man) == 0 || man[0].ID != rootSegment {
+		return nil, errors.New("manifest doesn't start with the root segment")
+	}
+	return man, nil
+}
+
+// errNotManifest stops reading a delta that isn't a manifest.
+var errNotManifest = errors.New("not a manifest")
+
+// readManifest reads the manifest of the given delta.  Returns nil if
+// the delta holds a plain tree.
+func (s *Store) readManifest(num int) ([]segment, error) {
+	var lines []string
+	first := true
+	err := weave.ReadDelta(s, num, func(text string) error {
+		if first {
+			first = false
+			if text != segmentMagic {
+				return errNotManifest
+			}
+			return nil
+		}
+		lines = append(lines, text)
+		return nil
+	})
+	if err == errNotManifest || (err == io.EOF && first) {
+		return nil, nil
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	man, err := parseManifest(lines)
+	if err != nil {
+		return nil, &DecodeError{Delta: num, Err: err}
+	}
+	return man, nil
+}
+
+// readManifests reads the manifests of the given deltas of a weave
+// file, or of every delta if 'deltas' is empty, in a single pass.
+// Deltas holding plain trees are left out.
+func readManifests(nc weave.NamingConvention, deltas []int) (map[int][]segment, error) {
+	lines := make(map[int][]string)
+	plain := make(map[int]bool)
+	err := weave.ReadDeltas(nc, deltas, func(delta int, text string) error {
+		if man, ok := lines[delta]; ok {
+			lines[delta] = append(man, text)
+		} else if !plain[delta] {
+			if text == segmentMagic {
+				lines[delta] = nil
+			} else {
+				plain[delta] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mans := make(map[int][]segment)
+	for delta, man := range lines {
+		mans[delta], err = parseManifest(man)
+		if err != nil {
+			return nil, &DecodeError{Delta: delta, Err: err}
+		}
+	}
+	return mans, nil
+}
+
+// readSegment gives each line of the text of a segment's delta to
+// 'fn', and then checks that the text matches the manifest.
+func (s *Store) readSegment(seg segment, fn func(text string) error) error {
+	h := sha256.New()
+	err := weave.ReadDelta(segmentNaming{s, seg.ID}, seg.Delta, func(text string) error {
+		h.Write([]byte(text))
+		h.Write([]byte{'\n'})
+		return fn(text)
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", seg.ID, err)
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != seg.Digest {
+		return fmt.Errorf("segment %s: delta %d does not match the manifest", seg.ID, seg.Delta)
+	}
+	return nil
+}
+
+// A segmentCache holds the trees of segments that have already been
+// read, so that segments shared by several deltas are only read once.
+type segmentCache map[segment]*sure.Tree
+
+// segmentTree reads the tree held in a segment.
+func (s *Store) segmentTree(seg segment, cache segmentCache) (*sure.Tree, error) {
+	if tree, ok := cache[seg]; ok {
+		return tree, nil
+	}
+
+	pd := sure.NewPushDecoder()
+	line := 0
+	err := s.readSegment(seg, func(text string) error {
+		line++
+		err := pd.Add(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := pd.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: at end: %v", seg.ID, err)
+	}
+
+	if cache != nil {
+		cache[seg] = tree
+	}
+	return tree, nil
+}
+
+// assemble builds the whole tree from the segments of a manifest.
+// The manifest lists the directories in the order of the tree that
+// was written.
+// Segment trees may be shared with other trees built with the same
+// cache.
+func (s *Store) assemble(man []segment, cache segmentCache) (*sure.Tree, error) {
+	root, err := s.segmentTree(man[0], cache)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &sure.Tree{
+		Name:  root.Name,
+		Atts:  root.Atts,
+		Files: root.Files,
+	}
+	for _, seg := range man[1:] {
+		child, err := s.segmentTree(seg, cache)
+		if err != nil {
+			return nil, err
+		}
+		tree.Children = append(tree.Children, child)
+	}
+
+	return tree, nil
+}
+
+// A treeDecoder decodes the text of a delta, which can either be a
+// plain tree, or the manifest of a segmented store.
+type treeDecoder struct {
+	delta int
+	line  int
+	pd    *sure.PushDecoder
+	man   []string // The lines of a manifest, after the magic.
+	isMan bool
+}
+
+func newTreeDecoder(delta int) *treeDecoder {
+	return &treeDecoder{
+		delta: delta,
+		pd:    sure.NewPushDecoder(),
+	}
+}
+
+// Add gives the decoder another line of the delta's text.
+func (d *treeDecoder) Add(text string) error {
+	d.line++
+	if d.line == 1 && text == segmentMagic {
+		d.isMan = true
+		d.pd = nil
+		return nil
+	}
+	if d.isMan {
+		d.man = append(d.man, text)
+		return nil
+	}
+
+	err := d.pd.Add(text)
+	if err != nil {
+		return &DecodeError{Delta: d.delta, Line: d.line, Err: err}
+	}
+	return nil
+}
+
+// Tree returns the decoded tree, reading the segments if this is a
+// manifest.
+func (d *treeDecoder) Tree(s *Store, cache segmentCache) (*sure.Tree, error) {
+	if !d.isMan {
+		tree, err := d.pd.Tree()
+		if err != nil {
+			return nil, &DecodeError{Delta: d.delta, Err: err}
+		}
+		return tree, nil
+	}
+
+	man, err := parseManifest(d.man)
+	if err != nil {
+		return nil, &DecodeError{Delta: d.delta, Err: err}
+	}
+	return s.assemble(man, cache)
+}
+
+// Recompress rewrites the surefile, any segments, and the weave of
+// file contents, using the compression of 'dest', which must name the
+// same store.  The compression of 's' must be set.  When the names of
+// the files change, the old ones are removed once everything has been
+// written.
+func (s *Store) Recompress(dest *Store) error {
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	same := dest.MainFile() == s.MainFile()
+
+	for _, id := range ids {
+		err = weave.Recompress(segmentNaming{s, id}, segmentNaming{dest, id})
+		if err != nil {
+			return err
+		}
+	}
+
+	cn := contentsNaming{s}
+	_, err = os.Stat(cn.MainFile())
+	hasContents := err == nil
+	if hasContents {
+		err = weave.Recompress(cn, contentsNaming{dest})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = weave.Recompress(s, dest)
+	if err != nil {
+		return err
+	}
+
+	if !same {
+		// The old files are no longer needed, as the new
+		// files contain the whole history.
+		os.Remove(s.MainFile())
+		os.Remove(s.BackupFile())
+		for _, id := range ids {
+			nc := segmentNaming{s, id}
+			os.Remove(nc.MainFile())
+			os.Remove(nc.BackupFile())
+		}
+		if hasContents {
+			os.Remove(cn.MainFile())
+			os.Remove(cn.BackupFile())
+		}
+	}
+
+	return nil
+}
+
+// Encrypt encrypts the surefile, any segments, and the weave of file
+// contents, with the store's key, if they were written without one.
+// A key given for a store that isn't encrypted is otherwise refused
+// (see weave.ErrNotEncrypted).  The unencrypted files aren't kept as
+// backups.  The surefile is done last, so that an interrupted Encrypt
+// can just be run again.
+func (s *Store) Encrypt() error {
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	var names []weave.NamingConvention
+	for _, id := range ids {
+		names = append(names, segmentNaming{s, id})
+	}
+	cn := contentsNaming{s}
+	if _, err := os.Stat(cn.MainFile()); err == nil {
+		names = append(names, cn)
+	}
+	names = append(names, s)
+
+	for _, nc := range names {
+		err = weave.Encrypt(nc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentProblems runs 'check' on the weave file of each segment, and
+// returns the problems found, marked as being in the segment.
+func (s *Store) segmentProblems(check func(nc weave.NamingConvention) ([]weave.Problem, error)) ([]weave.Problem, error) {
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []weave.Problem
+	for _, id := range ids {
+		probs, err := check(segmentNaming{s, id})
+		if err != nil {
+			probs = []weave.Problem{{Msg: err.Error()}}
+		}
+		for _, p := range probs {
+			p.Msg += fmt.Sprintf(" (in segment %s)", id)
+			problems = append(problems, p)
+		}
+	}
+	return problems, nil
+}
+
+// removeSegmentedDeltas removes deltas from a segmented surefile.  The
+// deltas of each segment that are no longer in any remaining manifest
+// are removed from the segment's weave file, and segments no longer
+// used at all are removed entirely.  As the remaining deltas of the
+// segments are renumbered, the manifests are rewritten to match.  The
+// 'tags' are added to the latest delta that remains.
+//
+// The new surefile is installed before any of the segments are
+// changed, with a plan of the changes to the segments written to the
+// prune file beforehand, so that recover can finish the job if it is
+// interrupted.  The manifests of the previous surefile don't match
+// the segments afterwards, so the backup is replaced with a copy of
+// the new surefile.
+func (s *Store) removeSegmentedDeltas(remove []int, tags map[string]string) error {
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	gone := make(map[int]bool)
+	for _, num := range remove {
+		gone[num] = true
+	}
+	var kept []int
+	for _, d := range hdr.Deltas {
+		if !gone[d.Number] {
+			kept = append(kept, d.Number)
+		}
+	}
+	if len(kept)+len(remove) != len(hdr.Deltas) {
+		return errors.New("deltas to remove not present")
+	}
+	if len(kept) == 0 {
+		return errors.New("cannot remove every delta")
+	}
+
+	mans, err := readManifests(s, kept)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]map[int]bool)
+	for _, man := range mans {
+		for _, seg := range man {
+			if used[seg.ID] == nil {
+				used[seg.ID] = make(map[int]bool)
+			}
+			used[seg.ID][seg.Delta] = true
+		}
+	}
+
+	// The deltas of each segment to remove, and the numbers the
+	// rest will have afterwards.
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+	var plan []segmentPrune
+	renumber := make(map[string]map[int]int)
+	for _, id := range ids {
+		shdr, err := weave.ReadHeader(segmentNaming{s, id})
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", id, err)
+		}
+
+		renumber[id] = make(map[int]int)
+		sp := segmentPrune{ID: id, Deltas: len(shdr.Deltas)}
+		for _, d := range shdr.Deltas {
+			if used[id][d.Number] {
+				renumber[id][d.Number] = len(renumber[id]) + 1
+			} else {
+				sp.Remove = append(sp.Remove, d.Number)
+			}
+		}
+		if len(sp.Remove) > 0 {
+			plan = append(plan, sp)
+		}
+	}
+
+	// The digests of the renumbered manifests.
+	digests := make(map[int]string)
+	for delta, man := range mans {
+		for i, seg := range man {
+			num := renumber[seg.ID][seg.Delta]
+			if num == 0 {
+				return fmt.Errorf("segment %s: delta %d missing", seg.ID, seg.Delta)
+			}
+			man[i].Delta = num
+		}
+		h := sha256.New()
+		err = encodeManifest(h, man)
+		if err != nil {
+			return err
+		}
+		digests[delta] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	err = writePrunePlan(s.pruneFile(), len(kept), plan)
+	if err != nil {
+		return err
+	}
+
+	err = weave.RemoveDeltasRewrite(s, remove, func(h *weave.Header) error {
+		for i, d := range h.Deltas {
+			if digest, ok := digests[kept[i]]; ok {
+				d.Digest = digest
+			}
+		}
+		latest := h.Deltas[len(h.Deltas)-1]
+		latest.Tags = addTags(latest.Tags, tags)
+		return nil
+	}, func(text string) (string, error) {
+		// Only the lines of manifests are changed.  The lines of
+		// trees never have a segment id and a number as their
+		// first two fields.
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return text, nil
+		}
+		num, err := strconv.Atoi(fields[1])
+		if err != nil || renumber[fields[0]][num] == 0 {
+			return text, nil
+		}
+		return fmt.Sprintf("%s %d %s", fields[0], renumber[fields[0]][num], fields[2]), nil
+	})
+
+	// Either finish the job, or, if the new surefile wasn't
+	// installed, remove the plan.
+	_, err2 := s.recoverPrune(true)
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// A segmentPrune is the part of the plan for a prune of a segmented
+// store that describes the change to one segment: the deltas to
+// remove from it, and the number of deltas it has beforehand.  When
+// every delta is removed, so is the segment.
+type segmentPrune struct {
+	ID     string
+	Deltas int
+	Remove []int
+}
+
+// pruneFile returns the name of the file holding the plan for a prune
+// of a segmented store that is in progress.
+func (s *Store) pruneFile() string {
+	return s.makeName("prune", false)
+}
+
+// writePrunePlan writes the plan for a prune of a segmented store.
+// The first line gives the number of deltas the surefile will have
+// afterwards, followed by a line for each segment to change:
+//
+//	<id> <deltas> <remove>...
+func writePrunePlan(name string, deltas int, plan []segmentPrune) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(file)
+	fmt.Fprintf(out, "%d\n", deltas)
+	for _, sp := range plan {
+		fmt.Fprintf(out, "%s %d", sp.ID, sp.Deltas)
+		for _, num := range sp.Remove {
+			fmt.Fprintf(out, " %d", num)
+		}
+		fmt.Fprintf(out, "\n")
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// readPrunePlan reads the plan written by writePrunePlan.
+func readPrunePlan(name string) (int, []segmentPrune, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	var deltas int
+	var plan []segmentPrune
+	scan := bufio.NewScanner(file)
+	for line := 1; scan.Scan(); line++ {
+		fields := strings.Fields(scan.Text())
+		if line == 1 {
+			if len(fields) != 1 {
+				return 0, nil, fmt.Errorf("%s: invalid prune plan", name)
+			}
+			deltas, err = strconv.Atoi(fields[0])
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s: invalid prune plan", name)
+			}
+			continue
+		}
+
+		if len(fields) < 3 {
+			return 0, nil, fmt.Errorf("%s:%d: invalid prune plan", name, line)
+		}
+		sp := segmentPrune{ID: fields[0]}
+		for i, field := range fields[1:] {
+			num, err := strconv.Atoi(field)
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s:%d: invalid prune plan", name, line)
+			}
+			if i == 0 {
+				sp.Deltas = num
+			} else {
+				sp.Remove = append(sp.Remove, num)
+			}
+		}
+		plan = append(plan, sp)
+	}
+	if err := scan.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return deltas, plan, nil
+}
+
+// recoverPrune finishes a prune of a segmented store, if the prune
+// file shows one was in progress.  If the new surefile was installed,
+// the segments are changed following the plan, and the backup is
+// replaced with a copy of the surefile.  Otherwise, the surefile and
+// segments were never changed, and the plan is just removed.  The
+// lock must be held.
+func (s *Store) recoverPrune(repair bool) ([]weave.Repair, error) {
+	name := s.pruneFile()
+	deltas, plan, err := readPrunePlan(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hdr, err := s.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	installed := len(hdr.Deltas) == deltas
+
+	r := weave.Repair{
+		Name:    name,
+		Problem: "interrupted prune",
+		Action:  "removed",
+	}
+	if installed {
+		r.Problem = "prune of the segments not finished"
+		r.Action = "finished"
+	}
+	if !repair {
+		return []weave.Repair{r}, nil
+	}
+
+	if installed {
+		for _, sp := range plan {
+			err = s.pruneSegment(sp)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = s.matchBackup()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		return nil, err
+	}
+	r.Done = true
+	return []weave.Repair{r}, nil
+}
+
+// pruneSegment removes deltas from a segment, as described by the
+// plan.  Segments that have already had the deltas removed are left
+// alone.
+func (s *Store) pruneSegment(sp segmentPrune) error {
+	nc := segmentNaming{s, sp.ID}
+	if len(sp.Remove) == sp.Deltas {
+		// Nothing refers to the segment any more.
+		for _, name := range []string{nc.MainFile(), nc.BackupFile(), nc.IndexFile()} {
+			err := os.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	hdr, err := weave.ReadHeader(nc)
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", sp.ID, err)
+	}
+	switch len(hdr.Deltas) {
+	case sp.Deltas:
+		err = weave.RemoveDeltas(nc, sp.Remove)
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", sp.ID, err)
+		}
+	case sp.Deltas - len(sp.Remove):
+	default:
+		return fmt.Errorf("segment %s: has %d deltas, expecting %d to prune", sp.ID, len(hdr.Deltas), sp.Deltas)
+	}
+	return nil
+}
+
+// matchBackup replaces the backup of the surefile with a copy of the
+// surefile.
+func (s *Store) matchBackup() error {
+	err := os.Remove(s.BackupFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(s.MainFile(), s.BackupFile()) == nil {
+		return nil
+	}
+
+	src, err := os.Open(s.MainFile())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := weave.TempFile(s, true)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), s.BackupFile())
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
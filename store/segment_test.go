@@ -0,0 +1,356 @@
+package store
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
+)
+
+func TestSegmented(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	// Replace one of the top-level directories with a new one of the
+	// same name.
+	change := func(tr *sure.Tree, k int) *sure.Tree {
+		nt := *tr
+		nt.Children = append([]*sure.Tree(nil), tr.Children...)
+		child := sure.GenerateTree(r, 10, 2)
+		child.Name = tr.Children[k].Name
+		nt.Children[k] = child
+		return &nt
+	}
+
+	tr := sure.GenerateTree(r, 10, 3)
+	for len(tr.Children) < 3 {
+		tr = sure.GenerateTree(r, 10, 3)
+	}
+	// Names that can be looked up with PathHistory.
+	tr.Files[0].Name = "top"
+	tr.Children[1].Name = "sub"
+	tr.Children[1].Files[0].Name = "file"
+
+	// An existing plain store is converted by the next write.
+	trees := []*sure.Tree{tr}
+	err = st.Write(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.IsSegmented() {
+		t.Fatal("Plain store is segmented")
+	}
+	st.Segmented = true
+	for i := 0; i < 4; i++ {
+		tr = change(tr, 0)
+		trees = append(trees, tr)
+		err = st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Once segmented, it stays that way.
+		st.Segmented = false
+	}
+	if !st.IsSegmented() {
+		t.Fatal("Store is not segmented")
+	}
+
+	// Only the changed directory has more than one delta.
+	for k, child := range tr.Children {
+		hdr, err := weave.ReadHeader(segmentNaming{&st, segmentID(child.Name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := 1
+		if k == 0 {
+			expect = 4
+		}
+		if len(hdr.Deltas) != expect {
+			t.Fatalf("Segment %d has %d deltas, expect %d", k, len(hdr.Deltas), expect)
+		}
+	}
+
+	for i, tree := range trees {
+		got, err := st.ReadDelta(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treesSame(t, tree, got)
+	}
+	count := 0
+	err = st.ReadDeltas(nil, func(num int, tree *sure.Tree) error {
+		count++
+		treesSame(t, trees[num-1], tree)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(trees) {
+		t.Fatalf("Read %d deltas, expect %d", count, len(trees))
+	}
+
+	// The history of paths in the root, and in the segments.
+	for _, name := range []string{".", "top", "sub", "sub/file"} {
+		hist, err := st.PathHistory(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pv := range hist {
+			if pv.Atts == nil {
+				t.Fatalf("%q not found in delta %d", name, pv.Delta.Number)
+			}
+		}
+	}
+
+	problems, err := st.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Segmented store has problems: %v", problems)
+	}
+	_, problems, err = st.VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Segmented store has problems: %v", problems)
+	}
+
+	// The segments are recompressed along with the surefile.
+	st.Compression = st.Codec()
+	dest := st
+	dest.Compression = weave.Plain
+	err = st.Recompress(&dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = Store{Path: tdir}
+	if st.Codec() != weave.Plain {
+		t.Fatal("Store was not recompressed")
+	}
+	got, err := st.ReadDat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	treesSame(t, tr, got)
+
+	// A segment can't be replaced with another.
+	a := segmentNaming{&st, segmentID(tr.Children[1].Name)}
+	b := segmentNaming{&st, segmentID(tr.Children[2].Name)}
+	os.Remove(a.IndexFile())
+	err = os.Rename(b.MainFile(), a.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.ReadDat()
+	if err == nil || !strings.Contains(err.Error(), "does not match the manifest") {
+		t.Fatalf("Replaced segment not detected: %v", err)
+	}
+}
+
+// Removing deltas from a segmented store removes the segment deltas
+// that only they used.
+func TestSegmentedPrune(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	st := Store{Path: tdir}
+
+	tr := sure.GenerateTree(r, 10, 3)
+	for len(tr.Children) < 2 {
+		tr = sure.GenerateTree(r, 10, 3)
+	}
+	trees := []*sure.Tree{tr}
+	err = st.Write(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Segmented = true
+	for i := 0; i < 4; i++ {
+		nt := *tr
+		nt.Children = append([]*sure.Tree(nil), tr.Children...)
+		child := sure.GenerateTree(r, 10, 2)
+		child.Name = tr.Children[0].Name
+		nt.Children[0] = child
+		tr = &nt
+		trees = append(trees, tr)
+		err = st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(expect []*sure.Tree, segDeltas int) {
+		t.Helper()
+		hdr, err := weave.ReadHeader(segmentNaming{&st, segmentID(tr.Children[0].Name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hdr.Deltas) != segDeltas {
+			t.Fatalf("Segment has %d deltas, expect %d", len(hdr.Deltas), segDeltas)
+		}
+		for i, tree := range expect {
+			got, err := st.ReadDelta(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			treesSame(t, tree, got)
+		}
+		problems, err := st.Fsck()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != 0 {
+			t.Fatalf("Pruned store has problems: %v", problems)
+		}
+		_, problems, err = st.VerifyChain(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != 0 {
+			t.Fatalf("Pruned store has chain problems: %v", problems)
+		}
+
+		// The backup matches the segments as well.
+		for i, tree := range expect {
+			td := newTreeDecoder(i + 1)
+			err = weave.ReadDelta(backupNaming{&st}, i+1, td.Add)
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			got, err := td.Tree(&st, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			treesSame(t, tree, got)
+		}
+	}
+
+	_, err = st.Truncate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees = trees[:4]
+	check(trees, 3)
+
+	// The first segmented delta.
+	err = st.locked(func() error {
+		return st.removeDeltas([]int{2}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check([]*sure.Tree{trees[0], trees[2], trees[3]}, 2)
+
+	// Interrupt a prune once the new surefile is in place, by
+	// putting a directory where the backup of a segment goes.
+	nc := segmentNaming{&st, segmentID(tr.Children[0].Name)}
+	err = os.Remove(nc.BackupFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(nc.BackupFile(), "x"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.locked(func() error {
+		return st.removeDeltas([]int{2}, nil)
+	})
+	if err == nil {
+		t.Fatal("Prune should have failed")
+	}
+	err = os.RemoveAll(nc.BackupFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Until then, the backup is the old surefile, which matches the
+	// new one by the digests of the segments in the manifests, but
+	// not if any of them differ.
+	_, problems, err := st.VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Interrupted prune has chain problems: %v", problems)
+	}
+	hdr, err := st.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bhdr, err := weave.ReadHeader(backupNaming{&st})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := deltaKeys(&st, hdr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkeys, err := deltaKeys(backupNaming{&st}, bhdr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pruned(bhdr, hdr, bkeys, keys) {
+		t.Fatal("Pruned surefile doesn't match the backup")
+	}
+	bkeys[len(bhdr.Deltas)] = strings.Replace(bkeys[len(bhdr.Deltas)], " ", " 0", 1)
+	if pruned(bhdr, hdr, bkeys, keys) {
+		t.Fatal("Changed segment not detected")
+	}
+
+	// The segment's temp file is also left behind.  The prune is
+	// finished after that is cleaned up.
+	repairs, err := st.Doctor(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := repairs[len(repairs)-1]
+	if last.Name != st.pruneFile() || last.Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+	repairs, err = st.Doctor(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last = repairs[len(repairs)-1]
+	if last.Name != st.pruneFile() || !last.Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+	check([]*sure.Tree{trees[0], trees[3]}, 1)
+
+	// A plan for a surefile that was never installed is only
+	// removed.
+	err = writePrunePlan(st.pruneFile(), 1, []segmentPrune{{ID: nc.id, Deltas: 1, Remove: []int{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairs, err = st.Doctor(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || repairs[0].Action != "removed" || !repairs[0].Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+	check([]*sure.Tree{trees[0], trees[3]}, 1)
+}
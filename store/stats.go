@@ -0,0 +1,47 @@
+package store
+
+import "davidb.org/x/gosure/sure"
+
+// The names of the statistics recorded in the header for each delta.
+// The counts of the tree itself are always recorded.  The others are
+// only present when the delta was written by a scan or update.
+const (
+	StatDirs    = "dirs"     // Number of directories.
+	StatFiles   = "files"    // Number of regular files.
+	StatLinks   = "symlinks" // Number of symbolic links.
+	StatOthers  = "others"   // Number of devices, fifos, and sockets.
+	StatBytes   = "bytes"    // Total size of the regular files.
+	StatHashed  = "hashed"   // Bytes of files that were hashed.
+	StatReused  = "reused"   // Bytes of files whose hash was reused from the previous delta.
+	StatAdded   = "added"    // Nodes added since the previous delta.
+	StatRemoved = "removed"  // Nodes removed since the previous delta.
+	StatChanged = "changed"  // Nodes changed since the previous delta.
+)
+
+// ChangeStats returns the statistics describing how 'newer' differs
+// from 'older'.
+func ChangeStats(older, newer *sure.Tree) map[string]int64 {
+	ch := sure.CountChanges(older, newer)
+	return map[string]int64{
+		StatAdded:   ch.Added,
+		StatRemoved: ch.Removed,
+		StatChanged: ch.Changed,
+	}
+}
+
+// treeStats returns the statistics for a delta holding the given
+// tree, along with any extra statistics given.
+func treeStats(tree *sure.Tree, extra map[string]int64) map[string]int64 {
+	c := tree.Count()
+	stats := map[string]int64{
+		StatDirs:   c.Dirs,
+		StatFiles:  c.Files,
+		StatLinks:  c.Links,
+		StatOthers: c.Others,
+		StatBytes:  c.Bytes,
+	}
+	for k, v := range extra {
+		stats[k] = v
+	}
+	return stats
+}
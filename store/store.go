@@ -1,13 +1,17 @@
 package store // import "davidb.org/x/gosure/store"
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"time"
 
 	"davidb.org/x/gosure/sure"
 	"davidb.org/x/gosure/weave"
@@ -17,28 +21,61 @@ import (
 // values will result in a the files "./2sure.dat.gz" and the likes
 // being used.
 type Store struct {
-	Path  string            // The directory where the surefiles will be written.
-	Base  string            // The initial part of the name.
-	Ext   string            // The extension to use "normally dat"
-	Plain bool              // Plain indicates the files should not be compressed.
-	Tags  map[string]string // For delta stores, indicates tags for next delta written.
-	Name  string            // The name used to describe this capture.
+	Path        string             // The directory where the surefiles will be written.
+	Base        string             // The initial part of the name.
+	Ext         string             // The extension to use "normally dat"
+	Compression weave.Codec        // The compression used, nil to use existing files, or gzip.
+	Plain       bool               // Deprecated: Set Compression to weave.Plain instead.
+	Tags        map[string]string  // For delta stores, indicates tags for next delta written.
+	Name        string             // The name used to describe this capture.
+	Stats       map[string]int64   // Extra statistics to record with the next delta written.
+	LockWait    time.Duration      // How long to wait for another process to unlock the surefile, negative to wait forever.
+	SignKey     ed25519.PrivateKey // Key to sign new deltas with, or nil to not sign them.
+	EncryptKey  *weave.Key         // Key to encrypt the surefiles with, or nil to not encrypt them.
+	Segmented   bool               // Write new deltas as a segmented store, see segment.go.
+
+	ContentPatterns []string // Patterns of files whose contents are kept, see contents.go.
+	ContentLimit    int64    // The largest file whose contents are kept, 0 for DefaultContentLimit.
+	Contents        Contents // File contents to record with the next delta written.
+
+	Scanner   sure.Scanner // Options for scanning the tree.
+	NoExclude bool         // Don't use the exclude and include patterns recorded with earlier deltas, see ignore.go.
+
+	lock *Lock // The lock, while it is held.
 }
 
-// Write writes a new version to the surefile.
+// Write writes a new version to the surefile.  The header records
+// counts of the contents of the tree, along with any statistics in
+// s.Stats.  If s.Contents is set, it is recorded along with the tree.
 func (s *Store) Write(tree *sure.Tree) error {
 	s.FixTags()
 
-	// TODO: Check for an existing file and make a delta.
+	return s.locked(func() error {
+		when := time.Now()
+		err := s.writeTree(tree, s.Name, s.Tags, when, treeStats(tree, s.Stats))
+		if err != nil || s.Contents == nil {
+			return err
+		}
+		return s.writeContents(s.Contents, s.Name, when)
+	})
+}
+
+// writeTree writes a new version to the surefile, with the given name,
+// tags, and statistics, recording 'when' as the time of the version.
+func (s *Store) writeTree(tree *sure.Tree, name string, tags map[string]string, when time.Time, stats map[string]int64) error {
 	base, err := s.GetDelta(DeltaLatest)
 	if err == nil {
-		return s.WriteDelta(tree, base)
+		return s.writeDelta(tree, base, name, tags, when, stats)
 	}
 	if !os.IsNotExist(err) {
 		return err
 	}
 
-	wr, err := weave.NewNewWeave(s, s.Name, s.Tags)
+	if s.Segmented || s.IsSegmented() {
+		return s.writeSegments(tree, 0, name, tags, when, stats)
+	}
+
+	wr, err := weave.NewNewWeaveAt(s, name, tags, when, stats)
 	if err != nil {
 		return err
 	}
@@ -57,7 +94,17 @@ func (s *Store) Write(tree *sure.Tree) error {
 // WriteDelta writes a new delta to the surefile, knowing the previous
 // version.
 func (s *Store) WriteDelta(tree *sure.Tree, base int) error {
-	wr, err := weave.NewDeltaWriter(s, base, s.Name, s.Tags)
+	return s.locked(func() error {
+		return s.writeDelta(tree, base, s.Name, s.Tags, time.Now(), treeStats(tree, s.Stats))
+	})
+}
+
+func (s *Store) writeDelta(tree *sure.Tree, base int, name string, tags map[string]string, when time.Time, stats map[string]int64) error {
+	if s.Segmented || s.IsSegmented() {
+		return s.writeSegments(tree, base, name, tags, when, stats)
+	}
+
+	wr, err := weave.NewDeltaWriterAt(s, base, name, tags, when, stats)
 	if err != nil {
 		return err
 	}
@@ -71,6 +118,30 @@ func (s *Store) WriteDelta(tree *sure.Tree, base int) error {
 	return wr.Close()
 }
 
+// appendWeave adds a new delta to the weave file named by 'nc',
+// creating the file if it doesn't exist yet.  The text of the delta
+// is written by 'encode'.
+func appendWeave(nc weave.NamingConvention, name string, tags map[string]string, when time.Time, stats map[string]int64, encode func(w io.Writer) error) error {
+	var wr io.WriteCloser
+	hdr, err := weave.ReadHeader(nc)
+	if err == nil {
+		wr, err = weave.NewDeltaWriterAt(nc, hdr.LatestDelta(), name, tags, when, stats)
+	} else if os.IsNotExist(err) {
+		wr, err = weave.NewNewWeaveAt(nc, name, tags, when, stats)
+	}
+	if err != nil {
+		return err
+	}
+	// Don't explicitly close to avoid corrupt file.
+
+	err = encode(wr)
+	if err != nil {
+		return err
+	}
+
+	return wr.Close()
+}
+
 // Magic delta numbers to refer to previous deltas
 // TODO: Interpret these the same as slices in python to be more
 // flexible.
@@ -99,11 +170,14 @@ func (s *Store) ReadDelta(num int) (*sure.Tree, error) {
 		return nil, err
 	}
 
-	pd := sure.NewPushDecoder()
+	return s.readTree(num)
+}
 
-	err = weave.ReadDelta(s, num, func(text string) error {
-		return pd.Add(text)
-	})
+// readTree decodes the tree stored in the given delta.
+func (s *Store) readTree(num int) (*sure.Tree, error) {
+	td := newTreeDecoder(num)
+
+	err := weave.ReadDelta(s, num, td.Add)
 	if err == io.EOF {
 		err = nil
 	}
@@ -111,7 +185,93 @@ func (s *Store) ReadDelta(num int) (*sure.Tree, error) {
 		return nil, err
 	}
 
-	return pd.Tree()
+	return td.Tree(s, nil)
+}
+
+// ReadDeltas reads several deltas in a single pass through the
+// surefile, which is much faster than reading each of them with
+// ReadDelta.  'nums' lists the deltas to read (DeltaLatest and
+// DeltaPrior can be used), or if it is empty, every delta is read.
+// The trees are given to 'fn' in increasing order of delta number,
+// after the whole file has been read, so all of the trees are held
+// in memory at once.  In a segmented store, the trees may share
+// subtrees with each other.
+func (s *Store) ReadDeltas(nums []int, fn func(num int, tree *sure.Tree) error) error {
+	var deltas []int
+	for _, num := range nums {
+		num, err := s.GetDelta(num)
+		if err != nil {
+			return err
+		}
+		deltas = append(deltas, num)
+	}
+
+	decoders := make(map[int]*treeDecoder)
+	var order []int
+
+	err := weave.ReadDeltas(s, deltas, func(delta int, text string) error {
+		td, ok := decoders[delta]
+		if !ok {
+			td = newTreeDecoder(delta)
+			decoders[delta] = td
+			order = append(order, delta)
+		}
+
+		return td.Add(text)
+	})
+	if err != nil {
+		return err
+	}
+
+	// A delta with no lines won't have been seen at all.
+	if len(deltas) == 0 {
+		hdr, err := s.ReadHeader()
+		if err != nil {
+			return err
+		}
+		for _, d := range hdr.Deltas {
+			deltas = append(deltas, d.Number)
+		}
+	}
+	for _, delta := range deltas {
+		if _, ok := decoders[delta]; !ok {
+			decoders[delta] = newTreeDecoder(delta)
+			order = append(order, delta)
+		}
+	}
+	sort.Ints(order)
+
+	cache := make(segmentCache)
+	for _, delta := range order {
+		tree, err := decoders[delta].Tree(s, cache)
+		if err != nil {
+			return err
+		}
+		// Let the decoder's memory be reclaimed as we go.
+		delete(decoders, delta)
+
+		err = fn(delta, tree)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A DecodeError indicates that the text of a delta is not a valid
+// surefile.
+type DecodeError struct {
+	Delta int   // The delta being decoded.
+	Line  int   // The line within the delta's text, 0 at the end.
+	Err   error // The error from the decoder.
+}
+
+func (e *DecodeError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("delta %d: at end: %v", e.Delta, e.Err)
+	}
+	return fmt.Sprintf("delta %d: line %d: %v", e.Delta, e.Line, e.Err)
 }
 
 // GetDelta canonicalizes a delta number.  Returns an error if there
@@ -144,7 +304,8 @@ func (s *Store) ReadHeader() (*weave.Header, error) {
 	return weave.ReadHeader(s)
 }
 
-// Read a tree from the given pathname.
+// Read a tree from the given pathname.  The file may or may not be
+// compressed, independent of the compression used by this store.
 func (s *Store) readNamed(name string) (*sure.Tree, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -152,21 +313,52 @@ func (s *Store) readNamed(name string) (*sure.Tree, error) {
 	}
 	defer f.Close()
 
-	var rd io.Reader
-	if s.Plain {
-		rd = f
-	} else {
-		gz, err := gzip.NewReader(f)
-		if err != nil {
-			return nil, err
-		}
-		defer gz.Close()
-		rd = gz
+	unz, err := weave.NewCodecReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer unz.Close()
+	rd := bufio.NewReader(unz)
+
+	// Give a clearer message than the decoder would if this is a
+	// weave file.
+	magic, err := rd.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte("\x01t")) {
+		return nil, fmt.Errorf("%q is a weave file, not a plain surefile", name)
 	}
 
 	return sure.Decode(rd)
 }
 
+// writeNamed writes a tree to the given pathname, as a plain
+// surefile.  The file is compressed if the name ends in the suffix of
+// one of the codecs (such as ".gz").
+func (s *Store) writeNamed(tree *sure.Tree, name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	wr, err := weave.CodecByExt(name).NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = tree.Encode(wr)
+	if err2 := wr.Close(); err == nil {
+		err = err2
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
 // Write out the tree to a temp file, returning the name of the temp
 // file.
 func (s *Store) writeTemp(tree *sure.Tree) (string, error) {
@@ -178,14 +370,11 @@ func (s *Store) writeTemp(tree *sure.Tree) (string, error) {
 
 	name := f.Name()
 
-	var wr io.Writer
-	if s.Plain {
-		wr = f
-	} else {
-		gz := gzip.NewWriter(f)
-		defer gz.Close()
-		wr = gz
+	wr, err := s.Codec().NewWriter(f)
+	if err != nil {
+		return "", err
 	}
+	defer wr.Close()
 
 	err = tree.Encode(wr)
 	if err != nil {
@@ -199,7 +388,7 @@ func (s *Store) writeTemp(tree *sure.Tree) (string, error) {
 func (s *Store) tmpFile() (*os.File, error) {
 	n := 0
 	for {
-		name := s.makeName(strconv.Itoa(n), !s.Plain)
+		name := s.makeName(strconv.Itoa(n), true)
 
 		f, err := os.OpenFile(name, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0644)
 		if err == nil {
@@ -221,26 +410,71 @@ func (s *Store) makeName(ext string, compressed bool) string {
 		base = "2sure"
 	}
 
-	gz := ".gz"
-	if !compressed {
-		gz = ""
+	gz := ""
+	if compressed {
+		gz = s.Codec().Ext()
 	}
 
 	return path.Join(s.Path, fmt.Sprintf("%s.%s%s", base, ext, gz))
 }
 
+// Codec returns the codec used to compress the files of this store.
+// If one hasn't been given, the compression of an existing surefile
+// is used, otherwise gzip.  The codec found is kept in s.Compression,
+// so the files are only looked for once.
+func (s *Store) Codec() weave.Codec {
+	if s.Compression == nil {
+		s.Compression = s.findCodec()
+	}
+	return s.Compression
+}
+
+// setCodec sets the compression of the store, finding it from the
+// existing files if 'codec' is nil, and keeps Plain up to date for
+// code still reading it.
+func (s *Store) setCodec(codec weave.Codec) {
+	s.Plain = false
+	s.Compression = codec
+	s.Plain = s.Codec() == weave.Plain
+}
+
+// findCodec returns the codec of an existing surefile, or gzip if
+// there isn't one.
+func (s *Store) findCodec() weave.Codec {
+	if s.Plain {
+		return weave.Plain
+	}
+
+	base := s.Base
+	if base == "" {
+		base = "2sure"
+	}
+	ext := "dat"
+	if s.Ext != "" {
+		ext = s.Ext
+	}
+	for _, c := range weave.Codecs {
+		name := path.Join(s.Path, fmt.Sprintf("%s.%s%s", base, ext, c.Ext()))
+		if _, err := os.Stat(name); err == nil {
+			return c
+		}
+	}
+
+	return weave.Gzip
+}
+
 // datName returns the pathname for the primary dat file.
 func (s *Store) datName() string {
 	ext := "dat"
 	if s.Ext != "" {
 		ext = s.Ext
 	}
-	return s.makeName(ext, !s.Plain)
+	return s.makeName(ext, true)
 }
 
 // bakName returns the pathname for the backup file.
 func (s *Store) bakName() string {
-	return s.makeName("bak", !s.Plain)
+	return s.makeName("bak", true)
 }
 
 // TempFile is used by the naming convention to generate temp files.
@@ -259,7 +493,22 @@ func (s *Store) BackupFile() string {
 	return s.bakName()
 }
 
+// IndexFile returns the name of the index file.
+func (s *Store) IndexFile() string {
+	return s.makeName("idx", false)
+}
+
+// SigningKey returns the key used to sign new deltas.
+func (s *Store) SigningKey() ed25519.PrivateKey {
+	return s.SignKey
+}
+
+// EncryptionKey returns the key used to encrypt the surefiles.
+func (s *Store) EncryptionKey() *weave.Key {
+	return s.EncryptKey
+}
+
 // IsCompressed returns whether or not this store is compressed.
 func (s *Store) IsCompressed() bool {
-	return !s.Plain
+	return s.Codec() != weave.Plain
 }
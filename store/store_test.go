@@ -2,14 +2,18 @@ package store
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"davidb.org/x/gosure/sure"
+	"davidb.org/x/gosure/weave"
 )
 
 func TestTmpFile(t *testing.T) {
@@ -83,17 +87,18 @@ func TestWrite(t *testing.T) {
 		}
 	}
 
-	// Check that we only have the two names.
+	// Check that we only have the expected names.
 	files, err := ioutil.ReadDir(tdir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(files) != 2 {
-		t.Fatalf("Wrong number of files: %d, expect %d", len(files), 2)
+	if len(files) != 4 {
+		t.Fatalf("Wrong number of files: %d, expect %d", len(files), 4)
 	}
 
 	for _, fi := range files {
-		if fi.Name() == "2sure.dat.gz" || fi.Name() == "2sure.bak.gz" {
+		if fi.Name() == "2sure.dat.gz" || fi.Name() == "2sure.bak.gz" || fi.Name() == "2sure.idx" ||
+			fi.Name() == "2sure.lock" {
 			continue
 		}
 		t.Fatalf("File: %q unexpected", fi.Name())
@@ -121,3 +126,766 @@ func treesSame(t *testing.T, a, b *sure.Tree) {
 		t.Fatal("Trees differ")
 	}
 }
+
+func TestFsck(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	for i := 0; i < 3; i++ {
+		err := st.Write(sure.GenerateTree(r, 10, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := st.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+
+	// Add a delta that isn't a valid surefile.
+	wr, err := weave.NewDeltaWriter(&st, 3, "bad", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(wr, "asure-2.0\n-----\nbogus\n")
+	err = wr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = st.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Delta != 4 {
+		t.Fatalf("Expecting problem with delta 4, got: %v", problems)
+	}
+	expect := "delta 4: invalid surefile at line 3 of text: Unexpected line in directory state: \"bogus\""
+	if problems[0].String() != expect {
+		t.Fatalf("Unexpected problem: %q", problems[0].String())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = path.Join(tdir, "a")
+	err = os.Mkdir(st.Path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trees []*sure.Tree
+	for i := 0; i < 3; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Export each delta, alternating compression, with distinct,
+	// increasing, modification times.
+	base := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	var names []string
+	for i := range trees {
+		name := path.Join(tdir, fmt.Sprintf("snap%d.dat", i))
+		if i%2 == 1 {
+			name += ".gz"
+		}
+		err := st.Export(i+1, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		when := base.Add(time.Duration(i) * 24 * time.Hour)
+		err = os.Chtimes(name, when, when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	// Import them into a new store.
+	var st2 Store
+	st2.Path = path.Join(tdir, "b")
+	err = os.Mkdir(st2.Path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		err := st2.Import(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hdr, err := st2.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.Deltas) != len(trees) {
+		t.Fatalf("Expecting %d deltas, got %d", len(trees), len(hdr.Deltas))
+	}
+	for i, d := range hdr.Deltas {
+		when := base.Add(time.Duration(i) * 24 * time.Hour)
+		if !d.Time.Equal(when) {
+			t.Fatalf("Delta %d time %v, expect %v", d.Number, d.Time, when)
+		}
+		if d.Name != when.Format(time.RFC3339Nano) {
+			t.Fatalf("Delta %d name %q", d.Number, d.Name)
+		}
+		if d.Tags[ImportTag] != path.Base(names[i]) {
+			t.Fatalf("Delta %d tags %v", d.Number, d.Tags)
+		}
+
+		tr, err := st2.ReadDelta(d.Number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treesSame(t, trees[i], tr)
+	}
+
+	// Importing a weave file should fail, and not add anything.
+	err = st2.Import(path.Join(st.Path, "2sure.dat.gz"))
+	if err == nil {
+		t.Fatal("Import of weave file should fail")
+	}
+}
+
+func TestReadDeltas(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	var trees []*sure.Tree
+	for i := 0; i < 5; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []int
+	err = st.ReadDeltas(nil, func(num int, tree *sure.Tree) error {
+		seen = append(seen, num)
+		treesSame(t, trees[num-1], tree)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(trees) {
+		t.Fatalf("Read deltas %v, expect %d", seen, len(trees))
+	}
+
+	seen = nil
+	err = st.ReadDeltas([]int{DeltaLatest, 2}, func(num int, tree *sure.Tree) error {
+		seen = append(seen, num)
+		treesSame(t, trees[num-1], tree)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != 2 || seen[1] != 5 {
+		t.Fatalf("Read deltas %v, expect [2 5]", seen)
+	}
+}
+
+// Each delta records the counts of its tree, and any extra statistics
+// given in the store.
+func TestStats(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	var trees []*sure.Tree
+	for i := 0; i < 3; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		if i > 0 {
+			st.Stats = ChangeStats(trees[i-1], tr)
+		}
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hdr, err := st.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != weave.HeaderVersion {
+		t.Fatalf("Header version %d, expect %d", hdr.Version, weave.HeaderVersion)
+	}
+
+	for i, d := range hdr.Deltas {
+		c := trees[i].Count()
+		if d.Stats[StatFiles] != c.Files || d.Stats[StatDirs] != c.Dirs ||
+			d.Stats[StatLinks] != c.Links || d.Stats[StatBytes] != c.Bytes {
+			t.Fatalf("Delta %d: stats %v don't match counts %+v", d.Number, d.Stats, c)
+		}
+
+		_, ok := d.Stats[StatAdded]
+		if ok != (i > 0) {
+			t.Fatalf("Delta %d: unexpected change stats %v", d.Number, d.Stats)
+		}
+		if i > 0 {
+			ch := sure.CountChanges(trees[i-1], trees[i])
+			if d.Stats[StatAdded] != ch.Added || d.Stats[StatRemoved] != ch.Removed ||
+				d.Stats[StatChanged] != ch.Changed {
+				t.Fatalf("Delta %d: stats %v don't match changes %+v", d.Number, d.Stats, ch)
+			}
+		}
+	}
+}
+
+// Tags can be changed on existing deltas, without changing their
+// contents.
+func TestRetag(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+	st.Tags = map[string]string{"kind": "test"}
+
+	var trees []*sure.Tree
+	for i := 0; i < 3; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = st.RetagDelta(2, map[string]string{
+		"verified": "yes",
+		"name":     "second",
+	}, []string{"kind"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.RetagDelta(DeltaLatest, map[string]string{NoteTag: "a note"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := st.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := hdr.Deltas[1]
+	if d.Name != "second" || len(d.Tags) != 1 || d.Tags["verified"] != "yes" {
+		t.Fatalf("Delta not retagged: %+v", d)
+	}
+	d = hdr.Deltas[2]
+	if d.Tags["kind"] != "test" || d.Tags[NoteTag] != "a note" {
+		t.Fatalf("Delta not annotated: %+v", d)
+	}
+
+	for i, tr := range trees {
+		tr2, err := st.ReadDelta(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treesSame(t, tr, tr2)
+	}
+
+	err = st.RetagDelta(4, map[string]string{"a": "b"}, nil)
+	if err == nil {
+		t.Fatal("Retagged a missing delta")
+	}
+}
+
+// Only one store can hold the lock at a time.
+func TestLock(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+	st2 := st
+
+	lk, err := st.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock can be taken again by the same store.
+	lk2, err := st.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk2.Unlock()
+
+	// Without waiting, writing fails, and names the holder.
+	err = st2.Write(sure.GenerateTree(rand.New(rand.NewSource(1)), 10, 2))
+	lerr, ok := err.(*LockError)
+	if !ok {
+		t.Fatalf("Expecting lock error, got %v", err)
+	}
+	if !strings.Contains(lerr.Holder, fmt.Sprintf("process %d ", os.Getpid())) {
+		t.Fatalf("Lock holder not named: %q", lerr.Holder)
+	}
+
+	// With a wait, it succeeds once the lock is released.
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		lk.Unlock()
+	}()
+	st2.LockWait = 5 * time.Second
+	err = st2.Write(sure.GenerateTree(rand.New(rand.NewSource(1)), 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// And the lock is released after writing.
+	lk, err = st.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk.Unlock()
+}
+
+// Surefiles written with each codec can be read back, and a store
+// without a given compression finds the existing file.
+func TestCodecs(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for _, codec := range weave.Codecs {
+		tdir, err := ioutil.TempDir("", "store-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		st := Store{Path: tdir, Compression: codec}
+
+		var trees []*sure.Tree
+		for i := 0; i < 2; i++ {
+			tr := sure.GenerateTree(r, 10, 2)
+			trees = append(trees, tr)
+			err := st.Write(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		name := path.Join(tdir, "2sure.dat"+codec.Ext())
+		if _, err := os.Stat(name); err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+
+		st2 := Store{Path: tdir}
+		if st2.Codec() != codec {
+			t.Fatalf("%s: store found codec %s", codec.Name(), st2.Codec().Name())
+		}
+		if st2.Compression != codec {
+			t.Fatalf("%s: codec found not kept", codec.Name())
+		}
+		for i, tr := range trees {
+			t2, err := st2.ReadDelta(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			treesSame(t, tr, t2)
+		}
+	}
+}
+
+// The deprecated Plain still writes uncompressed surefiles.
+func TestPlain(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	st := Store{Path: tdir, Plain: true}
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(tdir, "2sure.dat")); err != nil {
+		t.Fatal(err)
+	}
+	if st.Codec() != weave.Plain {
+		t.Fatalf("Plain store uses %s", st.Codec().Name())
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	keyName := path.Join(tdir, "sign.key")
+	err = GenerateKey(keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateKey(keyName)
+	if err == nil {
+		t.Fatal("GenerateKey overwrote an existing key")
+	}
+	priv, err := LoadSigningKey(keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := LoadPublicKey(keyName + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st Store
+	st.Path = tdir
+	st.SignKey = priv
+
+	verify := func(expect int) {
+		t.Helper()
+		_, problems, err := st.VerifyChain(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != expect {
+			t.Fatalf("Got problems %v, expect %d", problems, expect)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		err := st.Write(sure.GenerateTree(r, 10, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify(0)
+	}
+
+	// Retagging and pruning keep the history intact.
+	err = st.RetagDelta(2, map[string]string{"verified": "yes"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(0)
+	_, err = st.Prune(&Retention{Last: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(0)
+
+	// A backup from another surefile is detected.
+	var other Store
+	other.Path = path.Join(tdir, "other")
+	other.SignKey = priv
+	err = os.Mkdir(other.Path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err := other.Write(sure.GenerateTree(r, 10, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Rename(other.MainFile(), st.BackupFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err := st.VerifyChain(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Msg, "may have been replaced") {
+		t.Fatalf("Replaced backup not detected: %v", problems)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	keyName := path.Join(tdir, "crypt.key")
+	err = GenerateEncryptionKey(keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadEncryptionKey(keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadSigningKey(keyName)
+	if err == nil {
+		t.Fatal("Encryption key loaded as a signing key")
+	}
+
+	var st Store
+	st.Path = tdir
+	st.EncryptKey = key
+
+	var trees []*sure.Tree
+	for i := 0; i < 3; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = st.RetagDelta(2, map[string]string{"verified": "yes"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tr := range trees {
+		tr2, err := st.ReadDelta(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treesSame(t, tr, tr2)
+	}
+
+	_, problems, err := st.VerifyChain(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Encrypted surefile has problems: %v", problems)
+	}
+
+	st.EncryptKey = nil
+	_, err = st.ReadDat()
+	if !errors.Is(err, weave.ErrNoKey) {
+		t.Fatalf("Encrypted surefile read without key: %v", err)
+	}
+}
+
+// An existing store, with its segments, is only used with a key once
+// it has been encrypted.
+func TestEncryptExisting(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+	st.Segmented = true
+
+	var trees []*sure.Tree
+	for i := 0; i < 2; i++ {
+		tr := sure.GenerateTree(r, 10, 2)
+		trees = append(trees, tr)
+		err := st.Write(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st.EncryptKey = weave.NewPassphraseKey("secret")
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if !errors.Is(err, weave.ErrNotEncrypted) {
+		t.Fatalf("Wrote to unencrypted surefile with a key: %v", err)
+	}
+
+	err = st.Encrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(st.BackupFile()); !os.IsNotExist(err) {
+		t.Fatalf("Unencrypted surefile kept as the backup: %v", err)
+	}
+	for i, tr := range trees {
+		tr2, err := st.ReadDelta(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		treesSame(t, tr, tr2)
+	}
+	problems, err := st.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Encrypted surefile has problems: %v", problems)
+	}
+
+	st.EncryptKey = nil
+	_, err = st.ReadDelta(1)
+	if !errors.Is(err, weave.ErrNoKey) {
+		t.Fatalf("Encrypted surefile read without key: %v", err)
+	}
+	ids, err := st.segmentIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) == 0 {
+		t.Fatal("No segments written")
+	}
+	for _, id := range ids {
+		_, err = weave.ReadHeader(segmentNaming{&st, id})
+		if !errors.Is(err, weave.ErrNoKey) {
+			t.Fatalf("Segment %s not encrypted: %v", id, err)
+		}
+	}
+}
+
+// A surefile damaged in a way that still decodes is detected.
+func TestDamaged(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+	st.Compression = weave.Plain
+
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change a digit of the first hash.
+	buf, err := ioutil.ReadFile(st.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(buf, []byte(" sha1 "))
+	if pos < 0 {
+		t.Fatal("No hash in surefile")
+	}
+	pos += 6
+	if buf[pos] == '0' {
+		buf[pos] = '1'
+	} else {
+		buf[pos] = '0'
+	}
+	err = ioutil.WriteFile(st.MainFile(), buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = st.ReadDat()
+	if _, ok := err.(*weave.DigestError); !ok {
+		t.Fatalf("Damage not detected: %v", err)
+	}
+
+	problems, err := st.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Msg, "do not match the digest") {
+		t.Fatalf("Damage not reported: %v", problems)
+	}
+}
+
+// Files left by an interrupted write are cleaned up before the next
+// write.
+func TestDoctor(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tdir, err := ioutil.TempDir("", "store-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var st Store
+	st.Path = tdir
+
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := st.TempFile(0, true)
+	err = ioutil.WriteFile(stale, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err := st.Doctor(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || repairs[0].Name != stale || repairs[0].Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+
+	err = st.Write(sure.GenerateTree(r, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("Stale temp file not removed")
+	}
+	repairs, err = st.Doctor(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 0 {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+}
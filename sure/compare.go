@@ -32,6 +32,7 @@ func CompareTrees(older, newer *Tree) {
 
 func (w Comparer) CompareTrees(older, newer *Tree) {
 	w.compWalk(older, newer, ".")
+	w.compLinks(older, newer)
 }
 
 func (w Comparer) compWalk(older, newer *Tree, name string) {
@@ -109,26 +110,14 @@ func (w Comparer) compFiles(older, newer []*File, name string) {
 }
 
 // Compare attributes, and if any differ, print them out and the file
-// name.  Ignores attributes "ctime" and "ino" because these will not
-// be the same when restored from a backup.
+// name.  Ignores attributes "ctime", "ino", "dev" and "mount" because
+// these will not be the same when restored from a backup.
 func (w Comparer) compAtts(name string, oa, na AttMap) {
-	var mismatch []string
-
-	ov := reflect.ValueOf(oa).Elem()
-	nv := reflect.ValueOf(na).Elem()
-
-	if ov.Type() != nv.Type() {
-		mismatch = append(mismatch, "kind")
-	} else {
-		mismatch = compAttWalk(ov, nv, nil)
-	}
-
+	mismatch := AttDiff(oa, na)
 	if len(mismatch) == 0 {
 		return
 	}
 
-	sort.Sort(sort.StringSlice(mismatch))
-
 	attText := strings.Join(mismatch, ",")
 	fmt.Fprintf(w.write, "  [%-20s] %s\n", attText, name)
 }
@@ -145,15 +134,31 @@ func compAttWalk(ov, nv reflect.Value, mismatch []string) []string {
 		ftyp := t.Field(i)
 
 		// Walk down the struct
-		if ftyp.Type.Kind() == reflect.Struct {
+		if ftyp.Type.Kind() == reflect.Struct && ftyp.Type != timestampType {
 			mismatch = compAttWalk(ofld, nfld, mismatch)
 			continue
 		}
 
 		name := strings.ToLower(ftyp.Name)
 
-		// Special case to ignore ctime and ino.
-		if name == "ctime" || name == "ino" {
+		// Special case to ignore ctime and ino, and the hard
+		// links, which are compared by compLinks.  The device and
+		// mount point also change with a restore.
+		switch name {
+		case "ctime", "ino", "nlink", "link", "dev", "mount":
+			continue
+		}
+
+		// Attributes that older surefiles don't record are only
+		// compared when both have them.
+		if ftyp.Tag.Get("sure") == "optional" && (ofld.IsZero() || nfld.IsZero()) {
+			continue
+		}
+
+		// Extended attributes are reported by name.
+		if ftyp.Type == xattrsType {
+			mismatch = xattrDiff(ofld.Interface().(Xattrs),
+				nfld.Interface().(Xattrs), mismatch)
 			continue
 		}
 
@@ -173,6 +178,12 @@ func compAttWalk(ov, nv reflect.Value, mismatch []string) []string {
 			if ofld.Int() != nfld.Int() {
 				bad = true
 			}
+		case Timestamp:
+			// A time from an older surefile, with only seconds,
+			// matches any time within that second.
+			if !ofld.Interface().(Timestamp).Same(nfld.Interface().(Timestamp)) {
+				bad = true
+			}
 		case []byte:
 			if bytes.Compare(ofld.Bytes(), nfld.Bytes()) != 0 {
 				bad = true
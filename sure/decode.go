@@ -71,14 +71,23 @@ func (pd *PushDecoder) Add(line string) error {
 // a full surefile wasn't pushed to it.
 func (pd *PushDecoder) Tree() (*Tree, error) {
 	if pd.result == nil || len(pd.tree) != 0 {
-		return nil, fmt.Errorf("Invalid ending state")
+		return nil, fmt.Errorf("Invalid ending state, surefile is incomplete")
 	}
 
 	return pd.result, nil
 }
 
+// asureMagic is the first line of a surefile.  Version 2.1 added
+// nanoseconds to the file times.  Version 2.0 surefiles, with only
+// seconds, are still read.
+const asureMagic = "asure-2.1"
+
+func isAsureMagic(line string) bool {
+	return line == asureMagic || line == "asure-2.0"
+}
+
 func (pd *PushDecoder) needAsure(line string) error {
-	if line != "asure-2.0" {
+	if !isAsureMagic(line) {
 		return errors.New("Invalid Magic")
 	}
 	pd.add = pd.needHyphens
@@ -271,8 +280,8 @@ func decWalk(v reflect.Value, atts map[string]string) error {
 		fld := v.Field(i)
 		ftyp := t.Field(i)
 
-		// Flatten structs
-		if ftyp.Type.Kind() == reflect.Struct {
+		// Flatten structs, other than timestamps.
+		if ftyp.Type.Kind() == reflect.Struct && ftyp.Type != timestampType {
 			err := decWalk(fld, atts)
 			if err != nil {
 				return err
@@ -288,10 +297,23 @@ func decWalk(v reflect.Value, atts map[string]string) error {
 			continue
 		}
 
+		// Extended attributes are written as several
+		// attributes, and may be absent.
+		if ftyp.Type == xattrsType {
+			x, err := decodeXattrs(atts)
+			if err != nil {
+				return err
+			}
+			fld.Set(reflect.ValueOf(x))
+			continue
+		}
+
 		// Otherwise, just set the field based on type.
 		value, ok := atts[name]
 		if !ok {
-			warnAtt(name, "decWalk")
+			if ftyp.Tag.Get("sure") != "optional" {
+				warnAtt(name, "decWalk")
+			}
 			continue
 		}
 
@@ -316,6 +338,12 @@ func decWalk(v reflect.Value, atts map[string]string) error {
 				return err
 			}
 			fld.SetInt(v)
+		case Timestamp:
+			ts, err := parseTimestamp(value)
+			if err != nil {
+				return err
+			}
+			fld.Set(reflect.ValueOf(ts))
 		case []byte:
 			var buf []byte
 			_, err := fmt.Sscanf(value, "%x", &buf)
@@ -334,6 +362,8 @@ func decWalk(v reflect.Value, atts map[string]string) error {
 	return nil
 }
 
+var timestampType = reflect.TypeOf(Timestamp{})
+
 // A mapping between kind names and the integer codes for them.
 var allKinds = map[string]uint32{
 	"dir":  syscall.S_IFDIR,
@@ -18,7 +18,7 @@ func (t *Tree) Encode(w io.Writer) error {
 	out := bufio.NewWriter(w)
 	defer out.Flush()
 
-	_, err := fmt.Fprintf(out, "asure-2.0\n-----\n")
+	_, err := fmt.Fprintf(out, "%s\n-----\n", asureMagic)
 	if err != nil {
 		return err
 	}
@@ -104,6 +104,14 @@ func encWalk(v reflect.Value, atts []stringPair) []stringPair {
 		fld := v.Field(i)
 		ftyp := t.Field(i)
 
+		if ts, ok := fld.Interface().(Timestamp); ok {
+			atts = append(atts, stringPair{
+				key:   strings.ToLower(ftyp.Name),
+				value: ts.String(),
+			})
+			continue
+		}
+
 		// Flatten structs.
 		if ftyp.Type.Kind() == reflect.Struct {
 			atts = encWalk(fld, atts)
@@ -116,6 +124,10 @@ func encWalk(v reflect.Value, atts []stringPair) []stringPair {
 			continue
 		}
 
+		if ftyp.Tag.Get("sure") == "optional" && fld.IsZero() {
+			continue
+		}
+
 		switch v := fld.Interface().(type) {
 		case uint32:
 			atts = append(atts, stringPair{
@@ -132,6 +144,8 @@ func encWalk(v reflect.Value, atts []stringPair) []stringPair {
 				key:   name,
 				value: strconv.FormatUint(v, 10),
 			})
+		case Xattrs:
+			atts = v.encode(atts)
 		case []byte:
 			// Parser fails if there are no bytes output.
 			// Just skip the attribute.
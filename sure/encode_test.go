@@ -5,6 +5,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -42,6 +43,38 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+// Surefiles from before nanosecond times are still read, and their
+// times match any time within the same second.
+func TestDecodeSeconds(t *testing.T) {
+	old := "asure-2.0\n-----\nd__root__ [gid 0 kind dir perm 493 uid 0 ]\n-\n" +
+		"ffile [ctime 1485993510 gid 0 ino 5 kind file mtime 1485993509 perm 420 sha1 " +
+		"8f552e8f264d2a9c619bfcaa1f87f7b06c434582 size 3 uid 0 ]\nu\n"
+	tree, err := sure.Decode(strings.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atts := tree.Files[0].Atts.(*sure.RegAtts)
+	if atts.Mtime != (sure.Timestamp{Nsec: 1485993509e9, Coarse: true}) {
+		t.Fatalf("Decoded mtime %v", atts.Mtime)
+	}
+
+	newer := *atts
+	newer.Mtime = sure.Timestamp{Nsec: 1485993509999999999}
+	if diff := sure.AttDiff(atts, &newer); len(diff) != 0 {
+		t.Fatalf("Same second differs: %v", diff)
+	}
+	newer.Mtime = sure.Timestamp{Nsec: 1485993510e9}
+	if diff := sure.AttDiff(atts, &newer); len(diff) != 1 || diff[0] != "mtime" {
+		t.Fatalf("Next second: %v, expect mtime", diff)
+	}
+
+	precise := newer
+	precise.Mtime = sure.Timestamp{Nsec: 1485993510000000001}
+	if diff := sure.AttDiff(&precise, &newer); len(diff) != 1 {
+		t.Fatalf("Nanosecond change not seen: %v", diff)
+	}
+}
+
 var tdata1 *sure.Tree = &sure.Tree{
 	Name: "__root__",
 	Atts: &sure.DirAtts{
@@ -50,6 +83,9 @@ var tdata1 *sure.Tree = &sure.Tree{
 			Gid:  54321,
 			Perm: 0755,
 		},
+		Dev:    2049,
+		Fstype: "ext4",
+		Mount:  "/home dir",
 	},
 	Children: []*sure.Tree{},
 	Files: []*sure.File{
@@ -60,11 +96,17 @@ var tdata1 *sure.Tree = &sure.Tree{
 					Uid:  0xffffffff,
 					Gid:  0x80000000,
 					Perm: 0644,
+					Xattrs: sure.Xattrs{
+						"security.capability": {0x01, 0x00, 0x00, 0x02},
+						"user.odd name=\xff":  {},
+					},
 				},
-				Mtime: 1485993509,
-				Ctime: 1485993510,
+				Mtime: sure.Timestamp{Nsec: 1485993509123456789},
+				Ctime: sure.Timestamp{Nsec: 1485993510e9, Coarse: true},
 				Ino:   0x123456789abcdef0,
 				Size:  5827423,
+				Nlink: 2,
+				Link:  1,
 				Sha1: []byte{
 					0x8f, 0x55, 0x2e, 0x8f, 0x26,
 					0x4d, 0x2a, 0x9c, 0x61, 0x9b,
@@ -13,8 +13,8 @@ func generateRegAtts(rand *rand.Rand) AttMap {
 	a.Uid = rand.Uint32()
 	a.Gid = rand.Uint32()
 	a.Perm = uint32(rand.Int31n(010000))
-	a.Mtime = rand.Int63n(1e10)
-	a.Ctime = rand.Int63n(1e10)
+	a.Mtime = Timestamp{Nsec: rand.Int63n(1e18)}
+	a.Ctime = Timestamp{Nsec: rand.Int63n(1e18)}
 	a.Ino = uint64(rand.Int63())
 	a.Size = rand.Int63()
 	a.Sha1 = make([]byte, 20)
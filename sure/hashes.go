@@ -15,18 +15,25 @@ type Estimate struct {
 	Bytes uint64
 }
 
-// Estimate the amount of updates necessary to files hashes.
+// Estimate the amount of updates necessary to files hashes.  Files
+// that are hard linked together are only counted once.
 func (t *Tree) EstimateHashes() Estimate {
 	est := Estimate{}
-	est.update(t)
+	est.update(t, make(map[uint64]bool))
 	return est
 }
 
-func (e *Estimate) update(t *Tree) {
+func (e *Estimate) update(t *Tree, links map[uint64]bool) {
 	// Account for any files in this tree.
 	for _, f := range t.Files {
 		atts, ok := f.Atts.(*RegAtts)
 		if ok && atts.Sha1 == nil {
+			if atts.Link != 0 {
+				if links[atts.Link] {
+					continue
+				}
+				links[atts.Link] = true
+			}
 			e.Files += 1
 			e.Bytes += uint64(atts.Size)
 		}
@@ -34,11 +41,12 @@ func (e *Estimate) update(t *Tree) {
 
 	// And visit all children.
 	for _, c := range t.Children {
-		e.update(c)
+		e.update(c, links)
 	}
 }
 
-// Update all of the file nodes that don't have hashes.
+// Update all of the file nodes that don't have hashes.  Files that are
+// hard linked together are only hashed once, and share the hash.
 func (t *Tree) ComputeHashes(prog *Progress, dir string) {
 	cpus := runtime.NumCPU()
 
@@ -51,11 +59,19 @@ func (t *Tree) ComputeHashes(prog *Progress, dir string) {
 		go updateWorker(req, &wg, prog)
 	}
 
-	t.hashWalk(prog, dir, req)
+	links := make(map[uint64][]*RegAtts)
+	t.hashWalk(prog, dir, req, links)
 	close(req)
 
 	// Wait for everyone to finish.
 	wg.Wait()
+
+	// The hashed file of each set of links is first.
+	for _, group := range links {
+		for _, atts := range group[1:] {
+			atts.Sha1 = group[0].Sha1
+		}
+	}
 }
 
 // This message indicates a single path to compute a hash for.  The
@@ -65,10 +81,19 @@ type hashUpdate struct {
 	atts *RegAtts
 }
 
-func (t *Tree) hashWalk(prog *Progress, name string, req chan<- hashUpdate) {
+// hashWalk requests the hashes of the files in the tree.  Only the
+// first of the files with each Link is requested, and those that share
+// it are gathered in 'links'.
+func (t *Tree) hashWalk(prog *Progress, name string, req chan<- hashUpdate, links map[uint64][]*RegAtts) {
 	for _, f := range t.Files {
 		atts, ok := f.Atts.(*RegAtts)
 		if ok && atts.Sha1 == nil {
+			if atts.Link != 0 {
+				links[atts.Link] = append(links[atts.Link], atts)
+				if len(links[atts.Link]) > 1 {
+					continue
+				}
+			}
 			req <- hashUpdate{
 				path: path.Join(name, f.Name),
 				atts: atts,
@@ -78,7 +103,7 @@ func (t *Tree) hashWalk(prog *Progress, name string, req chan<- hashUpdate) {
 
 	// And the children.
 	for _, c := range t.Children {
-		c.hashWalk(prog, path.Join(name, c.Name), req)
+		c.hashWalk(prog, path.Join(name, c.Name), req, links)
 	}
 }
 
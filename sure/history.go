@@ -0,0 +1,167 @@
+package sure
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A PathFinder is given a surefile one line at a time, like a
+// PushDecoder, but instead of building the whole tree, it only
+// decodes the attributes of a single path within the tree.  This
+// makes it cheap enough to run on many versions of a surefile at
+// once.
+type PathFinder struct {
+	target  []string // The components of the path being looked for.
+	dirs    int      // The depth of the directory being read.
+	matched int      // How many of the enclosing directories match the target.
+	files   bool     // Are we reading the files of the directory.
+	line    int      // Lines seen so far.
+
+	atts  AttMap
+	isDir bool
+}
+
+// NewPathFinder creates a PathFinder looking for the given path.  The
+// path is relative to the top of the tree, and "." names the top
+// directory itself.
+func NewPathFinder(name string) *PathFinder {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+
+	var target []string
+	if name != "." {
+		target = strings.Split(name, "/")
+	}
+
+	return &PathFinder{
+		target: target,
+	}
+}
+
+// Add gives another line of the surefile to the finder.
+func (pf *PathFinder) Add(line string) error {
+	pf.line++
+	if pf.line <= 2 {
+		// The magic lines.
+		if (pf.line == 1 && !isAsureMagic(line)) || (pf.line == 2 && line != "-----") {
+			return errors.New("Invalid Magic")
+		}
+		return nil
+	}
+
+	if len(line) == 0 {
+		return errors.New("Invalid blank line")
+	}
+
+	switch line[0] {
+	case 'd':
+		if pf.files || (pf.dirs == 0 && pf.line > 3) {
+			return fmt.Errorf("Unexpected line in file state: %q", line)
+		}
+		pf.dirs++
+
+		// The name of the top directory isn't part of the
+		// path.
+		if pf.dirs > 1 && pf.matched == pf.dirs-1 && pf.dirs-1 <= len(pf.target) {
+			name, err := pf.name(line)
+			if err != nil {
+				return err
+			}
+			if name == pf.target[pf.dirs-2] {
+				pf.matched++
+			}
+		} else if pf.dirs == 1 {
+			pf.matched = 1
+		}
+
+		if pf.matched == pf.dirs && pf.dirs == len(pf.target)+1 {
+			return pf.found(line, true)
+		}
+	case '-':
+		if pf.files || pf.dirs == 0 {
+			return fmt.Errorf("Unexpected line in directory state: %q", line)
+		}
+		pf.files = true
+	case 'f':
+		if !pf.files {
+			return fmt.Errorf("Unexpected line in directory state: %q", line)
+		}
+		if pf.matched == pf.dirs && pf.dirs == len(pf.target) {
+			name, err := pf.name(line)
+			if err != nil {
+				return err
+			}
+			if name == pf.target[len(pf.target)-1] {
+				return pf.found(line, false)
+			}
+		}
+	case 'u':
+		if !pf.files {
+			return fmt.Errorf("Unexpected line in directory state: %q", line)
+		}
+		if pf.matched == pf.dirs {
+			pf.matched--
+		}
+		pf.dirs--
+		pf.files = false
+	default:
+		return fmt.Errorf("Unexpected line in surefile: %q", line)
+	}
+
+	return nil
+}
+
+// name decodes just the name from a line of the surefile.
+func (pf *PathFinder) name(line string) (string, error) {
+	pos := 1
+	return scanName(line, &pos)
+}
+
+// found decodes the attributes of the node that was being looked for.
+func (pf *PathFinder) found(line string, isDir bool) error {
+	var name string
+	err := parseNameAtts(line[1:], &name, &pf.atts)
+	if err != nil {
+		return err
+	}
+	pf.isDir = isDir
+	return nil
+}
+
+// Result returns the attributes of the path, and whether it is a
+// directory.  The attributes will be nil if the path was not present
+// in the tree.
+func (pf *PathFinder) Result() (atts AttMap, isDir bool) {
+	return pf.atts, pf.isDir
+}
+
+// AttDiff returns the names of the attributes that differ between the
+// two nodes, sorted.  As with CompareTrees, "ctime" and "ino" are
+// ignored, and if the nodes are of different kinds, just "kind" is
+// returned.
+func AttDiff(oa, na AttMap) []string {
+	ov := reflect.ValueOf(oa).Elem()
+	nv := reflect.ValueOf(na).Elem()
+
+	if ov.Type() != nv.Type() {
+		return []string{"kind"}
+	}
+
+	mismatch := compAttWalk(ov, nv, nil)
+	sort.Strings(mismatch)
+	return mismatch
+}
+
+// AttValues returns the attributes of a node, as they would be
+// written to a surefile, indexed by name.
+func AttValues(atts AttMap) map[string]string {
+	result := make(map[string]string)
+	for _, p := range encWalk(reflect.ValueOf(atts).Elem(), nil) {
+		result[p.key] = p.value
+	}
+	result["kind"] = atts.GetKind()
+	return result
+}
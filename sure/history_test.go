@@ -0,0 +1,81 @@
+package sure
+
+import (
+	"bytes"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Find every node of a generated tree with a PathFinder, and make sure
+// the attributes match.
+func TestPathFinder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := GenerateTree(r, 10, 3)
+	fixNames(tr)
+
+	var buf bytes.Buffer
+	err := tr.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+	find := func(name string) (AttMap, bool) {
+		pf := NewPathFinder(name)
+		for _, line := range lines {
+			err := pf.Add(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pf.Result()
+	}
+
+	count := 0
+	var walk func(tr *Tree, name string)
+	walk = func(tr *Tree, name string) {
+		atts, isDir := find(name)
+		if atts == nil || !isDir || len(AttDiff(tr.Atts, atts)) != 0 {
+			t.Fatalf("Directory %q not found correctly", name)
+		}
+		count++
+
+		for _, f := range tr.Files {
+			fname := path.Join(name, f.Name)
+			atts, isDir := find(fname)
+			if atts == nil || isDir || len(AttDiff(f.Atts, atts)) != 0 {
+				t.Fatalf("File %q not found correctly", fname)
+			}
+			count++
+		}
+
+		for _, ch := range tr.Children {
+			walk(ch, path.Join(name, ch.Name))
+		}
+	}
+	walk(tr, ".")
+
+	if count < 20 {
+		t.Fatalf("Only checked %d nodes", count)
+	}
+
+	for _, name := range []string{"missing", "./missing/deeper", tr.Children[0].Name + "/missing"} {
+		if atts, _ := find(name); atts != nil {
+			t.Fatalf("Found nonexistent path %q", name)
+		}
+	}
+}
+
+// fixNames changes the names in a generated tree so that they could
+// be the names of real files.
+func fixNames(tr *Tree) {
+	for _, f := range tr.Files {
+		f.Name = "f" + strings.Replace(f.Name, "/", "_", -1)
+	}
+	for _, ch := range tr.Children {
+		ch.Name = "d" + strings.Replace(ch.Name, "/", "_", -1)
+		fixNames(ch)
+	}
+}
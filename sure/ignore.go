@@ -0,0 +1,152 @@
+package sure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFile is the name of the file in a directory giving rules for
+// what in that directory, and below it, isn't scanned.
+const IgnoreFile = ".gosureignore"
+
+// The rules follow those of .gitignore.  Each line is a pattern, which
+// excludes what it matches, or, when it starts with a '!', includes it
+// again.  The last rule that matches a node decides.  Blank lines, and
+// lines starting with '#' are skipped, and a '\' before a leading '#'
+// or '!' makes it part of the pattern.  A pattern ending in '/' only
+// matches directories.  A pattern with no other '/' matches the name of
+// a node anywhere below the directory the rule comes from.  Otherwise,
+// the pattern matches the path relative to that directory, where "**"
+// matches any number of directories.  Nothing in a directory that is
+// excluded is scanned, even if a later rule would include it.
+
+// An ignoreRule is a single rule.
+type ignoreRule struct {
+	base     string   // The directory the rule applies below, "" for the top.
+	segments []string // The parts of the pattern, between the slashes.
+	anchored bool     // Whether the pattern matches the whole path.
+	negate   bool     // Whether the rule includes, rather than excludes.
+	dirOnly  bool     // Whether the rule only matches directories.
+}
+
+type ignoreRules []ignoreRule
+
+// parse adds the rules in 'lines', which apply to the directory
+// 'base', to the rules.  The result doesn't share storage with 'rules'.
+func (rules ignoreRules) parse(base string, lines []string) ignoreRules {
+	rules = rules[:len(rules):len(rules)]
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var rule ignoreRule
+		rule.base = base
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(line, "/")
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// excluded reports whether the node with the given path, relative to
+// the top of the scan, is excluded by the rules.
+func (rules ignoreRules) excluded(rel string, isDir bool) bool {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matches(rel, isDir) {
+			return !rules[i].negate
+		}
+	}
+	return false
+}
+
+func (r *ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches the parts of a pattern against the parts of a
+// path.  A "**" matches any number of parts, but at least one when it
+// ends the pattern.
+func matchSegments(pattern, names []string) bool {
+	if len(pattern) == 0 {
+		return len(names) == 0
+	}
+	if pattern[0] == "**" {
+		first := 0
+		if len(pattern) == 1 {
+			first = 1
+		}
+		for i := first; i <= len(names); i++ {
+			if matchSegments(pattern[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], names[0])
+	return ok && matchSegments(pattern[1:], names[1:])
+}
+
+// readIgnore reads the lines of an ignore file.  Also returns the
+// SHA-256 of the file, in hex, or "" if it couldn't be read.
+func readIgnore(name string) ([]string, string) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		log.Printf("Unable to read %q: %v", name, err)
+		return nil, ""
+	}
+
+	var lines []string
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		lines = append(lines, scan.Text())
+	}
+	if err := scan.Err(); err != nil {
+		log.Printf("Unable to read %q: %v", name, err)
+	}
+	sum := sha256.Sum256(data)
+	return lines, hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,105 @@
+package sure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := ignoreRules(nil).parse("", []string{
+		"# A comment",
+		"*.log",
+		"!keep.log",
+		"cache/",
+		"/top",
+		"a/**/z",
+		"logs/**",
+		`\#hash`,
+	}).parse("sub", []string{"build", "!/other.log"})
+
+	for _, tc := range []struct {
+		rel      string
+		isDir    bool
+		excluded bool
+	}{
+		{"x.log", false, true},
+		{"deep/down/x.log", false, true},
+		{"deep/keep.log", false, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"deep/cache", true, true},
+		{"top", false, true},
+		{"deep/top", false, false},
+		{"a/z", true, true},
+		{"a/b/c/z", false, true},
+		{"b/a/z", false, false},
+		{"logs", true, false},
+		{"logs/x", false, true},
+		{"#hash", false, true},
+		{"sub/build", true, true},
+		{"sub/deeper/build", false, true},
+		{"build", false, false},
+		{"sub/other.log", false, false},
+		{"sub/deeper/other.log", false, true},
+	} {
+		if got := rules.excluded(tc.rel, tc.isDir); got != tc.excluded {
+			t.Errorf("%q (dir %v) excluded: %v, expect %v", tc.rel, tc.isDir, got, tc.excluded)
+		}
+	}
+}
+
+func TestScanIgnore(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "sure-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	files := map[string]string{
+		"a.txt":                   "",
+		"b.log":                   "",
+		"node_modules/x/index.js": "",
+		"src/" + IgnoreFile:       "*.o\n!keep.o\n",
+		"src/main.c":              "",
+		"src/main.o":              "",
+		"src/keep.o":              "",
+		"src/lib/util.o":          "",
+		"other/util.o":            "",
+	}
+	for name, text := range files {
+		name = filepath.Join(tdir, name)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(name, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := Scanner{
+		Exclude: []string{"node_modules/", "*.log", "*.txt"},
+		Include: []string{"a.txt"},
+	}
+	tree, err := sc.Scan(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	walkRegFiles(tree, ".", func(name string, atts *RegAtts) {
+		names = append(names, name)
+	})
+	expect := []string{"other/util.o", "src/" + IgnoreFile, "src/keep.o", "src/main.c", "a.txt"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Fatalf("Scanned %q, expect %q", names, expect)
+	}
+
+	// The ignore files used are recorded.
+	if len(sc.IgnoreDigests) != 1 || len(sc.IgnoreDigests["src/"+IgnoreFile]) != 64 {
+		t.Fatalf("Ignore digests %q", sc.IgnoreDigests)
+	}
+}
@@ -0,0 +1,130 @@
+package sure
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Hard links are recorded by giving each set of regular files in a scan
+// that share an inode the same Link number, counting from 1 in the
+// order the first of each set is visited.  Files that aren't linked to
+// another file in the scan have a Link of 0.  The numbers only have
+// meaning within a single scan.
+
+// assignLinks sets the Link of every regular file in the tree.
+func assignLinks(tree *Tree) {
+	count := make(map[inode]int)
+	walkDevFiles(tree, 0, func(dev uint64, atts *RegAtts) {
+		if atts.Nlink > 1 {
+			count[inode{dev, atts.Ino}]++
+		}
+	})
+
+	links := make(map[inode]uint64)
+	walkDevFiles(tree, 0, func(dev uint64, atts *RegAtts) {
+		key := inode{dev, atts.Ino}
+		if atts.Nlink <= 1 || count[key] < 2 {
+			return
+		}
+		link, ok := links[key]
+		if !ok {
+			link = uint64(len(links) + 1)
+			links[key] = link
+		}
+		atts.Link = link
+	})
+}
+
+// walkDevFiles calls fn with the device and attributes of every regular
+// file in the tree, in the same order as walkRegFiles.
+func walkDevFiles(tree *Tree, dev uint64, fn func(dev uint64, atts *RegAtts)) {
+	if d := dirDev(tree); d != 0 {
+		dev = d
+	}
+	for _, c := range tree.Children {
+		walkDevFiles(c, dev, fn)
+	}
+	for _, f := range tree.Files {
+		if atts, ok := f.Atts.(*RegAtts); ok {
+			fn(dev, atts)
+		}
+	}
+}
+
+// walkRegFiles calls fn with the path and attributes of every regular
+// file in the tree, directories first, in order.
+func walkRegFiles(tree *Tree, name string, fn func(name string, atts *RegAtts)) {
+	for _, c := range tree.Children {
+		walkRegFiles(c, path.Join(name, c.Name), fn)
+	}
+	for _, f := range tree.Files {
+		if atts, ok := f.Atts.(*RegAtts); ok {
+			fn(path.Join(name, f.Name), atts)
+		}
+	}
+}
+
+// compLinks reports files that were hard linked in the older tree and
+// no longer are, and files that are newly hard linked.  Files whose
+// links weren't recorded in either tree aren't compared.
+func (w Comparer) compLinks(older, newer *Tree) {
+	oldFiles := make(map[string]*RegAtts)
+	walkRegFiles(older, ".", func(name string, atts *RegAtts) {
+		oldFiles[name] = atts
+	})
+	newFiles := make(map[string]*RegAtts)
+	walkRegFiles(newer, ".", func(name string, atts *RegAtts) {
+		newFiles[name] = atts
+	})
+
+	var lines []string
+	lines = linkChanges(oldFiles, newFiles, "hard link broken", "was linked to", lines)
+	lines = linkChanges(newFiles, oldFiles, "new hard link", "linked to", lines)
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprint(w.write, line)
+	}
+}
+
+// linkChanges finds the sets of files that are hard linked in 'from',
+// and reports each file in a set that isn't linked to the first file of
+// the set in 'to'.
+func linkChanges(from, to map[string]*RegAtts, what, verb string, lines []string) []string {
+	groups := make(map[uint64][]string)
+	for name, atts := range from {
+		if atts.Link != 0 {
+			groups[atts.Link] = append(groups[atts.Link], name)
+		}
+	}
+
+	for _, names := range groups {
+		sort.Strings(names)
+
+		// The first of the set that is also in the other tree,
+		// with its links recorded.
+		first := -1
+		for i, name := range names {
+			if atts, ok := to[name]; ok && atts.Nlink != 0 {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			continue
+		}
+		link := to[names[first]].Link
+
+		for _, name := range names[first+1:] {
+			atts, ok := to[name]
+			if !ok || atts.Nlink == 0 {
+				continue
+			}
+			if atts.Link == 0 || atts.Link != link {
+				lines = append(lines, fmt.Sprintf("  [%-20s] %s (%s %s)\n",
+					what, name, verb, names[first]))
+			}
+		}
+	}
+	return lines
+}
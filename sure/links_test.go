@@ -0,0 +1,98 @@
+package sure
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "sure-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	name := func(base string) string { return filepath.Join(tdir, base) }
+	for _, base := range []string{"a", "c"} {
+		err := ioutil.WriteFile(name(base), []byte(base+" data\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Link(name("a"), name("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older, err := ScanFs(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]uint64)
+	walkRegFiles(older, ".", func(name string, atts *RegAtts) {
+		links[name] = atts.Link
+	})
+	if links["a"] == 0 || links["a"] != links["b"] || links["c"] != 0 {
+		t.Fatalf("Link groups: %v", links)
+	}
+
+	est := older.EstimateHashes()
+	if est.Files != 2 {
+		t.Fatalf("Estimate of %d files to hash, expect 2", est.Files)
+	}
+	prog := NewProgress(est.Files, est.Bytes, ioutil.Discard)
+	older.ComputeHashes(&prog, tdir)
+	if !bytes.Equal(older.Files[0].Atts.(*RegAtts).Sha1, older.Files[1].Atts.(*RegAtts).Sha1) {
+		t.Fatal("Linked files have different hashes")
+	}
+
+	// Break the link to b, keeping its contents, and link c to a.
+	for _, base := range []string{"b", "c"} {
+		err := os.Remove(name(base))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(name("b"), []byte("a data\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(name("a"), name("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer, err := ScanFs(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MigrateHashes(older, newer)
+	prog = NewProgress(0, 0, ioutil.Discard)
+	newer.ComputeHashes(&prog, tdir)
+
+	var buf bytes.Buffer
+	NewComparer(&buf).CompareTrees(older, newer)
+	for _, want := range []string{
+		"hard link broken    ] b (was linked to a)\n",
+		"new hard link       ] c (linked to a)\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("Compare output:\n%s\nmissing: %q", buf.String(), want)
+		}
+	}
+
+	// Nothing is reported against a tree without links recorded.
+	walkRegFiles(older, ".", func(name string, atts *RegAtts) {
+		atts.Nlink = 0
+		atts.Link = 0
+	})
+	buf.Reset()
+	NewComparer(&buf).CompareTrees(older, newer)
+	if strings.Contains(buf.String(), "link") {
+		t.Fatalf("Links reported against unrecorded tree:\n%s", buf.String())
+	}
+}
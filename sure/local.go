@@ -25,10 +25,55 @@ func newScanMeter(meter io.Writer) *scanMeter {
 	}
 }
 
+// A Scanner walks a directory tree, as ScanFs does, with options for
+// what is recorded.  The zero Scanner records the same as ScanFs.
+type Scanner struct {
+	// Xattrs records the extended attributes of every node.
+	Xattrs bool
+
+	// XattrInclude limits the extended attributes recorded to those
+	// in these namespaces (such as "security"), or with these names.
+	// All are recorded if it is empty.
+	XattrInclude []string
+
+	// XattrExclude lists namespaces or names of extended attributes
+	// that aren't recorded.
+	XattrExclude []string
+
+	// OneFileSystem leaves out directories on filesystems other
+	// than the one the scan starts on.
+	OneFileSystem bool
+
+	// SkipFstypes leaves out directories on filesystems of these
+	// types, such as "proc" or "sysfs".  The top of the scan is never
+	// left out.
+	SkipFstypes []string
+
+	// Exclude and Include are patterns, following the rules of
+	// IgnoreFile, for what isn't scanned, and for what is scanned
+	// anyway, from the top of the scan.  The Include patterns come
+	// after the Exclude patterns, and rules from IgnoreFiles come
+	// after both.
+	Exclude []string
+	Include []string
+
+	// IgnoreDigests is set by Scan to the SHA-256, in hex, of each
+	// IgnoreFile whose rules were used, by its path from the top of
+	// the scan.
+	IgnoreDigests map[string]string
+}
+
 // Walk a directory tree, generating a tree structure for it.  All
 // attributes are filled in that can be gleaned through lstat (and
 // possibly readlink).  The files themselves are not opened.
 func ScanFs(path string, meter io.Writer) (tree *Tree, err error) {
+	var sc Scanner
+	return sc.Scan(path, meter)
+}
+
+// Scan walks a directory tree, as ScanFs, recording what the scanner
+// asks for.
+func (sc *Scanner) Scan(path string, meter io.Writer) (tree *Tree, err error) {
 	stat, err := os.Lstat(path)
 	if err != nil {
 		return
@@ -41,14 +86,42 @@ func ScanFs(path string, meter io.Writer) (tree *Tree, err error) {
 
 	sm := newScanMeter(meter)
 
-	return walkFs("__root__", path, stat, sm)
+	lines := append([]string{}, sc.Exclude...)
+	for _, pat := range sc.Include {
+		lines = append(lines, "!"+pat)
+	}
+	rules := ignoreRules(nil).parse("", lines)
+	sc.IgnoreDigests = make(map[string]string)
+
+	tree, err = sc.walkFs("__root__", path, "", stat, nil, rules, sm)
+	if err != nil {
+		return
+	}
+	assignLinks(tree)
+	return
 }
 
-// Walk an already statted (directory) node.
-func walkFs(name, fullName string, stat os.FileInfo, sm *scanMeter) (tree *Tree, err error) {
+// Walk an already statted (directory) node.  The tree is nil if the
+// directory is on a filesystem that the scanner leaves out.  'rel' is
+// the path of the directory from the top of the scan, and 'parent' is
+// nil for the top of the scan.  Nodes excluded by the rules are left
+// out.
+func (sc *Scanner) walkFs(name, fullName, rel string, stat os.FileInfo, parent *DirAtts, rules ignoreRules, sm *scanMeter) (tree *Tree, err error) {
+	atts := sc.getAtts(fullName, stat).(*DirAtts)
+	atts.Dev = uint64(stat.Sys().(*syscall.Stat_t).Dev)
+	if parent == nil || atts.Dev != parent.Dev {
+		if parent != nil && sc.OneFileSystem {
+			return nil, nil
+		}
+		atts.Fstype, atts.Mount = fsInfo(fullName, atts.Dev)
+		if parent != nil && sc.skipFstype(atts.Fstype) {
+			return nil, nil
+		}
+	}
+
 	tree = &Tree{
 		Name: name,
-		Atts: getAtts(fullName, stat),
+		Atts: atts,
 	}
 
 	entries, err := readdir(fullName)
@@ -58,21 +131,39 @@ func walkFs(name, fullName string, stat os.FileInfo, sm *scanMeter) (tree *Tree,
 
 	sort.Sort(byName(entries))
 
+	for _, ent := range entries {
+		if ent.Name() == IgnoreFile && ent.Mode().IsRegular() {
+			lines, digest := readIgnore(path.Join(fullName, IgnoreFile))
+			if digest != "" {
+				sc.IgnoreDigests[path.Join(rel, IgnoreFile)] = digest
+			}
+			rules = rules.parse(rel, lines)
+		}
+	}
+
 	for _, ent := range entries {
 		// log.Printf("Walk: %q", ent.Name())
+		entRel := path.Join(rel, ent.Name())
+		if rules.excluded(entRel, ent.IsDir()) {
+			continue
+		}
+
 		if ent.IsDir() {
 			var child *Tree
-			child, err = walkFs(ent.Name(),
-				path.Join(fullName, ent.Name()), ent, sm)
+			child, err = sc.walkFs(ent.Name(),
+				path.Join(fullName, ent.Name()), entRel, ent, atts, rules, sm)
 			if err != nil {
 				log.Printf("Unable to stat %q: %v", path.Join(fullName, ent.Name()), err)
 				continue
 			}
+			if child == nil {
+				continue
+			}
 			tree.Children = append(tree.Children, child)
 		} else {
 			node := &File{
 				Name: ent.Name(),
-				Atts: getAtts(path.Join(fullName, ent.Name()), ent),
+				Atts: sc.getAtts(path.Join(fullName, ent.Name()), ent),
 			}
 			tree.Files = append(tree.Files, node)
 			sm.files++
@@ -117,6 +208,33 @@ func readdir(path string) ([]os.FileInfo, error) {
 	return fi, nil
 }
 
+func (sc *Scanner) skipFstype(fstype string) bool {
+	for _, skip := range sc.SkipFstypes {
+		if fstype == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// getAtts gets the attributes of a node, along with the extended
+// attributes if the scanner records them.
+func (sc *Scanner) getAtts(name string, info os.FileInfo) AttMap {
+	atts := getAtts(name, info)
+	if !sc.Xattrs {
+		return atts
+	}
+
+	filter := xattrFilter{include: sc.XattrInclude, exclude: sc.XattrExclude}
+	x, err := getXattrs(name, filter)
+	if err != nil {
+		log.Printf("Unable to read xattrs of %q: %v", name, err)
+		return atts
+	}
+	baseAtts(atts).Xattrs = x
+	return atts
+}
+
 func getAtts(name string, info os.FileInfo) AttMap {
 	var atts AttMap
 	sys := info.Sys().(*syscall.Stat_t)
@@ -133,6 +251,7 @@ func getAtts(name string, info os.FileInfo) AttMap {
 			Ctime: ctime,
 			Ino:   sys.Ino,
 			Size:  sys.Size,
+			Nlink: uint64(sys.Nlink),
 		}
 		basePerms(&regAtts.BaseAtts, sys)
 		atts = regAtts
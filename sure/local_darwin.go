@@ -4,6 +4,33 @@ import (
 	"syscall"
 )
 
-func getSysTimes(sys *syscall.Stat_t) (int64, int64) {
-	return sys.Mtimespec.Sec, sys.Ctimespec.Sec
+func getSysTimes(sys *syscall.Stat_t) (Timestamp, Timestamp) {
+	return Timestamp{Nsec: sys.Mtimespec.Nano()}, Timestamp{Nsec: sys.Ctimespec.Nano()}
+}
+
+// fsInfo returns the type of the filesystem holding the named
+// directory, and where that filesystem is mounted.
+func fsInfo(name string, dev uint64) (fstype, mount string) {
+	var st syscall.Statfs_t
+	if syscall.Statfs(name, &st) != nil {
+		return
+	}
+	return cString(st.Fstypename[:]), cString(st.Mntonname[:])
+}
+
+func cString(text []int8) string {
+	buf := make([]byte, 0, len(text))
+	for _, ch := range text {
+		if ch == 0 {
+			break
+		}
+		buf = append(buf, byte(ch))
+	}
+	return string(buf)
+}
+
+// getXattrs isn't supported on this platform, and always gives an
+// empty set.
+func getXattrs(name string, filter xattrFilter) (Xattrs, error) {
+	return make(Xattrs), nil
 }
@@ -1,9 +1,224 @@
 package sure
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"unsafe"
 )
 
-func getSysTimes(sys *syscall.Stat_t) (int64, int64) {
-	return sys.Mtim.Sec, sys.Ctim.Sec
+func getSysTimes(sys *syscall.Stat_t) (Timestamp, Timestamp) {
+	return Timestamp{Nsec: sys.Mtim.Nano()}, Timestamp{Nsec: sys.Ctim.Nano()}
+}
+
+// fsInfo returns the type of the filesystem holding the named
+// directory, which is on device 'dev', and where that filesystem is
+// mounted.  These come from /proc/self/mountinfo, with the type coming
+// from statfs if the filesystem can't be found there.
+func fsInfo(name string, dev uint64) (fstype, mount string) {
+	abs, err := filepath.Abs(name)
+	if err == nil {
+		fstype, mount = findMount(abs, dev)
+	}
+	if fstype != "" {
+		return
+	}
+
+	var st syscall.Statfs_t
+	if syscall.Statfs(name, &st) != nil {
+		return
+	}
+	fstype, ok := fsMagic[st.Type]
+	if !ok {
+		fstype = fmt.Sprintf("0x%x", st.Type)
+	}
+	return
+}
+
+// findMount looks through /proc/self/mountinfo for the mount of device
+// 'dev' that holds 'name'.  With bind mounts, there can be several
+// mounts of a device, and the one with the longest mount point that
+// holds the name is used.
+func findMount(name string, dev uint64) (fstype, mount string) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	want := fmt.Sprintf("%d:%d", major, minor)
+
+	scan := bufio.NewScanner(file)
+	for scan.Scan() {
+		// Fields are: id parent major:minor root mount-point
+		// options optional-fields... - fstype source options
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 5 || fields[2] != want {
+			continue
+		}
+		sep := -1
+		for i := 5; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+
+		point := unescapeMount(fields[4])
+		if point != "/" && name != point && !strings.HasPrefix(name, point+"/") {
+			continue
+		}
+		if len(point) >= len(mount) {
+			fstype, mount = fields[sep+1], point
+		}
+	}
+	return
+}
+
+// unescapeMount decodes the octal escapes (such as \040 for a space)
+// used in mountinfo.
+func unescapeMount(text string) string {
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+3 < len(text) {
+			if ch, err := strconv.ParseUint(text[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(ch))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(text[i])
+	}
+	return buf.String()
+}
+
+// The names of filesystem types by their statfs magic numbers, for
+// filesystems that aren't in mountinfo.
+var fsMagic = map[int64]string{
+	0x9fa0:     "proc",
+	0x62656572: "sysfs",
+	0x01021994: "tmpfs",
+	0x858458f6: "ramfs",
+	0x1cd1:     "devpts",
+	0x27e0eb:   "cgroup",
+	0x63677270: "cgroup2",
+	0x64626720: "debugfs",
+	0x74726163: "tracefs",
+	0x73636673: "securityfs",
+	0xef53:     "ext4",
+	0x58465342: "xfs",
+	0x9123683e: "btrfs",
+	0x2fc12fc1: "zfs",
+	0x6969:     "nfs",
+	0xff534d42: "cifs",
+	0x794c7630: "overlay",
+	0x65735546: "fuse",
+}
+
+// getXattrs reads the extended attributes of a node, without
+// following symlinks.  A filesystem without extended attributes gives
+// an empty set.
+func getXattrs(name string, filter xattrFilter) (Xattrs, error) {
+	x := make(Xattrs)
+
+	list, err := readXattr(func(buf []byte) (int, error) {
+		return llistxattr(name, buf)
+	})
+	if err == syscall.ENOTSUP {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range bytes.Split(list, []byte{0}) {
+		if len(attr) == 0 || !filter.wanted(string(attr)) {
+			continue
+		}
+		value, err := readXattr(func(buf []byte) (int, error) {
+			return lgetxattr(name, string(attr), buf)
+		})
+		if err == syscall.ENODATA {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		x[string(attr)] = value
+	}
+
+	return x, nil
+}
+
+// readXattr calls an xattr syscall, first to find the size of the
+// result, and then to read it, retrying if it grew in between.
+func readXattr(call func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		size, err = call(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+func llistxattr(path string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(d), uintptr(len(dest)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func lgetxattr(path, attr string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)),
+		uintptr(d), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
 }
@@ -0,0 +1,68 @@
+package sure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Scan across a tmpfs mounted inside the tree, when we are able to
+// mount one.
+func TestFsBoundaries(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "sure-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	mnt := filepath.Join(tdir, "mnt")
+	err = os.Mkdir(mnt, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mount("none", mnt, "tmpfs", 0, "")
+	if err != nil {
+		t.Skipf("Unable to mount tmpfs: %v", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	err = ioutil.WriteFile(filepath.Join(mnt, "file"), []byte("data\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sc Scanner
+	tree, err := sc.Scan(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 1 {
+		t.Fatalf("Scanned %d directories, expect 1", len(tree.Children))
+	}
+	root := tree.Atts.(*DirAtts)
+	atts := tree.Children[0].Atts.(*DirAtts)
+	if atts.Fstype != "tmpfs" || atts.Mount != mnt || atts.Dev == root.Dev || root.Fstype == "" {
+		t.Fatalf("Mount point recorded as %+v, top as %+v", atts, root)
+	}
+
+	for _, sc := range []Scanner{
+		{OneFileSystem: true},
+		{SkipFstypes: []string{"proc", "tmpfs"}},
+	} {
+		tree, err := sc.Scan(tdir, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.Children) != 0 {
+			t.Fatalf("Scanner %+v scanned the tmpfs", sc)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	got := unescapeMount(`/mnt/with\040space\134x\04`)
+	if got != `/mnt/with space\x\04` {
+		t.Fatalf("Unescaped to %q", got)
+	}
+}
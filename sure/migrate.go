@@ -1,10 +1,26 @@
 package sure
 
-// Notice: there is a fairly strong assumption that this tool will not
-// be used to cross filesystems.  We don't store device numbers and
-// can't distinguish inodes from different filesystems.
+// Files are matched by their device and inode.  The device is that of
+// the directory holding the file.  Older surefiles don't record
+// devices, and their files are recorded with a device of 0, which
+// matches a file on any device with the same inode.
 
-type inoMap map[uint64]*RegAtts
+// An inode identifies a file.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+type inoMap map[inode]*RegAtts
+
+// dirDev returns the device recorded for a directory, or 0 if there
+// isn't one.
+func dirDev(tree *Tree) uint64 {
+	if atts, ok := tree.Atts.(*DirAtts); ok {
+		return atts.Dev
+	}
+	return 0
+}
 
 // Migrate hashes from oldTree to newTree.  Any files that are the
 // same in the oldTree as the newTree will have their hash migrated to
@@ -18,8 +34,8 @@ func MigrateHashes(oldTree, newTree *Tree) {
 
 // Walk through the tree, gathering all of the hashes of existing
 // nodes, keeping a pointer to the attribute map of the node.  We only
-// use the inode to distinguish the nodes, so the position and such of
-// the node is not needed.
+// use the device and inode to distinguish the nodes, so the position
+// and such of the node is not needed.
 func getHashes(tree *Tree, hashes inoMap) {
 	// Walk the children
 	for _, c := range tree.Children {
@@ -41,7 +57,7 @@ func getHashes(tree *Tree, hashes inoMap) {
 		// Come up with a way of dealing with this or just
 		// warning.
 
-		hashes[atts.Ino] = atts
+		hashes[inode{dirDev(tree), atts.Ino}] = atts
 	}
 }
 
@@ -60,14 +76,18 @@ func updateHashes(tree *Tree, hashes inoMap) {
 			continue
 		}
 
-		oldAtt, ok := hashes[atts.Ino]
+		oldAtt, ok := hashes[inode{dirDev(tree), atts.Ino}]
+		if !ok {
+			oldAtt, ok = hashes[inode{0, atts.Ino}]
+		}
 		if !ok {
 			continue
 		}
 
 		// For sanity, make sure the ctime, and size are the
-		// same.
-		if oldAtt.Ctime != atts.Ctime || oldAtt.Size != atts.Size {
+		// same.  A ctime from an older surefile only has seconds,
+		// so a change within the same second can't be seen.
+		if !oldAtt.Ctime.Same(atts.Ctime) || oldAtt.Size != atts.Size {
 			continue
 		}
 
@@ -0,0 +1,44 @@
+package sure
+
+import (
+	"testing"
+)
+
+// Hashes are only migrated between files on the same device, unless
+// the older tree predates recording devices.
+func TestMigrateDevices(t *testing.T) {
+	tree := func(devs ...uint64) *Tree {
+		tr := &Tree{Atts: &DirAtts{Dev: devs[0]}}
+		for _, dev := range devs[1:] {
+			tr.Children = append(tr.Children, &Tree{
+				Atts: &DirAtts{Dev: dev},
+				Files: []*File{{
+					Name: "file",
+					Atts: &RegAtts{Ino: 12, Size: 5, Sha1: []byte{byte(dev)}},
+				}},
+			})
+		}
+		return tr
+	}
+	hash := func(tr *Tree, i int) []byte {
+		return tr.Children[i].Files[0].Atts.(*RegAtts).Sha1
+	}
+
+	older := tree(1, 1, 2)
+	newer := tree(1, 1, 3)
+	for _, ch := range newer.Children {
+		ch.Files[0].Atts.(*RegAtts).Sha1 = nil
+	}
+	MigrateHashes(older, newer)
+	if hash(newer, 0) == nil || hash(newer, 0)[0] != 1 || hash(newer, 1) != nil {
+		t.Fatalf("Migrated hashes %v and %v", hash(newer, 0), hash(newer, 1))
+	}
+
+	older = tree(0, 0)
+	newer = tree(1, 3)
+	newer.Children[0].Files[0].Atts.(*RegAtts).Sha1 = nil
+	MigrateHashes(older, newer)
+	if hash(newer, 0) == nil {
+		t.Fatal("Hash not migrated from a tree without devices")
+	}
+}
@@ -0,0 +1,104 @@
+package sure
+
+// Counts summarizes the contents of a tree.
+type Counts struct {
+	Dirs   int64 // Directories, including the top directory.
+	Files  int64 // Regular files.
+	Links  int64 // Symbolic links.
+	Others int64 // Devices, fifos, and sockets.
+	Bytes  int64 // The total size of the regular files.
+}
+
+// Count returns counts of the nodes in the tree.
+func (t *Tree) Count() Counts {
+	var c Counts
+	c.add(t)
+	return c
+}
+
+func (c *Counts) add(t *Tree) {
+	c.Dirs++
+
+	for _, f := range t.Files {
+		switch atts := f.Atts.(type) {
+		case *RegAtts:
+			c.Files++
+			c.Bytes += atts.Size
+		case *LinkAtts:
+			c.Links++
+		default:
+			c.Others++
+		}
+	}
+
+	for _, ch := range t.Children {
+		c.add(ch)
+	}
+}
+
+// Changes counts the differences between two trees.
+type Changes struct {
+	Added   int64 // Nodes present only in the newer tree.
+	Removed int64 // Nodes present only in the older tree.
+	Changed int64 // Nodes present in both, with different attributes.
+}
+
+// CountChanges counts the nodes that differ between the two trees,
+// using the same rules as CompareTrees.  Unlike CompareTrees, the
+// contents of directories that were added or removed are included in
+// the counts, and not just the directories themselves.
+func CountChanges(older, newer *Tree) Changes {
+	var ch Changes
+	ch.walk(older, newer)
+	return ch
+}
+
+func (ch *Changes) walk(older, newer *Tree) {
+	oldc := make(map[string]*Tree)
+	for _, och := range older.Children {
+		oldc[och.Name] = och
+	}
+
+	for _, nch := range newer.Children {
+		och, ok := oldc[nch.Name]
+		if ok {
+			ch.walk(och, nch)
+			if len(AttDiff(och.Atts, nch.Atts)) > 0 {
+				ch.Changed++
+			}
+			delete(oldc, och.Name)
+		} else {
+			ch.Added += nodeCount(nch)
+		}
+	}
+
+	for _, och := range oldc {
+		ch.Removed += nodeCount(och)
+	}
+
+	oldf := make(map[string]*File)
+	for _, ofi := range older.Files {
+		oldf[ofi.Name] = ofi
+	}
+
+	for _, nfi := range newer.Files {
+		ofi, ok := oldf[nfi.Name]
+		if ok {
+			if len(AttDiff(ofi.Atts, nfi.Atts)) > 0 {
+				ch.Changed++
+			}
+			delete(oldf, ofi.Name)
+		} else {
+			ch.Added++
+		}
+	}
+
+	ch.Removed += int64(len(oldf))
+}
+
+// nodeCount returns the number of nodes in a tree, including the
+// directory itself.
+func nodeCount(t *Tree) int64 {
+	c := t.Count()
+	return c.Dirs + c.Files + c.Links + c.Others
+}
@@ -0,0 +1,71 @@
+package sure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCountChanges(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	older := GenerateTree(r, 10, 3)
+
+	// Make a copy of the tree to modify.
+	var buf bytes.Buffer
+	err := older.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := CountChanges(older, newer)
+	if ch != (Changes{}) {
+		t.Fatalf("Identical trees have changes: %+v", ch)
+	}
+
+	oc := older.Count()
+	if oc.Dirs < 2 || oc.Files == 0 || nodeCount(older) != oc.Dirs+oc.Files+oc.Links+oc.Others {
+		t.Fatalf("Unexpected counts: %+v", oc)
+	}
+
+	// Remove a directory, and the first file of the top directory,
+	// add a new file, and change the size of the first regular
+	// file found.
+	gone := newer.Children[0]
+	newer.Children = newer.Children[1:]
+	newer.Files = newer.Files[1:]
+	newer.Files = append(newer.Files, &File{
+		Name: "zz-new",
+		Atts: &RegAtts{Size: 42},
+	})
+
+	changed := false
+	for _, f := range newer.Files[:len(newer.Files)-1] {
+		if atts, ok := f.Atts.(*RegAtts); ok {
+			atts.Size++
+			changed = true
+			break
+		}
+	}
+
+	expect := Changes{
+		Added:   1,
+		Removed: nodeCount(gone) + 1,
+	}
+	if changed {
+		expect.Changed = 1
+	}
+
+	ch = CountChanges(older, newer)
+	if ch != expect {
+		t.Fatalf("Changes mismatch: %+v, expected %+v", ch, expect)
+	}
+
+	nc := newer.Count()
+	if nc.Dirs != oc.Dirs-gone.Count().Dirs {
+		t.Fatalf("Directory count mismatch: %d", nc.Dirs)
+	}
+}
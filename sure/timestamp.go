@@ -0,0 +1,68 @@
+package sure
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Timestamp is the time of a file, in nanoseconds since the epoch.
+// Surefiles written before nanosecond times were kept (asure-2.0) only
+// record whole seconds; times read from them are marked Coarse, and
+// are only compared to the second.
+type Timestamp struct {
+	Nsec   int64
+	Coarse bool
+}
+
+// Seconds returns the whole seconds of the timestamp, as the older
+// surefiles recorded them.
+func (t Timestamp) Seconds() int64 {
+	sec := t.Nsec / 1e9
+	if t.Nsec%1e9 < 0 {
+		sec--
+	}
+	return sec
+}
+
+// Same reports whether two timestamps could be the same time.  If
+// either only records seconds, they are the same if they are within the
+// same second.
+func (t Timestamp) Same(o Timestamp) bool {
+	if t.Coarse || o.Coarse {
+		return t.Seconds() == o.Seconds()
+	}
+	return t.Nsec == o.Nsec
+}
+
+// String formats the timestamp as it is written to a surefile: the
+// seconds, followed by a '.' and 9 digits of nanoseconds, which are
+// left off for a coarse timestamp.
+func (t Timestamp) String() string {
+	sec := t.Seconds()
+	if t.Coarse {
+		return strconv.FormatInt(sec, 10)
+	}
+	return fmt.Sprintf("%d.%09d", sec, t.Nsec-sec*1e9)
+}
+
+// parseTimestamp decodes a timestamp written by String.
+func parseTimestamp(text string) (Timestamp, error) {
+	secText, fracText, precise := strings.Cut(text, ".")
+	sec, err := strconv.ParseInt(secText, 10, 64)
+	if err != nil {
+		return Timestamp{}, err
+	}
+	if !precise {
+		return Timestamp{Nsec: sec * 1e9, Coarse: true}, nil
+	}
+
+	if len(fracText) != 9 {
+		return Timestamp{}, fmt.Errorf("Invalid timestamp: %q", text)
+	}
+	frac, err := strconv.ParseUint(fracText, 10, 32)
+	if err != nil {
+		return Timestamp{}, err
+	}
+	return Timestamp{Nsec: sec*1e9 + int64(frac)}, nil
+}
@@ -6,24 +6,40 @@ import (
 
 // BaseAtts are attributes associated with all most types.
 type BaseAtts struct {
-	Uid  uint32
-	Gid  uint32
-	Perm uint32
+	Uid    uint32
+	Gid    uint32
+	Perm   uint32
+	Xattrs Xattrs
 }
 
 type DirAtts struct {
 	BaseAtts
+
+	// The device the directory is on.  For the top of the scan, and
+	// for each directory that is the top of another filesystem, the
+	// type of the filesystem and where it is mounted are recorded as
+	// well.  These are left out of older surefiles.
+	Dev    uint64 `sure:"optional"`
+	Fstype string `sure:"optional"`
+	Mount  string `sure:"optional"`
 }
 
 func (r *DirAtts) GetKind() string { return "dir" }
 
 type RegAtts struct {
 	BaseAtts
-	Mtime int64 // TODO: Store better than seconds.
-	Ctime int64 // TODO: Store better than seconds.
+	Mtime Timestamp
+	Ctime Timestamp
 	Ino   uint64
 	Size  int64
 	Sha1  []byte
+
+	// The number of hard links to the file, and, for files that
+	// are hard linked to another in the same scan, a number shared
+	// by all of the links, see links.go.  These are left out of
+	// older surefiles.
+	Nlink uint64 `sure:"optional"`
+	Link  uint64 `sure:"optional"`
 }
 
 func (r *RegAtts) GetKind() string { return "file" }
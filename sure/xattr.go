@@ -0,0 +1,163 @@
+package sure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Xattrs holds the extended attributes of a node, by name.  These
+// include POSIX ACLs (system.posix_acl_access), SELinux labels
+// (security.selinux), and file capabilities (security.capability).  A
+// nil Xattrs means the extended attributes weren't recorded, either
+// because the scan wasn't asked to, or because the surefile predates
+// them.
+type Xattrs map[string][]byte
+
+var xattrsType = reflect.TypeOf(Xattrs(nil))
+
+// The extended attributes are written to the surefile as an "xattrs"
+// attribute giving how many there are (so that a node with none can be
+// told from one where they weren't recorded), followed by an attribute
+// for each, with the name prefixed by xattrPrefix, and the value in
+// hex, or "-" for an empty value.
+const xattrPrefix = "xattr."
+
+func (x Xattrs) encode(atts []stringPair) []stringPair {
+	if x == nil {
+		return atts
+	}
+
+	atts = append(atts, stringPair{
+		key:   "xattrs",
+		value: strconv.Itoa(len(x)),
+	})
+	for name, value := range x {
+		text := "-"
+		if len(value) > 0 {
+			text = hex.EncodeToString(value)
+		}
+		atts = append(atts, stringPair{
+			key:   escapeString(xattrPrefix + name),
+			value: text,
+		})
+	}
+	return atts
+}
+
+// decodeXattrs takes the extended attributes out of the attributes
+// read from a surefile.
+func decodeXattrs(atts map[string]string) (Xattrs, error) {
+	count, ok := atts["xattrs"]
+	if !ok {
+		return nil, nil
+	}
+	delete(atts, "xattrs")
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, err
+	}
+
+	x := make(Xattrs)
+	for key, text := range atts {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+		delete(atts, key)
+
+		value := []byte{}
+		if text != "-" {
+			value, err = hex.DecodeString(text)
+			if err != nil {
+				return nil, err
+			}
+		}
+		x[strings.TrimPrefix(key, xattrPrefix)] = value
+	}
+
+	if len(x) != n {
+		return nil, fmt.Errorf("Expecting %d xattrs, found %d", n, len(x))
+	}
+	return x, nil
+}
+
+// xattrDiff returns the differences between two sets of extended
+// attributes, as "+xattr:name" for those added, "-xattr:name" for those
+// removed, and "xattr:name" for those whose value changed.  If either
+// wasn't recorded, there are no differences.
+func xattrDiff(ox, nx Xattrs, mismatch []string) []string {
+	if ox == nil || nx == nil {
+		return mismatch
+	}
+
+	var names []string
+	for name := range ox {
+		names = append(names, name)
+	}
+	for name := range nx {
+		if _, ok := ox[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ov, inOld := ox[name]
+		nv, inNew := nx[name]
+		switch {
+		case !inOld:
+			mismatch = append(mismatch, "+xattr:"+name)
+		case !inNew:
+			mismatch = append(mismatch, "-xattr:"+name)
+		case !bytes.Equal(ov, nv):
+			mismatch = append(mismatch, "xattr:"+name)
+		}
+	}
+	return mismatch
+}
+
+// xattrFilter decides which extended attributes are recorded.  Each
+// entry of the lists is either a namespace, such as "security", or the
+// full name of an attribute.
+type xattrFilter struct {
+	include []string
+	exclude []string
+}
+
+func xattrMatch(name string, list []string) bool {
+	for _, item := range list {
+		if name == item || strings.HasPrefix(name, item+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f xattrFilter) wanted(name string) bool {
+	if len(f.include) > 0 && !xattrMatch(name, f.include) {
+		return false
+	}
+	return !xattrMatch(name, f.exclude)
+}
+
+// baseAtts returns the attributes shared by every kind of node.
+func baseAtts(atts AttMap) *BaseAtts {
+	switch a := atts.(type) {
+	case *DirAtts:
+		return &a.BaseAtts
+	case *RegAtts:
+		return &a.BaseAtts
+	case *LinkAtts:
+		return &a.BaseAtts
+	case *FifoAtts:
+		return &a.BaseAtts
+	case *DevAtts:
+		return &a.BaseAtts
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package sure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Scan a file with a user xattr, when the filesystem supports them.
+func TestScanXattrs(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "sure-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	name := filepath.Join(tdir, "file")
+	err = ioutil.WriteFile(name, []byte("data\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setxattr(name, "user.gosure-test", []byte("value"), 0)
+	if err != nil {
+		t.Skipf("Unable to set xattr: %v", err)
+	}
+
+	sc := Scanner{Xattrs: true, XattrInclude: []string{"user"}}
+	tr, err := sc.Scan(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := tr.Files[0].Atts.(*RegAtts).Xattrs
+	if !reflect.DeepEqual(x, Xattrs{"user.gosure-test": []byte("value")}) {
+		t.Fatalf("Scanned xattrs %q", x)
+	}
+
+	tr, err = ScanFs(tdir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := tr.Files[0].Atts.(*RegAtts).Xattrs; x != nil {
+		t.Fatalf("Xattrs recorded without being asked: %q", x)
+	}
+}
@@ -0,0 +1,74 @@
+package sure
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Extended attributes survive encoding, and their changes are reported
+// by name.
+func TestXattrs(t *testing.T) {
+	older := &RegAtts{BaseAtts: BaseAtts{Xattrs: Xattrs{
+		"security.capability":      {1, 2, 3},
+		"system.posix_acl_access":  {4},
+		"security.selinux":         []byte("system_u:object_r:bin_t:s0\x00"),
+		"user.empty":               {},
+		"user.with space=and\xffs": {5},
+	}}, Sha1: bytes.Repeat([]byte{0xaa}, 20)}
+	newer := &RegAtts{BaseAtts: BaseAtts{Xattrs: Xattrs{
+		"security.capability": {1, 2, 3},
+		"security.selinux":    []byte("system_u:object_r:tmp_t:s0\x00"),
+		"user.empty":          {},
+		"user.added":          {6},
+	}}, Sha1: older.Sha1}
+
+	tr := &Tree{
+		Name:  "__root__",
+		Atts:  &DirAtts{BaseAtts: BaseAtts{Xattrs: Xattrs{}}},
+		Files: []*File{{Name: "file", Atts: older}},
+	}
+	var buf bytes.Buffer
+	err := tr.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tr2.Atts, tr.Atts) || !reflect.DeepEqual(tr2.Files[0].Atts, older) {
+		t.Fatalf("Decoded %+v, expect %+v", tr2.Files[0].Atts, older)
+	}
+
+	diff := AttDiff(older, newer)
+	expect := []string{"+xattr:user.added", "-xattr:system.posix_acl_access",
+		"-xattr:user.with space=and\xffs", "xattr:security.selinux"}
+	if !reflect.DeepEqual(diff, expect) {
+		t.Fatalf("AttDiff: %q, expect %q", diff, expect)
+	}
+
+	// Nothing is reported when either didn't record them.
+	if diff := AttDiff(older, &RegAtts{Sha1: older.Sha1}); len(diff) != 0 {
+		t.Fatalf("Unrecorded xattrs differ: %q", diff)
+	}
+}
+
+func TestXattrFilter(t *testing.T) {
+	f := xattrFilter{
+		include: []string{"security", "user.keep"},
+		exclude: []string{"security.selinux"},
+	}
+	for name, want := range map[string]bool{
+		"security.capability": true,
+		"security.selinux":    false,
+		"securityx.other":     false,
+		"user.keep":           true,
+		"user.other":          false,
+		"system.posix_acl":    false,
+	} {
+		if f.wanted(name) != want {
+			t.Errorf("%q wanted: %v, expect %v", name, !want, want)
+		}
+	}
+}
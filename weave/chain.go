@@ -0,0 +1,346 @@
+package weave
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each delta records the SHA-256 digest of its contents, and a chain
+// value, which is a digest covering the chain value of the previous
+// delta, along with the time and digest of this delta.  Rewriting
+// the contents of a delta, or removing or reordering deltas, breaks
+// the chain.  Since anyone able to write the weave file could also
+// recompute the chain, the chain values can also be signed with an
+// Ed25519 key.  The names and tags of the deltas are not covered, so
+// that they can be changed without the signing key.
+
+// A SigningNaming is a NamingConvention that can sign the chain values
+// of the deltas written.
+type SigningNaming interface {
+	NamingConvention
+
+	// The key used to sign new deltas, or nil to not sign them.
+	SigningKey() ed25519.PrivateKey
+}
+
+// signingKey returns the naming convention's signing key, if it has
+// one.
+func signingKey(nc NamingConvention) ed25519.PrivateKey {
+	if sn, ok := nc.(SigningNaming); ok {
+		return sn.SigningKey()
+	}
+	return nil
+}
+
+// A contentHash computes the digest of the contents of a delta, as
+// written to a DeltaWriter or NewWeaveWriter.  The digest is of the
+// contents as they will be read back, with every line, including the
+// last, ending in a newline.
+type contentHash struct {
+	h    hash.Hash
+	last byte
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{
+		h:    sha256.New(),
+		last: '\n',
+	}
+}
+
+func (c *contentHash) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.last = p[len(p)-1]
+	}
+	return c.h.Write(p)
+}
+
+// complete reports whether the contents end with a newline.
+func (c *contentHash) complete() bool {
+	return c.last == '\n'
+}
+
+// digest returns the digest of the contents, in hex.
+func (c *contentHash) digest() string {
+	if !c.complete() {
+		c.h.Write([]byte{'\n'})
+		c.last = '\n'
+	}
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// chainValue computes the chain value of a delta, following the
+// delta with the given chain value.
+func chainValue(prev string, d *Delta) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "gosure-chain\n%s\n%s\n%s\n", prev,
+		d.Time.UTC().Format(time.RFC3339Nano), d.Digest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sign signs the chain value of the delta.
+func (d *Delta) sign(key ed25519.PrivateKey) {
+	d.Signature = ""
+	if key == nil {
+		return
+	}
+	raw, _ := hex.DecodeString(d.Chain)
+	d.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, raw))
+}
+
+// seal records the digest of the contents of the given delta, which
+// should be the last one in the header, and links it to the chain,
+// signing it if a key is given.
+func (h *Header) seal(num int, digest string, key ed25519.PrivateKey) {
+	prev := ""
+	for i, d := range h.Deltas {
+		if d.Number != num {
+			prev = d.Chain
+			continue
+		}
+
+		d.Digest = digest
+		d.Chain = chainValue(prev, d)
+		d.sign(key)
+		if i < len(h.Deltas)-1 {
+			panic("weave: sealing delta that isn't the latest")
+		}
+	}
+	if h.Version < HeaderVersion {
+		h.Version = HeaderVersion
+	}
+}
+
+// rechain recomputes the chain values of every delta, such as after
+// some have been removed.  Deltas whose chain value changes are signed
+// again, with the given key.  Without a key, their signatures are
+// removed, since they would no longer be valid.
+func (h *Header) rechain(key ed25519.PrivateKey) {
+	prev := ""
+	for _, d := range h.Deltas {
+		if d.Digest == "" {
+			prev = ""
+			continue
+		}
+
+		chain := chainValue(prev, d)
+		if chain != d.Chain || (key != nil && d.Signature == "") {
+			d.Chain = chain
+			d.sign(key)
+		}
+		prev = chain
+	}
+}
+
+// digestDeltas computes the digests of the contents of the given
+// deltas (all of them, if 'deltas' is empty), reading the weave file
+// once.
+func digestDeltas(nc NamingConvention, deltas []int) (map[int]string, error) {
+	hdr, err := ReadHeader(nc)
+	if err != nil {
+		return nil, err
+	}
+	wanted, err := hdr.selectDeltas(deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[int]hash.Hash)
+	for _, num := range wanted {
+		hashes[num] = sha256.New()
+	}
+
+	err = readDeltas(nc, wanted, func(delta int, text string) error {
+		h := hashes[delta]
+		io.WriteString(h, text)
+		h.Write([]byte{'\n'})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[int]string)
+	for num, h := range hashes {
+		digests[num] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// A DigestError indicates that the contents of a delta, as read from
+// the weave file, don't match the digest recorded when it was
+// written.  The weave file has been damaged or altered.
+type DigestError struct {
+	Name  string // The name of the weave file.
+	Delta int    // The delta with the wrong contents.
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("weave: %s: contents of delta %d do not match the digest, the file is damaged",
+		e.Name, e.Delta)
+}
+
+// A digestCheck checks the contents of deltas against their digests,
+// as they are read.
+type digestCheck struct {
+	name    string
+	digests map[int]string
+	hashes  map[int]hash.Hash
+}
+
+// Deltas without digests, that have already been warned about.
+var unverified sync.Map
+
+// newDigestCheck sets up checking the given deltas.  Deltas written
+// before the digests were added can still be read, but a warning is
+// logged (once) that they can't be checked.
+func newDigestCheck(nc NamingConvention, hdr *Header, deltas []int) *digestCheck {
+	check := &digestCheck{
+		name:    nc.MainFile(),
+		digests: make(map[int]string),
+		hashes:  make(map[int]hash.Hash),
+	}
+
+	want := make(map[int]bool)
+	for _, num := range deltas {
+		want[num] = true
+	}
+
+	var missing []int
+	for _, d := range hdr.Deltas {
+		if !want[d.Number] {
+			continue
+		}
+		if d.Digest == "" {
+			key := fmt.Sprintf("%s/%d", check.name, d.Number)
+			if _, seen := unverified.LoadOrStore(key, true); !seen {
+				missing = append(missing, d.Number)
+			}
+			continue
+		}
+		check.digests[d.Number] = d.Digest
+		check.hashes[d.Number] = sha256.New()
+	}
+
+	if len(missing) > 0 {
+		log.Printf("warning: %s: no digest recorded for deltas %v, their contents can't be verified",
+			check.name, missing)
+	}
+	return check
+}
+
+// add adds a line of a delta.
+func (c *digestCheck) add(delta int, text string) {
+	if h, ok := c.hashes[delta]; ok {
+		io.WriteString(h, text)
+		h.Write([]byte{'\n'})
+	}
+}
+
+// verify checks the digests, after all of the deltas have been read.
+func (c *digestCheck) verify() error {
+	var nums []int
+	for num := range c.hashes {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	for _, num := range nums {
+		if hex.EncodeToString(c.hashes[num].Sum(nil)) != c.digests[num] {
+			return &DigestError{Name: c.name, Delta: num}
+		}
+	}
+	return nil
+}
+
+// VerifyChain checks the digests and chain values of every delta of
+// the weave file.  If a public key is given, every delta must also be
+// signed with the matching private key.  Returns the header, and the
+// problems found.  The error result is only used when the file could
+// not be read.
+func VerifyChain(nc NamingConvention, key ed25519.PublicKey) (*Header, []Problem, error) {
+	hdr, err := ReadHeader(nc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digests, err := digestDeltas(nc, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var problems []Problem
+	problem := func(delta int, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Delta: delta,
+			Msg:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	prev := ""
+	for _, d := range hdr.Deltas {
+		if d.Digest == "" {
+			problem(d.Number, "has no digest")
+			prev = ""
+			continue
+		}
+
+		if digests[d.Number] != d.Digest {
+			problem(d.Number, "contents do not match the digest")
+		}
+		if chainValue(prev, d) != d.Chain {
+			problem(d.Number, "does not follow from the previous delta, history has been changed")
+		}
+		prev = d.Chain
+
+		if key == nil {
+			continue
+		}
+		if d.Signature == "" {
+			problem(d.Number, "is not signed")
+			continue
+		}
+		raw, err1 := hex.DecodeString(d.Chain)
+		sig, err2 := base64.StdEncoding.DecodeString(d.Signature)
+		if err1 != nil || err2 != nil || !ed25519.Verify(key, raw, sig) {
+			problem(d.Number, "signature is not valid")
+		}
+	}
+
+	return hdr, problems, nil
+}
+
+// SealChain computes the digests of any deltas that don't have them,
+// such as those written by older versions, and recomputes the chain,
+// signing the deltas with the naming convention's key.  Fails if the
+// contents of any delta don't match a digest already recorded, since
+// sealing would hide the change.
+func SealChain(nc NamingConvention) error {
+	digests, err := digestDeltas(nc, nil)
+	if err != nil {
+		return err
+	}
+
+	return RewriteHeader(nc, func(h *Header) error {
+		for _, d := range h.Deltas {
+			if d.Digest != "" && d.Digest != digests[d.Number] {
+				return fmt.Errorf("weave: delta %d: contents do not match the digest", d.Number)
+			}
+			d.Digest = digests[d.Number]
+		}
+		h.rechain(signingKey(nc))
+		if h.Version < HeaderVersion {
+			h.Version = HeaderVersion
+		}
+		return nil
+	})
+}
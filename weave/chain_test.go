@@ -0,0 +1,256 @@
+package weave_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestChain(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := NewDataSet(tdir, 100)
+	data.NC.Compressed = true
+	data.NC.SignKey = priv
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 5; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify := func(key ed25519.PublicKey, expect ...string) {
+		t.Helper()
+		_, problems, err := weave.VerifyChain(&data.NC, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != len(expect) {
+			t.Fatalf("Got problems %v, expect %q", problems, expect)
+		}
+		for i, p := range problems {
+			if !strings.Contains(p.String(), expect[i]) {
+				t.Fatalf("Got problem %q, expect %q", p, expect[i])
+			}
+		}
+	}
+
+	verify(nil)
+	verify(pub)
+	verify(otherPub, "delta 1: signature is not valid",
+		"delta 2: signature", "delta 3: signature",
+		"delta 4: signature", "delta 5: signature")
+
+	rewrite := func(fn func(h *weave.Header)) {
+		t.Helper()
+		err := weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+			fn(h)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tags can be changed without breaking the chain.
+	rewrite(func(h *weave.Header) {
+		h.Deltas[2].Tags["note"] = "changed"
+		h.Deltas[2].Name = "renamed"
+	})
+	verify(pub)
+
+	// Changing the time of a delta breaks the chain.
+	rewrite(func(h *weave.Header) {
+		h.Deltas[2].Time = h.Deltas[2].Time.Add(time.Hour)
+	})
+	verify(nil, "delta 3: does not follow")
+	rewrite(func(h *weave.Header) {
+		h.Deltas[2].Time = h.Deltas[2].Time.Add(-time.Hour)
+	})
+	verify(pub)
+
+	// Sealing without the key doesn't make a tampered file valid.
+	good := data.NC.SignKey
+	data.NC.SignKey = nil
+	rewrite(func(h *weave.Header) {
+		h.Deltas[1].Digest = h.Deltas[0].Digest
+	})
+	verify(nil, "delta 2: contents do not match", "delta 2: does not follow")
+	err = weave.SealChain(&data.NC)
+	if err == nil {
+		t.Fatal("Sealing a tampered weave should fail")
+	}
+
+	// Removing a delta, without the key, leaves the following
+	// deltas unsigned.
+	err = weave.RemoveDeltas(&data.NC, []int{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Renumber([]int{2})
+	checkAll(t, data)
+	verify(nil)
+	verify(pub, "delta 2: is not signed", "delta 3: is not signed",
+		"delta 4: is not signed")
+
+	// Sealing with the key signs them again.
+	data.NC.SignKey = good
+	err = weave.SealChain(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(pub)
+}
+
+// Weave files written before the chain was added can be sealed.
+func TestSealChain(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 3; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Remove the chain, as if written by an older version.
+	err = weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+		h.Version = 2
+		for _, d := range h.Deltas {
+			d.Digest = ""
+			d.Chain = ""
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, problems, err := weave.VerifyChain(&data.NC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("Expecting 3 problems, got %v", problems)
+	}
+
+	err = weave.SealChain(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, problems, err := weave.VerifyChain(&data.NC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 || hdr.Version != weave.HeaderVersion {
+		t.Fatalf("Sealed weave has problems: %v (version %d)", problems, hdr.Version)
+	}
+
+	// New deltas continue the chain.
+	data.Scramble()
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err = weave.VerifyChain(&data.NC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Weave has problems: %v", problems)
+	}
+}
+
+// Damage to the body of the weave is detected when reading.
+func TestDigestCheck(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	data.NC.Compressed = false
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 3; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(data.NC.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := bytes.Replace(buf, []byte("\n42\n"), []byte("\n43\n"), 1)
+	err = ioutil.WriteFile(data.NC.MainFile(), bad, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(data.NC.IndexFile())
+
+	err = weave.ReadDelta(&data.NC, 1, func(text string) error { return nil })
+	if de, ok := err.(*weave.DigestError); !ok || de.Delta != 1 {
+		t.Fatalf("Damaged delta not detected: %v", err)
+	}
+	err = weave.ReadDeltas(&data.NC, nil, func(delta int, text string) error { return nil })
+	if _, ok := err.(*weave.DigestError); !ok {
+		t.Fatalf("Damaged delta not detected: %v", err)
+	}
+
+	// Without the digests, the damage can't be detected, but the
+	// file can still be read.
+	err = weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+		for _, d := range h.Deltas {
+			d.Digest = ""
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = weave.ReadDelta(&data.NC, 1, func(text string) error { return nil })
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,245 @@
+package weave
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// A Codec is a compression format for weave files (and plain
+// surefiles).  When reading, the codec is determined from the magic
+// bytes at the start of the file, so the choice of codec only affects
+// the files that are written.
+type Codec interface {
+	// The name of the codec, as given by the user.
+	Name() string
+
+	// The suffix added to names of files using this codec,
+	// including the '.'.
+	Ext() string
+
+	// The bytes at the start of every file using this codec.
+	Magic() []byte
+
+	// Return a writer that compresses to 'w'.  Closing the writer
+	// finishes the compressed data, but doesn't close 'w'.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// Return a reader that decompresses from 'r'.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// The available codecs.
+var (
+	Plain Codec = plainCodec{}
+	Gzip  Codec = gzipCodec{}
+	Zstd  Codec = zstdCodec{}
+	Xz    Codec = xzCodec{}
+)
+
+// Codecs lists all of the known codecs.  Any data not starting with
+// the magic of one of the others is assumed to be Plain.
+var Codecs = []Codec{Gzip, Zstd, Xz, Plain}
+
+// CodecByName returns the codec with the given name.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range Codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("weave: unknown compression %q", name)
+}
+
+// CodecByExt returns the codec whose suffix is at the end of the
+// given filename.  Returns Plain if there is no such suffix.
+func CodecByExt(name string) Codec {
+	for _, c := range Codecs {
+		if c.Ext() != "" && len(name) > len(c.Ext()) && name[len(name)-len(c.Ext()):] == c.Ext() {
+			return c
+		}
+	}
+	return Plain
+}
+
+// DetectCodec determines the codec of the data in 'rd', by looking at
+// (without consuming) its first few bytes.
+func DetectCodec(rd *bufio.Reader) (Codec, error) {
+	for _, c := range Codecs {
+		magic := c.Magic()
+		if len(magic) == 0 {
+			continue
+		}
+		buf, err := rd.Peek(len(magic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.Equal(buf, magic) {
+			return c, nil
+		}
+	}
+	return Plain, nil
+}
+
+// NewCodecReader returns a reader that decompresses 'rd', using
+// whichever codec it was written with.
+func NewCodecReader(rd io.Reader) (io.ReadCloser, error) {
+	bufrd := bufio.NewReader(rd)
+	codec, err := DetectCodec(bufrd)
+	if err != nil {
+		return nil, err
+	}
+	return codec.NewReader(bufrd)
+}
+
+// The codec used by the naming convention for new files.
+func namingCodec(nc NamingConvention) Codec {
+	if cn, ok := nc.(CodecNaming); ok {
+		return cn.Codec()
+	}
+	if nc.IsCompressed() {
+		return Gzip
+	}
+	return Plain
+}
+
+// A CodecNaming is a NamingConvention that can specify which codec
+// to use for new files.  Naming conventions that don't implement
+// this use Gzip if they are compressed.
+type CodecNaming interface {
+	NamingConvention
+
+	// The codec to use for files written.
+	Codec() Codec
+}
+
+type plainCodec struct{}
+
+func (plainCodec) Name() string  { return "none" }
+func (plainCodec) Ext() string   { return "" }
+func (plainCodec) Magic() []byte { return nil }
+
+func (plainCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (plainCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string  { return "gzip" }
+func (gzipCodec) Ext() string   { return ".gz" }
+func (gzipCodec) Magic() []byte { return []byte{0x1f, 0x8b} }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string  { return "zstd" }
+func (zstdCodec) Ext() string   { return ".zst" }
+func (zstdCodec) Magic() []byte { return []byte{0x28, 0xb5, 0x2f, 0xfd} }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Name() string  { return "xz" }
+func (xzCodec) Ext() string   { return ".xz" }
+func (xzCodec) Magic() []byte { return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00} }
+
+func (xzCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	// Weave files are compressed in blocks, so there is no
+	// benefit to the default 8MB dictionary.
+	cfg := xz.WriterConfig{
+		DictCap: 1 << 20,
+	}
+	return cfg.NewWriter(w)
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	rd, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(rd), nil
+}
+
+// Recompress copies the weave file named by 'src' to the one named
+// by 'dst', which will normally use a different codec.  The contents
+// are not changed.  The source files are left alone.
+func Recompress(src, dst NamingConvention) error {
+	return copyWeave(src, dst, nil)
+}
+
+// copyWeave copies the weave file named by 'src' to the one named by
+// 'dst', decompressing and recompressing all of it.  If 'update' is
+// not nil, it is called to modify the header before it is written.
+func copyWeave(src, dst NamingConvention, update func(h *Header) error) error {
+	file, rd, err := weaveOpen(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bufrd := bufio.NewReader(rd)
+
+	hdr, err := LoadHeader(bufrd)
+	if err != nil {
+		return err
+	}
+
+	if update != nil {
+		err = update(hdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	wfile, wr, err := weaveCreate(dst, hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(wr, bufrd)
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return err
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return err
+	}
+
+	return installWeave(dst, wfile.Name(), &wr.index)
+}
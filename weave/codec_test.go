@@ -0,0 +1,68 @@
+package weave_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// Each codec should be detected from its output, including when
+// several compressed streams are concatenated, as in a weave file
+// with an index.
+func TestCodecs(t *testing.T) {
+	parts := []string{"\x01t{}\n", "first part\n", "", "second part\n"}
+
+	for _, codec := range weave.Codecs {
+		var buf bytes.Buffer
+		for _, part := range parts {
+			wr, err := codec.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = wr.Write([]byte(part))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = wr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if codec != weave.Plain && !bytes.HasPrefix(buf.Bytes(), codec.Magic()) {
+			t.Fatalf("%s: output doesn't start with magic", codec.Name())
+		}
+
+		rd, err := weave.NewCodecReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		rd.Close()
+
+		expect := ""
+		for _, part := range parts {
+			expect += part
+		}
+		if string(got) != expect {
+			t.Fatalf("%s: got %q, expect %q", codec.Name(), got, expect)
+		}
+
+		byName, err := weave.CodecByName(codec.Name())
+		if err != nil || byName != codec {
+			t.Fatalf("%s: lookup by name failed", codec.Name())
+		}
+		if byExt := weave.CodecByExt("2sure.dat" + codec.Ext()); byExt != codec {
+			t.Fatalf("%s: lookup by extension gave %s", codec.Name(), byExt.Name())
+		}
+	}
+
+	if _, err := weave.CodecByName("bogus"); err == nil {
+		t.Fatal("Expecting error from unknown codec")
+	}
+}
@@ -0,0 +1,567 @@
+package weave
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Encrypted files are stored below the compression, so that the
+// weave is compressed, and the compressed data encrypted.  An
+// encrypted file begins with a header:
+//
+//	magic     8 bytes, "GOSURE\x00E"
+//	kind      1 byte, how the key was derived (see below)
+//	iter      4 bytes, iterations of the KDF
+//	chunk     4 bytes, size of the plaintext chunks
+//	kdf salt  16 bytes, salt for deriving the key from a passphrase
+//	salt      16 bytes, salt for deriving the key for this file
+//
+// followed by the data, divided into chunks of 'chunk' bytes (the
+// last chunk being shorter, possibly empty), each sealed separately
+// with AES-256-GCM, with the header as additional data.  The nonce
+// of each chunk is its number, with a flag marking the last chunk,
+// so that reordered or truncated files are detected.  Since every
+// chunk but the last is the same size, the chunks can be decrypted
+// in any order, which allows the index to still be used.
+//
+// The key for each file is derived, with HKDF, from the salt of the
+// file and a master key.  The master key is either the contents of a
+// key file, or derived from a passphrase with PBKDF2.
+
+var cryptMagic = []byte("GOSURE\x00E")
+
+// The ways the master key can be derived.
+const (
+	kindKeyFile    = 0
+	kindPassphrase = 1
+)
+
+const (
+	cryptHeaderSize = 8 + 1 + 4 + 4 + 16 + 16
+	cryptKeySize    = 32
+	cryptMaxChunk   = 16 << 20
+)
+
+// The default iterations of PBKDF2, and the range of iterations
+// accepted from a file.  A file asking for more would make opening it
+// take arbitrarily long.
+const (
+	kdfDefaultIterations = 600000
+	kdfMinIterations     = 1000
+	kdfMaxIterations     = 10 * kdfDefaultIterations
+)
+
+// Iterations of PBKDF2 used for new files, and the size of the
+// chunks.  These are variables so that the tests can use smaller
+// values, and are recorded in each file.
+var (
+	kdfIterations = kdfDefaultIterations
+	cryptChunk    = 64 << 10
+)
+
+// SetCryptParams changes the KDF iterations and chunk size used for
+// newly encrypted files, returning the previous values.  This is
+// intended for testing.
+func SetCryptParams(iter, chunk int) (int, int) {
+	oldIter, oldChunk := kdfIterations, cryptChunk
+	kdfIterations, cryptChunk = iter, chunk
+	return oldIter, oldChunk
+}
+
+// ErrNoKey is returned when reading an encrypted file without a key.
+var ErrNoKey = errors.New("weave: file is encrypted, and no key was given")
+
+// ErrWrongKey is returned when an encrypted file can't be decrypted,
+// because the key is wrong, or the file has been damaged or altered.
+var ErrWrongKey = errors.New("weave: unable to decrypt, the key is wrong or the file is damaged")
+
+// ErrNotEncrypted is returned when reading a file that isn't
+// encrypted, when a key was given.  Reading it anyway would let
+// someone able to replace the file substitute one of their own, so an
+// existing file has to be encrypted explicitly, with Encrypt.
+var ErrNotEncrypted = errors.New("weave: a key was given, but the file is not encrypted")
+
+// A Key is the secret used to encrypt surefiles.  It is made from
+// either the contents of a key file, or a passphrase.
+type Key struct {
+	secret     []byte
+	passphrase bool
+
+	lock    sync.Mutex
+	masters map[string][]byte // Master keys derived, by KDF salt.
+	salt    []byte            // KDF salt for new files.
+}
+
+// NewKey makes a Key from the contents of a key file, which must be
+// 32 random bytes.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != cryptKeySize {
+		return nil, fmt.Errorf("weave: encryption key must be %d bytes", cryptKeySize)
+	}
+	return &Key{
+		secret: append([]byte{}, secret...),
+	}, nil
+}
+
+// NewPassphraseKey makes a Key from a passphrase.
+func NewPassphraseKey(passphrase string) *Key {
+	return &Key{
+		secret:     []byte(passphrase),
+		passphrase: true,
+	}
+}
+
+// GenerateKeyBytes returns new random contents for a key file.
+func GenerateKeyBytes() ([]byte, error) {
+	secret := make([]byte, cryptKeySize)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// An EncryptingNaming is a NamingConvention whose files are encrypted.
+type EncryptingNaming interface {
+	NamingConvention
+
+	// The key to encrypt new files with, and to decrypt existing
+	// ones, or nil if files are not encrypted.
+	EncryptionKey() *Key
+}
+
+// encryptionKey returns the naming convention's encryption key, if
+// it has one.
+func encryptionKey(nc NamingConvention) *Key {
+	if en, ok := nc.(EncryptingNaming); ok {
+		return en.EncryptionKey()
+	}
+	return nil
+}
+
+// master returns the master key for the given kind and KDF parameters.
+func (k *Key) master(kind byte, iter int, salt []byte) ([]byte, error) {
+	switch {
+	case kind == kindKeyFile && !k.passphrase:
+		return k.secret, nil
+	case kind == kindKeyFile:
+		return nil, errors.New("weave: file is encrypted with a key file, not a passphrase")
+	case kind != kindPassphrase:
+		return nil, fmt.Errorf("weave: unknown encryption key kind %d", kind)
+	case !k.passphrase:
+		return nil, errors.New("weave: file is encrypted with a passphrase, not a key file")
+	}
+
+	// Deriving the key is slow by design, so remember the keys
+	// already derived.
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	id := fmt.Sprintf("%d/%x", iter, salt)
+	if m, ok := k.masters[id]; ok {
+		return m, nil
+	}
+
+	m, err := pbkdf2.Key(sha256.New, string(k.secret), salt, iter, cryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if k.masters == nil {
+		k.masters = make(map[string][]byte)
+	}
+	k.masters[id] = m
+	return m, nil
+}
+
+// newHeader makes the header for a new encrypted file.
+func (k *Key) newHeader() ([]byte, error) {
+	hdr := make([]byte, cryptHeaderSize)
+	copy(hdr, cryptMagic)
+	binary.BigEndian.PutUint32(hdr[9:], uint32(kdfIterations))
+	binary.BigEndian.PutUint32(hdr[13:], uint32(cryptChunk))
+
+	// Files written together share the KDF salt, so that the
+	// passphrase is only run through the KDF once.
+	k.lock.Lock()
+	if k.salt == nil {
+		k.salt = make([]byte, 16)
+		_, err := rand.Read(k.salt)
+		if err != nil {
+			k.lock.Unlock()
+			return nil, err
+		}
+	}
+	copy(hdr[17:], k.salt)
+	k.lock.Unlock()
+
+	if k.passphrase {
+		hdr[8] = kindPassphrase
+	} else {
+		hdr[8] = kindKeyFile
+	}
+
+	_, err := rand.Read(hdr[33:])
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// A cryptFile holds the parameters of a single encrypted file.
+type cryptFile struct {
+	header []byte
+	aead   cipher.AEAD
+	chunk  int
+}
+
+// newCryptFile sets up the cipher for a file with the given header.
+func (k *Key) newCryptFile(hdr []byte) (*cryptFile, error) {
+	kind := hdr[8]
+	iter := int(binary.BigEndian.Uint32(hdr[9:]))
+	chunk := int(binary.BigEndian.Uint32(hdr[13:]))
+	if chunk <= 0 || chunk > cryptMaxChunk {
+		return nil, fmt.Errorf("weave: invalid encryption chunk size %d", chunk)
+	}
+	if kind == kindPassphrase && (iter < kdfMinIterations || iter > kdfMaxIterations) {
+		return nil, fmt.Errorf("weave: invalid key derivation iterations %d", iter)
+	}
+
+	m, err := k.master(kind, iter, hdr[17:33])
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := hkdf.Key(sha256.New, m, hdr[33:cryptHeaderSize], "gosure file", cryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cryptFile{
+		header: hdr,
+		aead:   aead,
+		chunk:  chunk,
+	}, nil
+}
+
+// nonce returns the nonce for the given chunk.
+func (c *cryptFile) nonce(num int64, last bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(num))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// A cryptWriter encrypts the data written to it.  Close must be called
+// to write the last chunk, but does not close the underlying writer.
+type cryptWriter struct {
+	w      io.Writer
+	c      *cryptFile
+	buf    []byte
+	num    int64
+	sealed []byte
+}
+
+// newCryptWriter writes the header for a new encrypted file to 'w',
+// and returns a writer to encrypt the data following it.
+func newCryptWriter(w io.Writer, key *Key) (*cryptWriter, error) {
+	hdr, err := key.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	c, err := key.newCryptFile(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cryptWriter{
+		w:   w,
+		c:   c,
+		buf: make([]byte, 0, c.chunk),
+	}, nil
+}
+
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.c.chunk {
+			err := w.flush(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(w.buf[len(w.buf):w.c.chunk], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// flush encrypts and writes out the buffered chunk.
+func (w *cryptWriter) flush(last bool) error {
+	w.sealed = w.c.aead.Seal(w.sealed[:0], w.c.nonce(w.num, last), w.buf, w.c.header)
+	w.num++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+// Close writes the last chunk.
+func (w *cryptWriter) Close() error {
+	if len(w.buf) == w.c.chunk {
+		err := w.flush(false)
+		if err != nil {
+			return err
+		}
+	}
+	return w.flush(true)
+}
+
+// A cryptReader decrypts an encrypted file, allowing it to be read in
+// any order.  The most recently decrypted chunk is kept, so that
+// small sequential reads don't decrypt each chunk many times.
+type cryptReader struct {
+	file   io.ReaderAt
+	c      *cryptFile
+	size   int64 // The size of the decrypted data.
+	last   int64 // The number of the last chunk.
+	cached int64 // The number of the chunk in 'plain', or -1.
+	plain  []byte
+	sealed []byte
+}
+
+// newCryptReader sets up decryption of an encrypted file, of the
+// given size.
+func newCryptReader(file io.ReaderAt, fileSize int64, key *Key) (*cryptReader, error) {
+	hdr := make([]byte, cryptHeaderSize)
+	_, err := file.ReadAt(hdr, 0)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	if key == nil {
+		return nil, ErrNoKey
+	}
+
+	c, err := key.newCryptFile(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every chunk but the last is full, and the last may be
+	// empty, but is always present.
+	overhead := int64(c.aead.Overhead())
+	full := int64(c.chunk) + overhead
+	body := fileSize - cryptHeaderSize
+	if body < overhead {
+		return nil, ErrWrongKey
+	}
+	last := (body - overhead) / full
+	tail := body - last*full - overhead
+
+	return &cryptReader{
+		file:   file,
+		c:      c,
+		size:   last*int64(c.chunk) + tail,
+		last:   last,
+		cached: -1,
+	}, nil
+}
+
+// load decrypts the given chunk.
+func (r *cryptReader) load(num int64) error {
+	if num == r.cached {
+		return nil
+	}
+
+	overhead := int64(r.c.aead.Overhead())
+	full := int64(r.c.chunk) + overhead
+	size := full
+	if num == r.last {
+		size = r.size - num*int64(r.c.chunk) + overhead
+	}
+
+	if int64(cap(r.sealed)) < size {
+		r.sealed = make([]byte, size)
+	}
+	r.sealed = r.sealed[:size]
+	_, err := r.file.ReadAt(r.sealed, cryptHeaderSize+num*full)
+	if err != nil {
+		return err
+	}
+
+	r.cached = -1
+	r.plain, err = r.c.aead.Open(r.plain[:0], r.c.nonce(num, num == r.last), r.sealed, r.c.header)
+	if err != nil {
+		return ErrWrongKey
+	}
+	r.cached = num
+	return nil
+}
+
+func (r *cryptReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		num := off / int64(r.c.chunk)
+		err := r.load(num)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(p, r.plain[off-num*int64(r.c.chunk):])
+		n += m
+		off += int64(m)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// A rawFile gives access to the data of a file written by the weave
+// package, decrypted if the file is encrypted, but not decompressed.
+type rawFile struct {
+	file *os.File
+	rd   io.ReaderAt
+	size int64 // The size of the (decrypted) data.
+}
+
+// openRaw opens the named file, which was written by createRaw.
+// Whether the file is encrypted is determined from its contents, but
+// if the naming convention has a key, the file must be encrypted.
+func openRaw(nc NamingConvention, name string) (*rawFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	raw := &rawFile{
+		file: file,
+		rd:   file,
+		size: fi.Size(),
+	}
+
+	magic := make([]byte, len(cryptMagic))
+	_, err = file.ReadAt(magic, 0)
+	if err != nil || !bytes.Equal(magic, cryptMagic) {
+		if encryptionKey(nc) != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", name, ErrNotEncrypted)
+		}
+		return raw, nil
+	}
+
+	cr, err := newCryptReader(file, fi.Size(), encryptionKey(nc))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	raw.rd = cr
+	raw.size = cr.size
+	return raw, nil
+}
+
+// Encrypt rewrites a weave file that isn't encrypted, encrypting it
+// with the key of the naming convention.  The unencrypted file is
+// removed, rather than being kept as the backup.  A file that is
+// already encrypted is left alone.
+func Encrypt(nc NamingConvention) error {
+	if encryptionKey(nc) == nil {
+		return errors.New("weave: no key given to encrypt with")
+	}
+
+	file, err := openRaw(plainNaming{nc}, nc.MainFile())
+	if errors.Is(err, ErrNoKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	err = copyWeave(plainNaming{nc}, nc, nil)
+	if err != nil {
+		return err
+	}
+	return os.Remove(nc.BackupFile())
+}
+
+// A plainNaming reads the files of a naming convention as if it had
+// no key.
+type plainNaming struct {
+	NamingConvention
+}
+
+func (f *rawFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.rd.ReadAt(p, off)
+}
+
+// reader returns a reader for all of the data of the file.
+func (f *rawFile) reader() io.Reader {
+	return io.NewSectionReader(f, 0, f.size)
+}
+
+// isEncrypted reports whether the file is encrypted.
+func (f *rawFile) isEncrypted() bool {
+	_, ok := f.rd.(*cryptReader)
+	return ok
+}
+
+func (f *rawFile) Close() error {
+	return f.file.Close()
+}
+
+// createRaw creates a new temp file, returning the file, and a writer
+// for its data, which encrypts it if the naming convention has an
+// encryption key.  The writer must be closed before the file.
+func createRaw(nc NamingConvention, compressed bool) (*os.File, io.WriteCloser, error) {
+	file, err := TempFile(nc, compressed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := encryptionKey(nc)
+	if key == nil {
+		return file, nopWriteCloser{file}, nil
+	}
+
+	wr, err := newCryptWriter(file, key)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, nil, err
+	}
+	return file, wr, nil
+}
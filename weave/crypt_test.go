@@ -0,0 +1,250 @@
+package weave_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestEncrypted(t *testing.T) {
+	defer weave.SetCryptParams(weave.SetCryptParams(1000, 100))
+	defer weave.SetIndexBlockSize(weave.SetIndexBlockSize(64))
+
+	secret, err := weave.GenerateKeyBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := weave.NewKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]*weave.Key{
+		"keyfile":    keyFile,
+		"passphrase": weave.NewPassphraseKey("correct horse battery staple"),
+	}
+	for name, key := range keys {
+		for _, codec := range []weave.Codec{weave.Plain, weave.Gzip} {
+			key, codec := key, codec
+			t.Run(name+"-"+codec.Name(), func(t *testing.T) {
+				testEncrypted(t, key, codec)
+			})
+		}
+	}
+}
+
+func testEncrypted(t *testing.T, key *weave.Key, codec weave.Codec) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	data.NC.Compressed = codec != weave.Plain
+	data.NC.Compression = codec
+	data.NC.EncryptKey = key
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 10; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAll(t, data)
+
+	// Only the final files should be left, and none of them
+	// should have any of the contents in the clear.
+	names, err := filepath.Glob(filepath.Join(tdir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("Expecting 3 files, found %q", names)
+	}
+	for _, name := range []string{data.NC.MainFile(), data.NC.BackupFile()} {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte("initial")) || bytes.Contains(buf, []byte("\n42\n")) {
+			t.Fatalf("%s has plaintext", name)
+		}
+	}
+
+	// Rewriting the header, both with and without the index.
+	err = weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+		h.Deltas[1].Tags["note"] = "a longer value, to move the rest of the file"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+	err = os.Remove(data.NC.IndexFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+
+	_, problems, err := weave.Validate(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Encrypted weave has problems: %v", problems)
+	}
+
+	// Without the key, or with the wrong one, nothing can be read.
+	other := data.NC
+	other.EncryptKey = nil
+	_, err = weave.ReadHeader(&other)
+	if !errors.Is(err, weave.ErrNoKey) {
+		t.Fatalf("Read without key: %v", err)
+	}
+	secret, err := weave.GenerateKeyBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.EncryptKey, err = weave.NewKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = weave.ReadHeader(&other)
+	if err == nil {
+		t.Fatal("Read with wrong key succeeded")
+	}
+	other.EncryptKey = weave.NewPassphraseKey("wrong")
+	_, err = weave.ReadHeader(&other)
+	if err == nil {
+		t.Fatal("Read with wrong passphrase succeeded")
+	}
+
+	// A truncated file is detected.
+	buf, err := ioutil.ReadFile(data.NC.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(data.NC.MainFile(), buf[:len(buf)-1], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.Check(10)
+	if !errors.Is(err, weave.ErrWrongKey) {
+		t.Fatalf("Truncated file not detected: %v", err)
+	}
+}
+
+// A file asking for an unreasonable amount of key derivation is
+// rejected, rather than taking forever to open.
+func TestCryptIterations(t *testing.T) {
+	defer weave.SetCryptParams(weave.SetCryptParams(1000, 100))
+
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	data.NC.EncryptKey = weave.NewPassphraseKey("secret")
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(data.NC.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iter := range [][]byte{{0xff, 0xff, 0xff, 0xff}, {0, 0, 0, 1}} {
+		copy(buf[9:13], iter)
+		err = ioutil.WriteFile(data.NC.MainFile(), buf, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = weave.ReadHeader(&data.NC)
+		if err == nil || !strings.Contains(err.Error(), "iterations") {
+			t.Fatalf("Iterations %x accepted: %v", iter, err)
+		}
+	}
+}
+
+// Files written without a key can still be read with one, and are
+// encrypted when they are next written.
+func TestEncryptExisting(t *testing.T) {
+	defer weave.SetCryptParams(weave.SetCryptParams(1000, 100))
+
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Giving a key doesn't read, or write to, a file that isn't
+	// encrypted, until it has been encrypted.
+	data.NC.EncryptKey = weave.NewPassphraseKey("secret")
+	_, err = weave.ReadHeader(&data.NC)
+	if !errors.Is(err, weave.ErrNotEncrypted) {
+		t.Fatalf("Read unencrypted file with a key: %v", err)
+	}
+	data.Scramble()
+	err = data.SaveDelta()
+	if !errors.Is(err, weave.ErrNotEncrypted) {
+		t.Fatalf("Wrote to unencrypted file with a key: %v", err)
+	}
+
+	err = weave.Encrypt(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(data.NC.BackupFile()); !os.IsNotExist(err) {
+		t.Fatalf("Unencrypted file kept as the backup: %v", err)
+	}
+	checkAll(t, data)
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+
+	// Encrypting it again changes nothing.
+	before, err := ioutil.ReadFile(data.NC.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = weave.Encrypt(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(data.NC.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("Encrypted file was encrypted again")
+	}
+
+	data.NC.EncryptKey = nil
+	_, err = weave.ReadHeader(&data.NC)
+	if !errors.Is(err, weave.ErrNoKey) {
+		t.Fatalf("New delta not encrypted: %v", err)
+	}
+}
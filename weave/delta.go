@@ -2,25 +2,28 @@ package weave
 
 import (
 	"bufio"
-	"compress/gzip"
+	"errors"
 	"fmt"
+	"hash/maphash"
 	"io"
 	"os"
-	"os/exec"
-	"regexp"
-	"strconv"
-	"strings"
-	"syscall"
+	"time"
+
+	"davidb.org/x/gosure/diff"
 )
 
 // A DeltaWriter is used to write a new version to a weave file.
 type DeltaWriter struct {
-	file *os.File
-	wr   *bufio.Writer
-	nc   NamingConvention
-	base int
-	name string
-	tags map[string]string
+	file  *os.File
+	raw   io.WriteCloser // Encrypts the temp file, if needed.
+	wr    *bufio.Writer
+	nc    NamingConvention
+	base  int
+	name  string
+	tags  map[string]string
+	when  time.Time
+	stats map[string]int64
+	hash  *contentHash
 }
 
 // NewDeltaWriter create a new DeltaWriter.  The contents should be
@@ -30,24 +33,34 @@ type DeltaWriter struct {
 // This will typically be the last delta written.  Note that the tags
 // should not be changed until after Close is called.
 func NewDeltaWriter(nc NamingConvention, base int, name string, tags map[string]string) (*DeltaWriter, error) {
-	file, err := TempFile(nc, false)
+	return NewDeltaWriterAt(nc, base, name, tags, time.Now(), nil)
+}
+
+// NewDeltaWriterAt creates a new DeltaWriter, like NewDeltaWriter,
+// but the new delta will record the given time instead of the current
+// time, and the given statistics (which may be nil).
+func NewDeltaWriterAt(nc NamingConvention, base int, name string, tags map[string]string, when time.Time, stats map[string]int64) (*DeltaWriter, error) {
+	file, raw, err := createRaw(nc, false)
 	if err != nil {
 		return nil, err
 	}
 
-	wr := bufio.NewWriter(file)
-
 	return &DeltaWriter{
-		file: file,
-		wr:   wr,
-		nc:   nc,
-		base: base,
-		name: name,
-		tags: tags,
+		file:  file,
+		raw:   raw,
+		wr:    bufio.NewWriter(raw),
+		nc:    nc,
+		base:  base,
+		name:  name,
+		tags:  tags,
+		when:  when,
+		stats: stats,
+		hash:  newContentHash(),
 	}, nil
 }
 
 func (w *DeltaWriter) Write(p []byte) (n int, err error) {
+	w.hash.Write(p)
 	return w.wr.Write(p)
 }
 
@@ -55,120 +68,91 @@ func (w *DeltaWriter) Write(p []byte) (n int, err error) {
 // be generated, so it is important to check the error status from
 // this method.
 func (w *DeltaWriter) Close() error {
+	defer os.Remove(w.file.Name())
+
 	err := w.wr.Flush()
-	if err != nil {
-		return err
+	if err2 := w.raw.Close(); err == nil {
+		err = err2
 	}
-	err = w.file.Close()
-	if err != nil {
-		return err
+	if err2 := w.file.Close(); err == nil {
+		err = err2
 	}
-
-	priorName, err := w.getPrior()
 	if err != nil {
 		return err
 	}
 
-	diffs, err := w.getDiff(priorName, w.file.Name())
+	// The diff is computed on hashes of the lines, rather than
+	// the lines themselves.  applyDiff verifies the text of every
+	// line that the diff considers unchanged.
+	seed := maphash.MakeSeed()
+
+	prior, err := w.priorHashes(seed)
 	if err != nil {
 		return err
 	}
 
-	newName, _, err := w.applyDiff(diffs)
+	latest, err := hashFile(w.nc, w.file.Name(), seed)
 	if err != nil {
 		return err
 	}
-	// fmt.Printf("new delta: %d\n", newDelta)
 
-	os.Rename(w.nc.MainFile(), w.nc.BackupFile())
-	err = os.Rename(newName, w.nc.MainFile())
+	newName, idx, err := w.applyDiff(prior, latest)
 	if err != nil {
 		return err
 	}
 
-	os.Remove(priorName)
-	os.Remove(w.file.Name())
-
-	return nil
+	return installWeave(w.nc, newName, idx)
 }
 
-// getPrior reads the base delta into a new temporary file.  Returns
-// the name of the new temporary file
-func (w *DeltaWriter) getPrior() (string, error) {
-	file, err := TempFile(w.nc, false)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-	wr := bufio.NewWriter(file)
-
-	inpfile, err := os.Open(w.nc.MainFile())
-	if err != nil {
-		return "", err
-	}
-	defer inpfile.Close()
+// priorHashes computes the hashes of each line of the base delta.
+func (w *DeltaWriter) priorHashes(seed maphash.Seed) ([]uint64, error) {
+	var hashes []uint64
 
-	gz, err := gzip.NewReader(inpfile)
-	if err != nil {
-		return "", err
-	}
-
-	err = NewParser(gz, NewWriteDelta(wr), w.base).ParseTo(0)
+	err := ReadDelta(w.nc, w.base, func(text string) error {
+		hashes = append(hashes, maphash.String(seed, text))
+		return nil
+	})
 	if err != io.EOF {
 		if err == nil {
-			panic("Unexpected flow")
+			err = errors.New("weave: parse of prior delta ended early")
 		}
-		return "", err
-	}
-	// fmt.Printf("Flushing writer for %q\n", file.Name())
-	err = wr.Flush()
-	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return file.Name(), nil
+	return hashes, nil
 }
 
-// getDiff Runs diff on the two filenames, returning it as lines.
-// TODO: This should stream the diff result instead of reading it all
-// into memory.
-func (w *DeltaWriter) getDiff(a, b string) ([]string, error) {
-	diffBuf, err := exec.Command("diff", a, b).Output()
+// hashFile computes the hashes of each line of the given temp file.
+func hashFile(nc NamingConvention, name string, seed maphash.Seed) ([]uint64, error) {
+	file, err := openRaw(nc, name)
 	if err != nil {
-		state, ok := err.(*exec.ExitError)
-		if !ok {
-			panic("Guessed wrong type of exit code")
-		}
-		status, ok := state.Sys().(syscall.WaitStatus)
-		if !ok {
-			panic("return code is not helpful")
+		return nil, err
+	}
+	defer file.Close()
+
+	var hashes []uint64
+	rd := newLineReader(file.reader())
+	for {
+		line, err := rd.next()
+		if err == io.EOF {
+			return hashes, nil
 		}
-		switch status {
-		case 0, 256:
-		default:
-			return nil, fmt.Errorf("Unable to run diff: %s", err)
+		if err != nil {
+			return nil, err
 		}
+		hashes = append(hashes, maphash.String(seed, line))
 	}
-	lines := strings.Split(string(diffBuf), "\n")
-	lines = lines[:len(lines)-1]
-
-	return lines, nil
 }
 
-// Regexp for parsing what we care about in diff lines.  There are one
-// or two numbers (comma separated), one of the letters a, c or d, and
-// then stuff describing the destination file, which really doesn't
-// matter to us.  The regexp result [1] is the range start [3] is the
-// optional range end, and [4] is the command.
-var commandRe = regexp.MustCompile(`^(\d+)(,(\d+))?([acd]).*$`)
-
-// applyDelta uses the output of diff to generate a new weave file
-// with the new delta as an additional revision.  Returns the new
-// delta number.
-func (w *DeltaWriter) applyDiff(diff []string) (string, int, error) {
+// applyDiff generates a new weave file, with the contents of the new
+// delta (in the DeltaWriter's temp file) as an additional revision.
+// 'prior' and 'latest' are the line hashes of the base delta and of
+// the new delta.  Returns the name of the new weave file, and its
+// index.
+func (w *DeltaWriter) applyDiff(prior, latest []uint64) (string, *Index, error) {
 	file, rd, err := weaveOpen(w.nc)
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 	defer file.Close()
 
@@ -176,129 +160,198 @@ func (w *DeltaWriter) applyDiff(diff []string) (string, int, error) {
 
 	hdr, err := LoadHeader(bufrd)
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 
-	newDelta := hdr.AddDelta(w.name, w.tags)
+	newDelta := hdr.AddDeltaAt(w.name, w.tags, w.when)
+	err = hdr.SetStats(newDelta, w.stats)
+	if err != nil {
+		return "", nil, err
+	}
+	hdr.seal(newDelta, w.hash.digest(), signingKey(w.nc))
+
+	src, err := openRaw(w.nc, w.file.Name())
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
 
 	wfile, wr, err := weaveCreate(w.nc, hdr)
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
-	defer wfile.Close()
-	defer wr.Close() // Calls flush.
 
-	weaveWr := Writer{wr}
+	ap := &applier{
+		Writer: Writer{wr},
+		src:    newLineReader(src.reader()),
+		delta:  newDelta,
+	}
+	ap.parser = NewParser(bufrd, ap, w.base)
+	ap.parser.fileLine = 1 // The header has already been read.
 
-	parser := NewParser(bufrd, weaveWr, w.base)
+	err = ap.apply(prior, latest)
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return "", nil, err
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return "", nil, err
+	}
 
+	return wfile.Name(), &wr.index, nil
+}
+
+// An applier is a Sink used while applying a diff.  It writes the
+// weave through to the new file, and compares each line that the
+// diff considered common against the text of the new delta.  This
+// guards against the (unlikely) case of two different lines having
+// the same hash.
+type applier struct {
+	Writer
+	parser   *Parser
+	src      *lineReader
+	delta    int  // The number of the new delta.
+	deleting bool // Are lines of the base currently being deleted.
+}
+
+// apply runs the diff, writing the weave with the new delta added.
+func (a *applier) apply(prior, latest []uint64) error {
 	isDone := false
-	isAdding := false
 
 	// Go through the diff, and apply
-	for _, diffLine := range diff {
-		m := commandRe.FindStringSubmatch(diffLine)
-		// fmt.Printf("diff: %q, %#v\n", diffLine, m)
-		if m != nil {
-			if isAdding {
-				err = weaveWr.End(newDelta)
-				if err != nil {
-					return "", 0, err
-				}
-				isAdding = false
+	err := diff.Diff(prior, latest, func(h diff.Hunk) error {
+		if h.AHigh > h.ALow {
+			// These include deletions.  Parser lines are
+			// numbered from 1.
+			err := a.parser.ParseTo(h.ALow + 1)
+			if err != nil {
+				return err
 			}
-
-			left, err := strconv.Atoi(m[1])
+			err = a.Delete(a.delta)
 			if err != nil {
-				panic(err)
+				return err
 			}
-
-			right := left
-			if m[3] != "" {
-				right, err = strconv.Atoi(m[3])
-				if err != nil {
-					panic(err)
-				}
+			a.deleting = true
+			err = a.parser.ParseTo(h.AHigh + 1)
+			if err == io.EOF {
+				isDone = true
+			} else if err != nil {
+				return err
+			}
+			a.deleting = false
+			err = a.End(a.delta)
+			if err != nil {
+				return err
 			}
+		} else {
+			err := a.parser.ParseTo(h.ALow + 1)
+			if err == io.EOF {
+				isDone = true
+			} else if err != nil {
+				return err
+			}
+		}
 
-			cmd := m[4][0]
-			if cmd == 'd' || cmd == 'c' {
-				// These include deletions.
-				err = parser.ParseTo(left)
-				// fmt.Printf("p1: %s\n", err)
-				if err != nil {
-					return "", 0, err
-				}
-				err = weaveWr.Delete(newDelta)
+		if h.BHigh > h.BLow {
+			err := a.Insert(a.delta)
+			if err != nil {
+				return err
+			}
+			for i := h.BLow; i < h.BHigh; i++ {
+				line, err := a.src.next()
 				if err != nil {
-					return "", 0, err
-				}
-				err = parser.ParseTo(right + 1)
-				// fmt.Printf("p2: %s\n", err)
-				if err == io.EOF {
-					isDone = true
-				} else if err != nil {
-					return "", 0, err
+					return a.srcError(err)
 				}
-				err = weaveWr.End(newDelta)
+				// Add lines should just be written as-is.
+				err = a.Writer.Plain(line, true)
 				if err != nil {
-					return "", 0, err
-				}
-			} else {
-				err = parser.ParseTo(right + 1)
-				// fmt.Printf("p3: %s\n", err)
-				if err == io.EOF {
-					isDone = true
-				} else if err != nil {
-					return "", 0, err
+					return err
 				}
 			}
-
-			if cmd == 'c' || cmd == 'a' {
-				err = weaveWr.Insert(newDelta)
-				if err != nil {
-					return "", 0, err
-				}
-				isAdding = true
+			err = a.End(a.delta)
+			if err != nil {
+				return err
 			}
-
-			continue
 		}
 
-		if diffLine[0] == '<' || diffLine[0] == '-' {
-			continue
-		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		if diffLine[0] == '>' {
-			// Add lines should just be written as-is.
-			err = weaveWr.Plain(diffLine[2:], true)
-			if err != nil {
-				return "", 0, err
+	if !isDone {
+		err = a.parser.ParseTo(0)
+		if err != io.EOF {
+			if err == nil {
+				err = errors.New("weave: parse ended before end of file")
 			}
-
-			continue
+			return err
 		}
+	}
 
-		panic(fmt.Sprintf("Unexpected line from diff command: %q", diffLine))
+	// The entire new delta should have been consumed.
+	_, err = a.src.next()
+	if err == nil {
+		return fmt.Errorf("weave: diff did not consume line %d of new delta", a.src.lineNo)
 	}
+	if err != io.EOF {
+		return err
+	}
+
+	return nil
+}
 
-	if isAdding {
-		err = weaveWr.End(newDelta)
+func (a *applier) Plain(text string, keep bool) error {
+	if keep && !a.deleting {
+		line, err := a.src.next()
 		if err != nil {
-			return "", 0, err
+			return a.srcError(err)
+		}
+		if line != text {
+			return fmt.Errorf("weave: line %d of new delta does not match prior delta", a.src.lineNo)
 		}
 	}
+	return a.Writer.Plain(text, keep)
+}
 
-	if !isDone {
-		err = parser.ParseTo(0)
-		// fmt.Printf("p4: %s\n", err)
-		if err == nil {
-			panic("Unexpected non-eof")
-		}
-		if err != io.EOF {
-			return "", 0, err
-		}
+// srcError reports an error reading the new delta.
+func (a *applier) srcError(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("weave: new delta ended early at line %d", a.src.lineNo)
 	}
+	return err
+}
+
+// A lineReader reads lines of text, without their trailing newline.
+// A final line that is missing its newline is still returned as a
+// line.
+type lineReader struct {
+	rd     *bufio.Reader
+	lineNo int
+}
+
+func newLineReader(rd io.Reader) *lineReader {
+	return &lineReader{
+		rd: bufio.NewReader(rd),
+	}
+}
 
-	return wfile.Name(), newDelta, nil
+// next returns the next line, or io.EOF at the end of the input.
+func (r *lineReader) next() (string, error) {
+	line, err := r.rd.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	r.lineNo++
+	if line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
 }
@@ -0,0 +1,87 @@
+package weave
+
+import (
+	"bufio"
+	"io"
+)
+
+// RewriteHeader replaces the header of the weave file with one
+// modified by 'update', leaving the deltas themselves alone.  As with
+// other changes, the new file is written under a temporary name, and
+// renamed into place, with the previous weave file becoming the
+// backup file.
+//
+// When the weave file has a usable index, the header is in a block of
+// its own, and the rest of the file is copied without being
+// decompressed (although it is decrypted and encrypted again, if
+// needed).  Otherwise, the whole weave is copied through.
+func RewriteHeader(nc NamingConvention, update func(h *Header) error) error {
+	if idx := loadIndex(nc); idx != nil && len(idx.Blocks) > 1 && idx.Blocks[1].Line == 2 {
+		file, err := openRaw(nc, nc.MainFile())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// The blocks can only be copied if they are compressed
+		// the same way as new blocks would be.
+		codec, err := DetectCodec(bufio.NewReader(file.reader()))
+		if err != nil {
+			return err
+		}
+		if codec == namingCodec(nc) {
+			return idx.rewriteHeader(nc, file, update)
+		}
+	}
+
+	return copyWeave(nc, nc, update)
+}
+
+// rewriteHeader writes a new weave file, with a new header, followed
+// by a copy of the blocks after the header in 'file'.
+func (idx *Index) rewriteHeader(nc NamingConvention, file *rawFile, update func(h *Header) error) error {
+	rest := idx.Blocks[1].Offset
+
+	rd, err := NewCodecReader(io.NewSectionReader(file, 0, rest))
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	hdr, err := LoadHeader(bufio.NewReader(rd))
+	if err != nil {
+		return err
+	}
+
+	err = update(hdr)
+	if err != nil {
+		return err
+	}
+
+	wfile, wr, err := weaveCreate(nc, hdr)
+	if err != nil {
+		return err
+	}
+
+	// The header block has been finished, so the remaining blocks
+	// can be written directly, moving them to follow the new
+	// header.
+	shift := wr.count.total - rest
+	_, err = io.Copy(&wr.count, io.NewSectionReader(file, rest, file.size-rest))
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return err
+	}
+
+	for _, b := range idx.Blocks[1:] {
+		b.Offset += shift
+		wr.index.Blocks = append(wr.index.Blocks, b)
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return err
+	}
+
+	return installWeave(nc, wfile.Name(), &wr.index)
+}
@@ -0,0 +1,84 @@
+package weave_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestRewriteHeader(t *testing.T) {
+	for _, codec := range []weave.Codec{weave.Plain, weave.Gzip, weave.Zstd} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			testRewriteHeader(t, codec)
+		})
+	}
+}
+
+func testRewriteHeader(t *testing.T, codec weave.Codec) {
+	defer weave.SetIndexBlockSize(weave.SetIndexBlockSize(64))
+
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	data.NC.Compressed = codec != weave.Plain
+	data.NC.Compression = codec
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 5; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := loadIndex(t, &data.NC)
+
+	setTag := func(value string) {
+		err := weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+			h.Deltas[1].Tags["note"] = value
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, err := weave.ReadHeader(&data.NC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Deltas[1].Tags["note"] != value {
+			t.Fatalf("Tag not changed: %v", hdr.Deltas[1].Tags)
+		}
+		if _, err := os.Stat(data.NC.BackupFile()); err != nil {
+			t.Fatal(err)
+		}
+		checkAll(t, data)
+	}
+
+	// With the index, only the header is rewritten, and the rest
+	// of the index is kept.
+	setTag("a much longer value, to move the rest of the file")
+	after := loadIndex(t, &data.NC)
+	if len(after.Blocks) != len(before.Blocks) {
+		t.Fatalf("Index has %d blocks, expect %d", len(after.Blocks), len(before.Blocks))
+	}
+
+	// Without the index, the whole file is copied.
+	err = os.Remove(data.NC.IndexFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTag("short")
+	loadIndex(t, &data.NC)
+}
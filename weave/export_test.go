@@ -0,0 +1,9 @@
+package weave
+
+// SetIndexBlockSize changes the size of the blocks that new weave
+// files are divided into, returning the previous size.
+func SetIndexBlockSize(size int) int {
+	old := indexBlockSize
+	indexBlockSize = size
+	return old
+}
@@ -11,7 +11,11 @@ import (
 
 // A Header is at the beginning of ever weave file.  It describes each
 // of the deltas in the file.  The version describes the version of
-// the header, in this case, 1.
+// the header.  Version 2 adds the statistics to the deltas.  Since
+// this is just an additional field, version 1 headers can still be
+// read, and readers of version 1 will ignore the statistics.  Version
+// 3 adds the digests, chain values and signatures of the deltas (see
+// chain.go), which are likewise ignored by older readers.
 type Header struct {
 	Version int      `json:"version"`
 	Deltas  []*Delta `json:"deltas"`
@@ -25,12 +29,21 @@ type Delta struct {
 	Number int               `json:"number"`
 	Tags   map[string]string `json:"tags"`
 	Time   time.Time         `json:"time"`
+	Stats  map[string]int64  `json:"stats,omitempty"`
+
+	Digest    string `json:"digest,omitempty"`    // SHA-256 of the contents.
+	Chain     string `json:"chain,omitempty"`     // Links to the previous delta.
+	Signature string `json:"signature,omitempty"` // Ed25519 signature of Chain.
 }
 
+// HeaderVersion is the current version of the header.  Headers with a
+// newer version than this are rejected.
+const HeaderVersion = 3
+
 // NewHeader creates a blank header describing zero deltas.
 func NewHeader() Header {
 	return Header{
-		Version: 1,
+		Version: HeaderVersion,
 	}
 }
 
@@ -38,6 +51,12 @@ func NewHeader() Header {
 // The tags will be copied, the Time filled in, and the number
 // returned.
 func (h *Header) AddDelta(name string, tags map[string]string) int {
+	return h.AddDeltaAt(name, tags, time.Now())
+}
+
+// AddDeltaAt adds a new delta to this header, like AddDelta, but
+// records the given time instead of the current time.
+func (h *Header) AddDeltaAt(name string, tags map[string]string, when time.Time) int {
 	newTags := make(map[string]string)
 
 	for k, v := range tags {
@@ -48,13 +67,39 @@ func (h *Header) AddDelta(name string, tags map[string]string) int {
 		Name:   name,
 		Number: len(h.Deltas) + 1,
 		Tags:   newTags,
-		Time:   time.Now().UTC().Round(0),
+		Time:   when.UTC().Round(0),
 	}
 	h.Deltas = append(h.Deltas, &delta)
 
 	return delta.Number
 }
 
+// SetStats records statistics about the contents of a delta, such
+// as counts of the files, or how it differs from the previous delta.
+// The statistics are copied.  Older headers are upgraded to the
+// current version, since this is the version that adds the
+// statistics.
+func (h *Header) SetStats(num int, stats map[string]int64) error {
+	for _, d := range h.Deltas {
+		if d.Number != num {
+			continue
+		}
+
+		d.Stats = nil
+		if len(stats) > 0 {
+			d.Stats = make(map[string]int64)
+			for k, v := range stats {
+				d.Stats[k] = v
+			}
+		}
+		if h.Version < HeaderVersion {
+			h.Version = HeaderVersion
+		}
+		return nil
+	}
+	return fmt.Errorf("weave: delta %d not present", num)
+}
+
 // Save writes the header to the stream in the format used in the
 // weave files.
 func (h *Header) Save(w io.Writer) error {
@@ -124,5 +169,9 @@ func LoadHeader(r BytesReader) (*Header, error) {
 		return nil, err
 	}
 
+	if header.Version > HeaderVersion {
+		return nil, fmt.Errorf("weave: unsupported header version %d", header.Version)
+	}
+
 	return &header, nil
 }
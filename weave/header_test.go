@@ -53,3 +53,38 @@ func TestHeader(t *testing.T) {
 		t.Fatalf("Header did not read back correctly")
 	}
 }
+
+// Version 1 headers, without statistics, can still be read, and are
+// upgraded when statistics are added.  Newer versions are rejected.
+func TestHeaderVersion(t *testing.T) {
+	src := "\x01t{\"version\":1,\"deltas\":[{\"name\":\"a\",\"number\":1}]}\n"
+	hdr, err := weave.LoadHeader(bytes.NewBufferString(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != 1 || hdr.Deltas[0].Stats != nil {
+		t.Fatalf("Unexpected header: %+v", hdr)
+	}
+
+	num := hdr.AddDelta("b", nil)
+	stats := map[string]int64{"files": 5}
+	err = hdr.SetStats(num, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats["files"] = 6
+	if hdr.Version != weave.HeaderVersion || hdr.Deltas[1].Stats["files"] != 5 {
+		t.Fatalf("Stats not recorded: %+v", hdr)
+	}
+
+	err = hdr.SetStats(3, stats)
+	if err == nil {
+		t.Fatal("Stats set for missing delta")
+	}
+
+	src = fmt.Sprintf("\x01t{\"version\":%d,\"deltas\":[]}\n", weave.HeaderVersion+1)
+	_, err = weave.LoadHeader(bytes.NewBufferString(src))
+	if err == nil {
+		t.Fatal("Newer header version was accepted")
+	}
+}
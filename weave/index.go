@@ -0,0 +1,459 @@
+package weave
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// An IndexNaming is a NamingConvention that also names an index file
+// to be kept alongside the weave file.  The index records restart
+// points within the weave, so that a single delta can be read without
+// decompressing and parsing the entire file.  The index is optional.
+// If the naming convention doesn't provide one, or the index is
+// missing or out of date, the weave is just read from the beginning.
+type IndexNaming interface {
+	NamingConvention
+
+	// Return the pathname of the index file.
+	IndexFile() string
+}
+
+// The weave is divided into blocks of roughly this many bytes of
+// uncompressed data.  This is a variable so that the tests can use
+// smaller blocks.
+var indexBlockSize = 1 << 20
+
+// The current version of the index file.
+const indexVersion = 1
+
+// An Index describes the blocks of a weave file.  Each block begins
+// at the start of a line, and in a compressed weave, is compressed
+// separately (as a gzip member, or a zstd frame, or an xz stream), so
+// reading can start at the beginning of any block.
+// The header line is always in a block by itself.
+type Index struct {
+	Version int          `json:"version"`
+	Size    int64        `json:"size"`    // The size of the weave file, as stored.
+	ModTime time.Time    `json:"modtime"` // The modification time of the weave file.
+	Blocks  []IndexBlock `json:"blocks"`
+}
+
+// An IndexBlock describes a single block of the weave file.
+type IndexBlock struct {
+	Offset  int64  `json:"offset"`  // Byte offset of the block in the (decrypted) weave file.
+	Line    int    `json:"line"`    // Line number of the first line of the block.
+	Inserts []int  `json:"inserts"` // Inserts open at the start of the block.
+	Deletes []int  `json:"deletes"` // Deletes open at the start of the block.
+	Visible []Span `json:"visible"` // The deltas that lines in the block are visible in.
+}
+
+// A Span is a range of deltas, from Low, up to but not including
+// High.  A High of zero means the range has no upper limit.
+type Span struct {
+	Low  int `json:"low"`
+	High int `json:"high"`
+}
+
+// contains returns whether the given delta is within the span.
+func (s Span) contains(delta int) bool {
+	return delta >= s.Low && (s.High == 0 || delta < s.High)
+}
+
+// visibleIn returns whether any line of the block is visible in the
+// given delta.
+func (b *IndexBlock) visibleIn(delta int) bool {
+	for _, s := range b.Visible {
+		if s.contains(delta) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSpans sorts the spans, and combines any that overlap or are
+// adjacent.  The result reuses the storage of the argument.
+func mergeSpans(spans []Span) []Span {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Low < spans[j].Low
+	})
+
+	result := spans[:0]
+	for _, s := range spans {
+		if n := len(result); n > 0 {
+			last := &result[n-1]
+			if last.High == 0 || s.Low <= last.High {
+				if last.High != 0 && (s.High == 0 || s.High > last.High) {
+					last.High = s.High
+				}
+				continue
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// An indexWriter writes the data of a weave file, dividing it into
+// blocks, and building the index for them as it goes.
+type indexWriter struct {
+	raw       io.WriteCloser // The file, encrypted if needed.
+	buf       *bufio.Writer
+	count     countWriter    // Counts the bytes written to 'buf'.
+	codec     Codec          // How each block is compressed.
+	out       io.WriteCloser // The compressor for the current block.
+	index     Index          // The index being built.
+	state     lineState      // The markers open at this point.
+	spans     []Span         // Visibility of the lines of the current block.
+	spanLimit int            // Merge the spans when there are this many.
+	size      int            // The bytes written to the current block.
+	line      int            // The number of complete lines written.
+	started   bool           // Has the current block been started.
+	midLine   bool           // Has a partial line been written.
+	isControl bool           // Is the current line a control line.
+	control   []byte         // The current line, if it is a control line.
+}
+
+func newIndexWriter(raw io.WriteCloser, codec Codec) *indexWriter {
+	w := &indexWriter{
+		raw:       raw,
+		buf:       bufio.NewWriter(raw),
+		codec:     codec,
+		spanLimit: 1024,
+		index: Index{
+			Version: indexVersion,
+		},
+	}
+	w.count.w = w.buf
+	return w
+}
+
+// A countWriter counts the bytes written through it.
+type countWriter struct {
+	w     io.Writer
+	total int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.total += int64(n)
+	return n, err
+}
+
+func (w *indexWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if !w.started {
+			err := w.startBlock()
+			if err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		end := bytes.IndexByte(p, '\n')
+		if end >= 0 {
+			chunk = p[:end+1]
+		}
+
+		m, err := w.out.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		w.size += len(chunk)
+		p = p[len(chunk):]
+
+		if !w.midLine {
+			w.isControl = chunk[0] == '\x01'
+		}
+		if w.isControl {
+			w.control = append(w.control, chunk...)
+		}
+
+		if end < 0 {
+			w.midLine = true
+			continue
+		}
+		w.midLine = false
+
+		err = w.endLine()
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// endLine is called after each complete line is written.
+func (w *indexWriter) endLine() error {
+	w.line++
+
+	if w.isControl {
+		err := w.controlLine(w.control[:len(w.control)-1])
+		w.control = w.control[:0]
+		if err != nil {
+			return err
+		}
+	} else {
+		w.plainLine()
+	}
+
+	// The header is kept in a block of its own.
+	if w.line == 1 || w.size >= indexBlockSize {
+		return w.endBlock()
+	}
+	return nil
+}
+
+// controlLine tracks the markers, in the same manner as the Parser.
+func (w *indexWriter) controlLine(line []byte) error {
+	if len(line) < 4 {
+		return nil
+	}
+	if line[1] != 'I' && line[1] != 'D' && line[1] != 'E' {
+		return nil
+	}
+
+	delta, err := strconv.Atoi(string(line[3:]))
+	if err != nil {
+		return fmt.Errorf("weave: invalid delta number in control line %q", line)
+	}
+
+	switch line[1] {
+	case 'I':
+		return w.state.Insert(delta)
+	case 'D':
+		return w.state.Delete(delta)
+	default:
+		return w.state.End(delta)
+	}
+}
+
+// plainLine records the deltas that a line of text is visible in.
+func (w *indexWriter) plainLine() {
+	ins, del := w.state.span()
+	if ins == 0 {
+		return
+	}
+
+	if n := len(w.spans); n > 0 && w.spans[n-1] == (Span{ins, del}) {
+		return
+	}
+	w.spans = append(w.spans, Span{ins, del})
+
+	// Keep a large block with many changes from using too much
+	// memory.
+	if len(w.spans) >= w.spanLimit {
+		w.spans = mergeSpans(w.spans)
+		if len(w.spans) > w.spanLimit/2 {
+			w.spanLimit *= 2
+		}
+	}
+}
+
+// startBlock begins a new block at the current position.
+func (w *indexWriter) startBlock() error {
+	w.index.Blocks = append(w.index.Blocks, IndexBlock{
+		Offset:  w.count.total,
+		Line:    w.line + 1,
+		Inserts: append([]int{}, w.state.inserts...),
+		Deletes: append([]int{}, w.state.deletes...),
+	})
+
+	out, err := w.codec.NewWriter(&w.count)
+	if err != nil {
+		return err
+	}
+	w.out = out
+
+	w.size = 0
+	w.started = true
+	return nil
+}
+
+// endBlock finishes the current block.  The next block is not started
+// until there is more data for it.
+func (w *indexWriter) endBlock() error {
+	if !w.started {
+		return nil
+	}
+
+	block := &w.index.Blocks[len(w.index.Blocks)-1]
+	block.Visible = append([]Span{}, mergeSpans(w.spans)...)
+	w.spans = w.spans[:0]
+
+	w.started = false
+	return w.out.Close()
+}
+
+// Close finishes the last block, and flushes the data to the file,
+// finishing the encryption.  It does not close the underlying file.
+func (w *indexWriter) Close() error {
+	err := w.endBlock()
+	if err2 := w.buf.Flush(); err == nil {
+		err = err2
+	}
+	if err2 := w.raw.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// saveIndex writes the index for a newly installed weave file.
+func saveIndex(nc NamingConvention, idx *Index) error {
+	inc, ok := nc.(IndexNaming)
+	if !ok || idx == nil {
+		return nil
+	}
+
+	fi, err := os.Stat(nc.MainFile())
+	if err != nil {
+		return err
+	}
+	idx.Size = fi.Size()
+	idx.ModTime = fi.ModTime()
+
+	file, err := TempFile(nc, false)
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(file)
+	err = json.NewEncoder(wr).Encode(idx)
+	if err == nil {
+		err = wr.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), inc.IndexFile())
+}
+
+// removeIndex removes the index file, if there is one.
+func removeIndex(nc NamingConvention) {
+	if inc, ok := nc.(IndexNaming); ok {
+		os.Remove(inc.IndexFile())
+	}
+}
+
+// loadIndex reads the index for the weave file.  Returns nil if there
+// is no usable index, either because the naming convention doesn't
+// have one, or it is missing, unreadable, or doesn't describe the
+// current weave file.
+func loadIndex(nc NamingConvention) *Index {
+	inc, ok := nc.(IndexNaming)
+	if !ok {
+		return nil
+	}
+
+	file, err := os.Open(inc.IndexFile())
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var idx Index
+	err = json.NewDecoder(bufio.NewReader(file)).Decode(&idx)
+	if err != nil || idx.Version != indexVersion || len(idx.Blocks) == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(nc.MainFile())
+	if err != nil || fi.Size() != idx.Size || !fi.ModTime().Equal(idx.ModTime) {
+		return nil
+	}
+
+	return &idx
+}
+
+// readDelta reads the given delta from the weave file, only reading
+// the blocks that have lines visible in that delta.  The sink will
+// be given every line of the delta, but not the markers or lines of
+// the blocks that are skipped.  Like ParseTo, returns io.EOF at the
+// end of the data.
+func (idx *Index) readDelta(nc NamingConvention, delta int, sink Sink) error {
+	file, err := openRaw(nc, nc.MainFile())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	blocks := idx.Blocks
+	for i := 0; i < len(blocks); {
+		if !blocks[i].visibleIn(delta) {
+			i++
+			continue
+		}
+
+		// Read this block, along with any following blocks
+		// that are also needed, in one run.
+		j := i + 1
+		for j < len(blocks) && blocks[j].visibleIn(delta) {
+			j++
+		}
+		end := file.size
+		if j < len(blocks) {
+			end = blocks[j].Offset
+		}
+
+		err = readBlocks(file, &blocks[i], end, delta, sink)
+		if err != nil {
+			return err
+		}
+
+		i = j
+	}
+
+	return io.EOF
+}
+
+// readBlocks parses the part of the weave file from the start of the
+// given block, up to the offset 'end'.
+func readBlocks(file io.ReaderAt, block *IndexBlock, end int64, delta int, sink Sink) error {
+	rd, err := NewCodecReader(io.NewSectionReader(file, block.Offset, end-block.Offset))
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	parser := NewParser(rd, sink, delta)
+	parser.resume(block)
+
+	err = parser.ParseTo(0)
+	if err == nil {
+		err = errors.New("weave: parse ended before end of block")
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// resume sets up the parser to start reading at the beginning of the
+// given block, rather than at the beginning of the weave.
+func (p *Parser) resume(block *IndexBlock) {
+	p.fileLine = block.Line - 1
+	for _, delta := range block.Inserts {
+		p.push(delta, p.insertMode(delta))
+	}
+	for _, delta := range block.Deletes {
+		p.push(delta, p.deleteMode(delta))
+	}
+	p.updateKeep()
+}
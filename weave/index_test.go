@@ -0,0 +1,144 @@
+package weave_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestIndex(t *testing.T) {
+	for _, codec := range weave.Codecs {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			testIndex(t, codec)
+		})
+	}
+}
+
+func testIndex(t *testing.T, codec weave.Codec) {
+	// Starting an xz stream is slow, so use fewer blocks.
+	size := 64
+	if codec == weave.Xz {
+		size = 512
+	}
+	defer weave.SetIndexBlockSize(weave.SetIndexBlockSize(size))
+
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 200)
+	data.NC.Compressed = codec != weave.Plain
+	data.NC.Compression = codec
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i <= 30; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx := loadIndex(t, &data.NC)
+	if len(idx.Blocks) < 10 {
+		t.Fatalf("Expecting many blocks, got %d", len(idx.Blocks))
+	}
+
+	// With this much change, some blocks should have nothing in
+	// the latest delta.
+	skipped := 0
+	for _, b := range idx.Blocks[1:] {
+		live := false
+		for _, s := range b.Visible {
+			if s.High == 0 {
+				live = true
+			}
+		}
+		if !live {
+			skipped++
+		}
+	}
+	if skipped == 0 {
+		t.Fatal("Expecting some blocks to not be in the latest delta")
+	}
+
+	checkAll(t, data)
+
+	// Reading should still work (without the index) if the index
+	// doesn't match the weave file.
+	stale, err := ioutil.ReadFile(data.NC.IndexFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Scramble()
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(data.NC.IndexFile(), stale, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+
+	// And if it is missing.
+	err = os.Remove(data.NC.IndexFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+
+	// Removing deltas should write a new index.
+	err = weave.RemoveDeltas(&data.NC, []int{3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Renumber([]int{3, 4, 5})
+	loadIndex(t, &data.NC)
+	checkAll(t, data)
+}
+
+func loadIndex(t *testing.T, nc *weave.SimpleNaming) *weave.Index {
+	buf, err := ioutil.ReadFile(nc.IndexFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idx weave.Index
+	err = json.Unmarshal(buf, &idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(nc.MainFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != idx.Size {
+		t.Fatalf("Index size %d, file is %d", idx.Size, fi.Size())
+	}
+	if len(idx.Blocks) < 2 || idx.Blocks[0].Offset != 0 || idx.Blocks[1].Line != 2 {
+		t.Fatalf("Header should be in a block by itself: %+v", idx.Blocks)
+	}
+
+	return &idx
+}
+
+func checkAll(t *testing.T, data *DataSet) {
+	for delta := range data.Deltas {
+		err := data.Check(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -2,48 +2,39 @@ package weave
 
 import (
 	"bufio"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
-// closeWrite wraps bufio.Writer and adds a Close method so that it
-// can also be a io.WriteCloser and be used in place of a gzip.Writer,
-// which requires Close to be called for the gzipped file to be valid.
-type closeWrite struct {
-	*bufio.Writer
-}
-
-func (cl closeWrite) Close() error {
-	return cl.Flush()
-}
-
 // NewWeaveWriter implements io.Writer (buffered) to write to a new
 // weave file.  The client should call the Close method to finalize
-// writing.
+// writing.  Since the header records the digest of the contents, the
+// contents are written to a plain temp file, and the weave file is
+// only written by Close.
 type NewWeaveWriter struct {
-	file  *os.File       // The temp file where the data is written.
-	w     io.WriteCloser // Writer, buffered possibly with compression.
-	nc    NamingConvention
-	delta int
+	file *os.File       // The temp file where the data is written.
+	raw  io.WriteCloser // Encrypts the temp file, if needed.
+	w    *bufio.Writer  // Buffered writer for the temp file.
+	hash *contentHash
+	nc   NamingConvention
+	head Header
 }
 
 // weaveCreate opens a new weave file for writing, writing the given
-// header to the file, and returning the file, and a bufferfed writer
-// (possibly with compression).
-func weaveCreate(nc NamingConvention, head *Header) (*os.File, io.WriteCloser, error) {
-	file, err := TempFile(nc, nc.IsCompressed())
+// header to the file, and returning the file, and a buffered writer
+// (possibly with compression).  The writer builds the index for the
+// file as it is written, and encrypts it if the naming convention
+// has an encryption key.
+func weaveCreate(nc NamingConvention, head *Header) (*os.File, *indexWriter, error) {
+	codec := namingCodec(nc)
+	file, raw, err := createRaw(nc, codec != Plain)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var wr io.WriteCloser
-	if nc.IsCompressed() {
-		wr = gzip.NewWriter(file)
-	} else {
-		wr = closeWrite{bufio.NewWriter(file)}
-	}
+	wr := newIndexWriter(raw, codec)
 
 	err = head.Save(wr)
 	if err != nil {
@@ -55,59 +46,171 @@ func weaveCreate(nc NamingConvention, head *Header) (*os.File, io.WriteCloser, e
 	return file, wr, err
 }
 
+// finishWeave flushes and closes a weave file written with
+// weaveCreate, making sure it is on disk before it is renamed into
+// place.  On failure, the file is removed.
+func finishWeave(file *os.File, wr io.WriteCloser) error {
+	err := wr.Close()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// abandonWeave closes and removes a partially written weave file.
+func abandonWeave(file *os.File, wr io.WriteCloser) {
+	wr.Close()
+	file.Close()
+	os.Remove(file.Name())
+}
+
 // NewNewWeave creates a new weave file.  The file will be named based on
 // the given naming convention.  The 'name' will be used for the
 // initial delta, and the tags will be recorded in that delta.  Close
 // must be called to finialize the weaving.  Note that the underlying
 // writer is buffered.
 func NewNewWeave(nc NamingConvention, name string, tags map[string]string) (*NewWeaveWriter, error) {
-	head := NewHeader()
-	delta := head.AddDelta(name, tags)
+	return NewNewWeaveAt(nc, name, tags, time.Now(), nil)
+}
 
-	file, wr, err := weaveCreate(nc, &head)
+// NewNewWeaveAt creates a new weave file, like NewNewWeave, but the
+// initial delta will record the given time instead of the current
+// time, and the given statistics (which may be nil).
+func NewNewWeaveAt(nc NamingConvention, name string, tags map[string]string, when time.Time, stats map[string]int64) (*NewWeaveWriter, error) {
+	head := NewHeader()
+	delta := head.AddDeltaAt(name, tags, when)
+	err := head.SetStats(delta, stats)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = fmt.Fprintf(wr, "\x01I %d\n", delta)
+	file, raw, err := createRaw(nc, false)
 	if err != nil {
-		file.Close()
-		os.Remove(file.Name())
 		return nil, err
 	}
 
 	return &NewWeaveWriter{
-		file:  file,
-		w:     wr,
-		nc:    nc,
-		delta: delta,
+		file: file,
+		raw:  raw,
+		w:    bufio.NewWriter(raw),
+		hash: newContentHash(),
+		nc:   nc,
+		head: head,
 	}, nil
 }
 
-// writeWeave opens a temp weave file for writing,
-
 func (w *NewWeaveWriter) Write(p []byte) (n int, err error) {
+	w.hash.Write(p)
 	return w.w.Write(p)
 }
 
-// Close closes the NewWeaveWriter, renaming the new file to the
-// finalized name.
+// Close closes the NewWeaveWriter, writing the weave file, and
+// renaming it to the finalized name.
 func (w *NewWeaveWriter) Close() error {
-	_, err := fmt.Fprintf(w, "\x01E %d\n", w.delta)
+	defer os.Remove(w.file.Name())
+
+	err := w.w.Flush()
+	if err2 := w.raw.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := openRaw(w.nc, w.file.Name())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// A last line without a newline still needs one before the
+	// end marker.
+	complete := w.hash.complete()
+	delta := w.head.LatestDelta()
+	w.head.seal(delta, w.hash.digest(), signingKey(w.nc))
+
+	wfile, wr, err := weaveCreate(w.nc, &w.head)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(wr, "\x01I %d\n", delta)
+	if err == nil {
+		_, err = io.Copy(wr, src.reader())
+	}
+	if err == nil && !complete {
+		_, err = wr.Write([]byte("\n"))
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(wr, "\x01E %d\n", delta)
+	}
 	if err != nil {
+		abandonWeave(wfile, wr)
 		return err
 	}
 
-	err = w.w.Close()
+	err = finishWeave(wfile, wr)
 	if err != nil {
 		return err
 	}
 
-	err = w.file.Close()
+	return installWeave(w.nc, wfile.Name(), &wr.index)
+}
+
+// installWeave moves a newly written weave file into place as the
+// main file, keeping the previous main file as the backup.  The index
+// is then written for the new file.  The index is only an
+// optimization, so failure to write it is not an error; readers will
+// just read the whole weave file.
+//
+// The backup is made as a link to the main file, so that the main
+// file is replaced in a single rename, and is never missing if the
+// process is interrupted.  Only if the filesystem doesn't support
+// links is the main file renamed to the backup, leaving a moment
+// where only the backup exists (see Recover).
+func installWeave(nc NamingConvention, name string, idx *Index) error {
+	// Make sure an old index is never used with the new file.
+	removeIndex(nc)
+
+	err := os.Remove(nc.BackupFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Link(nc.MainFile(), nc.BackupFile())
+	if err != nil && !os.IsNotExist(err) {
+		err = os.Rename(nc.MainFile(), nc.BackupFile())
+		if err != nil {
+			return err
+		}
+	}
+
+	// A backup written before the naming convention asked for
+	// tighter permissions is no more readable than the new file.
+	if _, ok := nc.(ModeNaming); ok {
+		err = os.Chmod(nc.BackupFile(), fileMode(nc))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = os.Rename(name, nc.MainFile())
+	if err != nil {
+		return err
+	}
+	err = syncDir(nc.MainFile())
 	if err != nil {
 		return err
 	}
 
-	os.Rename(w.nc.MainFile(), w.nc.BackupFile())
-	return os.Rename(w.file.Name(), w.nc.MainFile())
+	saveIndex(nc, idx)
+	return nil
 }
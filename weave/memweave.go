@@ -0,0 +1,238 @@
+package weave
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"time"
+
+	"davidb.org/x/gosure/diff"
+)
+
+// A MemWeave is a weave held in memory, as the lines of the weave,
+// each with the range of deltas it is visible in.  Any of its deltas
+// can be read, and new deltas added, without going through a file
+// each time, and the whole weave is then written in a single pass.
+// It takes about as much memory as the uncompressed weave file, which
+// is far less than the text of all of the deltas.
+type MemWeave struct {
+	Header Header
+
+	lines *list.List // Of *memLine, in the order of the weave.
+
+	// The lines of the latest delta, and their hashes, which the
+	// next delta added is diffed against.
+	latest []*list.Element
+	hashes []uint64
+	seed   maphash.Seed
+}
+
+// A memLine is a line of a MemWeave, visible in the deltas [ins, del).
+// A 'del' of zero means it is visible in the latest delta.
+type memLine struct {
+	text     string
+	ins, del int
+}
+
+func (l *memLine) visible(delta int) bool {
+	return l.ins <= delta && (l.del == 0 || delta < l.del)
+}
+
+// NewMemWeave returns a MemWeave with no deltas.
+func NewMemWeave() *MemWeave {
+	return &MemWeave{
+		Header: NewHeader(),
+		lines:  list.New(),
+		seed:   maphash.MakeSeed(),
+	}
+}
+
+// LoadMemWeave reads the weave file described by the naming convention
+// into memory, in a single pass.  The contents of the deltas are
+// checked against their digests, as ReadDeltas does.
+func LoadMemWeave(nc NamingConvention) (*MemWeave, error) {
+	hdr, err := ReadHeader(nc)
+	if err != nil {
+		return nil, err
+	}
+	wanted, err := hdr.selectDeltas(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := NewMemWeave()
+	w.Header = *hdr
+
+	check := newDigestCheck(nc, hdr, wanted)
+	sink := &multiSink{
+		deltas: wanted,
+		line: func(delta int, text string) error {
+			check.add(delta, text)
+			return nil
+		},
+		spans: func(text string, ins, del int) {
+			w.lines.PushBack(&memLine{text: text, ins: ins, del: del})
+		},
+	}
+	err = ReadGeneral(nc, 0, sink)
+	if err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("weave: %s: parse ended before end of file", nc.MainFile())
+		}
+		return nil, err
+	}
+	err = check.verify()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Delta returns the lines of the given delta, without their newlines.
+func (w *MemWeave) Delta(delta int) ([]string, error) {
+	if _, err := w.Header.selectDeltas([]int{delta}); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for e := w.lines.Front(); e != nil; e = e.Next() {
+		if l := e.Value.(*memLine); l.visible(delta) {
+			lines = append(lines, l.text)
+		}
+	}
+	return lines, nil
+}
+
+// AddDelta adds a new delta, with the given lines (without their
+// newlines) as its contents, and returns its number.  The delta has
+// the given name, tags, time and statistics, as with NewDeltaWriterAt.
+// The lines are diffed against the previous latest delta, so only the
+// lines that change are added to the weave.
+func (w *MemWeave) AddDelta(name string, tags map[string]string, when time.Time, stats map[string]int64, lines []string) (int, error) {
+	if w.latest == nil && len(w.Header.Deltas) > 0 {
+		w.loadLatest()
+	}
+
+	hashes := make([]uint64, len(lines))
+	digest := sha256.New()
+	for i, text := range lines {
+		hashes[i] = maphash.String(w.seed, text)
+		io.WriteString(digest, text)
+		digest.Write([]byte{'\n'})
+	}
+
+	// The diff is checked against the text of every line it
+	// considers unchanged before anything is modified, so that a
+	// failed add leaves the weave as it was.
+	var hunks []diff.Hunk
+	err := diff.Diff(w.hashes, hashes, func(h diff.Hunk) error {
+		hunks = append(hunks, h)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	pos, line := 0, 0
+	same := func(end int) error {
+		for ; pos < end; pos, line = pos+1, line+1 {
+			if w.latest[pos].Value.(*memLine).text != lines[line] {
+				return fmt.Errorf("weave: line %d of new delta does not match prior delta", line+1)
+			}
+		}
+		return nil
+	}
+	for _, h := range hunks {
+		if err := same(h.ALow); err != nil {
+			return 0, err
+		}
+		pos, line = h.AHigh, h.BHigh
+	}
+	if err := same(len(w.latest)); err != nil {
+		return 0, err
+	}
+
+	num := w.Header.AddDeltaAt(name, tags, when)
+	err = w.Header.SetStats(num, stats)
+	if err != nil {
+		return 0, err
+	}
+	w.Header.Deltas[len(w.Header.Deltas)-1].Digest = hex.EncodeToString(digest.Sum(nil))
+
+	// New lines go just before the line of the previous delta that
+	// follows them, or at the end of the weave, which is where
+	// DeltaWriter would have put them.
+	latest := make([]*list.Element, 0, len(lines))
+	pos = 0
+	for _, h := range hunks {
+		latest = append(latest, w.latest[pos:h.ALow]...)
+		for pos = h.ALow; pos < h.AHigh; pos++ {
+			w.latest[pos].Value.(*memLine).del = num
+		}
+		for i := h.BLow; i < h.BHigh; i++ {
+			l := &memLine{text: lines[i], ins: num}
+			if pos < len(w.latest) {
+				latest = append(latest, w.lines.InsertBefore(l, w.latest[pos]))
+			} else {
+				latest = append(latest, w.lines.PushBack(l))
+			}
+		}
+	}
+	latest = append(latest, w.latest[pos:]...)
+
+	w.latest = latest
+	w.hashes = hashes
+	return num, nil
+}
+
+// loadLatest finds the lines of the latest delta of a weave that was
+// loaded, so that a new delta can be diffed against it.
+func (w *MemWeave) loadLatest() {
+	latest := w.Header.LatestDelta()
+	w.latest = []*list.Element{}
+	w.hashes = nil
+	for e := w.lines.Front(); e != nil; e = e.Next() {
+		if l := e.Value.(*memLine); l.visible(latest) {
+			w.latest = append(w.latest, e)
+			w.hashes = append(w.hashes, maphash.String(w.seed, l.text))
+		}
+	}
+}
+
+// Save writes the weave to the file described by the naming
+// convention, in a single pass, replacing any file already there.  As
+// with other writes, an existing file becomes the backup.  The deltas
+// are chained, and signed if the naming convention has a signing key.
+func (w *MemWeave) Save(nc NamingConvention) error {
+	w.Header.rechain(signingKey(nc))
+
+	wfile, wr, err := weaveCreate(nc, &w.Header)
+	if err != nil {
+		return err
+	}
+
+	sw := &spanWriter{Writer: Writer{wr}}
+	for e := w.lines.Front(); e != nil; e = e.Next() {
+		l := e.Value.(*memLine)
+		err = sw.line(l.text, l.ins, l.del)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = sw.closeMarkers()
+	}
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return err
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return err
+	}
+
+	return installWeave(nc, wfile.Name(), &wr.index)
+}
@@ -0,0 +1,104 @@
+package weave_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestMemWeave(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	w := weave.NewMemWeave()
+	add := func(w *weave.MemWeave) {
+		num, err := w.AddDelta(data.Name, data.Tags, when, nil, data.lines())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Deltas[num] = append([]int(nil), data.Data...)
+		when = when.Add(time.Hour)
+		data.Scramble()
+	}
+	for i := 1; i <= 20; i++ {
+		add(w)
+	}
+
+	err = w.Save(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMem(t, data)
+
+	// Read it back, and add to it both in memory and with a
+	// DeltaWriter.
+	w, err = weave.LoadMemWeave(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, nums := range data.Deltas {
+		lines, err := w.Delta(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, data.linesOf(nums)) {
+			t.Fatalf("Delta %d of loaded weave doesn't match", num)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		add(w)
+	}
+	err = w.Save(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMem(t, data)
+
+	_, err = w.Delta(len(data.Deltas) + 1)
+	if err == nil {
+		t.Fatal("Reading a missing delta should fail")
+	}
+}
+
+// lines returns the current data as lines of text.
+func (d *DataSet) lines() []string {
+	return d.linesOf(d.Data)
+}
+
+func (d *DataSet) linesOf(nums []int) []string {
+	lines := []string{}
+	for _, num := range nums {
+		lines = append(lines, strconv.Itoa(num))
+	}
+	return lines
+}
+
+// checkMem checks every delta, and that the chain of the weave file
+// is intact.
+func checkMem(t *testing.T, data *DataSet) {
+	checkAll(t, data)
+
+	_, problems, err := weave.VerifyChain(&data.NC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Weave has problems: %v", problems)
+	}
+}
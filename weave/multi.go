@@ -0,0 +1,121 @@
+package weave
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ReadDeltas reads the contents of several deltas from the weave file
+// in a single pass.  'deltas' lists the delta numbers to read, or if
+// it is empty, every delta in the file is read.  The 'line' function
+// is called for each line of each delta, along with the number of the
+// delta it belongs to.  The lines of the deltas are interleaved, but
+// the lines of each delta are given in order.  If 'line' returns a
+// non-nil error, it is returned from ReadDeltas.  Unlike ReadDelta,
+// returns nil when the whole file has been read.  As with ReadDelta,
+// the contents of the deltas are checked against their digests, once
+// the whole file has been read.
+func ReadDeltas(nc NamingConvention, deltas []int, line func(delta int, text string) error) error {
+	hdr, err := ReadHeader(nc)
+	if err != nil {
+		return err
+	}
+
+	wanted, err := hdr.selectDeltas(deltas)
+	if err != nil {
+		return err
+	}
+
+	check := newDigestCheck(nc, hdr, wanted)
+	err = readDeltas(nc, wanted, func(delta int, text string) error {
+		check.add(delta, text)
+		return line(delta, text)
+	})
+	if err != nil {
+		return err
+	}
+	return check.verify()
+}
+
+// readDeltas reads the given deltas, which must be sorted, and in the
+// header, without checking their digests.
+func readDeltas(nc NamingConvention, wanted []int, line func(delta int, text string) error) error {
+	sink := &multiSink{
+		deltas: wanted,
+		line:   line,
+	}
+
+	err := ReadGeneral(nc, 0, sink)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// selectDeltas returns the given delta numbers sorted, and without
+// duplicates, or all of the deltas in the header if the list is
+// empty.  Returns an error if any of the deltas are not in the
+// header.
+func (h *Header) selectDeltas(deltas []int) ([]int, error) {
+	present := make(map[int]bool)
+	for _, d := range h.Deltas {
+		present[d.Number] = true
+	}
+
+	var result []int
+	if len(deltas) == 0 {
+		for _, d := range h.Deltas {
+			result = append(result, d.Number)
+		}
+	} else {
+		seen := make(map[int]bool)
+		for _, num := range deltas {
+			if !present[num] {
+				return nil, fmt.Errorf("weave: delta %d not present", num)
+			}
+			if !seen[num] {
+				seen[num] = true
+				result = append(result, num)
+			}
+		}
+	}
+
+	sort.Ints(result)
+	return result, nil
+}
+
+// A multiSink is a Sink that gives each line to every one of a set
+// of deltas that it is visible in.
+type multiSink struct {
+	lineState
+	deltas []int // The deltas wanted, sorted.
+	line   func(delta int, text string) error
+
+	// If not nil, spans is also given each visible line once,
+	// along with the range of deltas [ins, del) it is visible in.
+	spans func(text string, ins, del int)
+}
+
+func (m *multiSink) Plain(text string, keep bool) error {
+	ins, del := m.span()
+	if ins == 0 {
+		return nil
+	}
+	if m.spans != nil {
+		m.spans(text, ins, del)
+	}
+
+	for pos := sort.SearchInts(m.deltas, ins); pos < len(m.deltas); pos++ {
+		delta := m.deltas[pos]
+		if del != 0 && delta >= del {
+			break
+		}
+		err := m.line(delta, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package weave_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestReadDeltas(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i <= 20; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An empty delta.
+	data.Data = []int{}
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readDeltas(t, &data.NC, nil)
+	if len(got) != len(data.Deltas)-1 {
+		t.Fatalf("Read %d deltas, expect %d", len(got), len(data.Deltas)-1)
+	}
+	for delta, expect := range data.Deltas {
+		if len(expect) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got[delta], expect) {
+			t.Fatalf("Delta %d mismatch:\ngot: %v\nexpect: %v", delta, got[delta], expect)
+		}
+	}
+
+	got = readDeltas(t, &data.NC, []int{7, 3, 7, 15})
+	if len(got) != 3 {
+		t.Fatalf("Read %d deltas, expect 3", len(got))
+	}
+	for _, delta := range []int{3, 7, 15} {
+		if !reflect.DeepEqual(got[delta], data.Deltas[delta]) {
+			t.Fatalf("Delta %d mismatch:\ngot: %v\nexpect: %v", delta, got[delta], data.Deltas[delta])
+		}
+	}
+
+	err = weave.ReadDeltas(&data.NC, []int{1, 50}, func(delta int, text string) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Should not be able to read missing delta")
+	}
+}
+
+func readDeltas(t *testing.T, nc weave.NamingConvention, deltas []int) map[int][]int {
+	result := make(map[int][]int)
+	err := weave.ReadDeltas(nc, deltas, func(delta int, text string) error {
+		num, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		result[delta] = append(result[delta], num)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
@@ -1,6 +1,7 @@
 package weave
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"strconv"
@@ -27,28 +28,63 @@ type NamingConvention interface {
 	IsCompressed() bool
 }
 
+// A ModeNaming is a NamingConvention that gives the permissions to
+// create its files with, such as for files that shouldn't be readable
+// by everyone.  Files are otherwise created with mode 0644.
+type ModeNaming interface {
+	NamingConvention
+
+	// The permissions for new files, before the umask.
+	FileMode() os.FileMode
+}
+
+// fileMode returns the permissions to create the naming convention's
+// files with.
+func fileMode(nc NamingConvention) os.FileMode {
+	if mn, ok := nc.(ModeNaming); ok {
+		return mn.FileMode()
+	}
+	return 0644
+}
+
 // The SimpleNaming is a NamingConvention that has a basename, with
 // the main file having a specified extension, the backup file having
 // a ".bak" extension, and the temp files using a numbered extension
-// starting with ".0".  If the names are intended to be compressed, a
-// ".gz" suffix can also be added.
+// starting with ".0".  If the names are intended to be compressed, the
+// suffix of the codec (normally ".gz") is also added.
 type SimpleNaming struct {
-	Path       string // The directory for the files to be written.
-	Base       string // The base of the filename.
-	Ext        string // The extension to use for the main name.
-	Compressed bool   // Are these names to indicate compression.
+	Path        string // The directory for the files to be written.
+	Base        string // The base of the filename.
+	Ext         string // The extension to use for the main name.
+	Compressed  bool   // Are these names to indicate compression.
+	Compression Codec  // The codec to use when compressed, nil for Gzip.
+
+	SignKey    ed25519.PrivateKey // Key to sign new deltas, or nil.
+	EncryptKey *Key               // Key to encrypt the files, or nil.
 }
 
 // MakeName constructs a name with a given extention and possibility
 // of being compressed.
 func (sn *SimpleNaming) MakeName(ext string, compressed bool) string {
 	gz := ""
-	if sn.Compressed && compressed {
-		gz = ".gz"
+	if compressed {
+		gz = sn.Codec().Ext()
 	}
 	return fmt.Sprintf("%s/%s.%s%s", sn.Path, sn.Base, ext, gz)
 }
 
+// Codec returns the codec used to compress files with this naming.
+func (sn *SimpleNaming) Codec() Codec {
+	switch {
+	case !sn.Compressed:
+		return Plain
+	case sn.Compression == nil:
+		return Gzip
+	default:
+		return sn.Compression
+	}
+}
+
 // MainFile returns the name of the primary file for this naming.
 func (sn *SimpleNaming) MainFile() string {
 	return sn.MakeName(sn.Ext, true)
@@ -59,6 +95,21 @@ func (sn *SimpleNaming) BackupFile() string {
 	return sn.MakeName("bak", true)
 }
 
+// SigningKey returns the key used to sign new deltas.
+func (sn *SimpleNaming) SigningKey() ed25519.PrivateKey {
+	return sn.SignKey
+}
+
+// EncryptionKey returns the key used to encrypt the files.
+func (sn *SimpleNaming) EncryptionKey() *Key {
+	return sn.EncryptKey
+}
+
+// IndexFile returns the name of the index file for this naming.
+func (sn *SimpleNaming) IndexFile() string {
+	return sn.MakeName("idx", false)
+}
+
 // TempFile returns the name of a temp file, containing a given
 // sequence number, and with the desired compression.
 func (sn *SimpleNaming) TempFile(num int, compressed bool) string {
@@ -71,7 +122,7 @@ func TempFile(nc NamingConvention, compressed bool) (file *os.File, err error) {
 	for {
 		name := nc.TempFile(n, compressed)
 
-		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode(nc))
 		if err == nil {
 			return file, nil
 		}
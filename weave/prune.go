@@ -0,0 +1,313 @@
+package weave
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// RemoveDeltas rewrites the weave file, removing the given deltas
+// from it.  The contents of the remaining deltas are unchanged, but
+// the deltas are renumbered so that they are again sequential,
+// starting with 1.  The previous weave file becomes the backup file.
+// Removing deltas changes the chain values of those that follow, so
+// they are signed again if the naming convention has a signing key,
+// and otherwise lose their signatures.
+func RemoveDeltas(nc NamingConvention, remove []int) error {
+	return RemoveDeltasEdit(nc, remove, nil)
+}
+
+// RemoveDeltasEdit removes deltas as RemoveDeltas does, but also calls
+// 'update', if not nil, to modify the new header, with the remaining
+// deltas renumbered, before it is written.
+func RemoveDeltasEdit(nc NamingConvention, remove []int, update func(h *Header) error) error {
+	return RemoveDeltasRewrite(nc, remove, update, nil)
+}
+
+// RemoveDeltasRewrite removes deltas as RemoveDeltasEdit does, and
+// also replaces the text of each line that remains with the result of
+// 'rewrite', if not nil.  The same line can be visible in several
+// deltas, so it is changed in all of them.  The digests of the
+// deltas whose contents change must be set by 'update'.
+func RemoveDeltasRewrite(nc NamingConvention, remove []int, update func(h *Header) error, rewrite func(text string) (string, error)) error {
+	file, rd, err := weaveOpen(nc)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bufrd := bufio.NewReader(rd)
+
+	hdr, err := LoadHeader(bufrd)
+	if err != nil {
+		return err
+	}
+
+	newHdr, kept, err := hdr.without(remove)
+	if err != nil {
+		return err
+	}
+	if update != nil {
+		err = update(newHdr)
+		if err != nil {
+			return err
+		}
+	}
+	newHdr.rechain(signingKey(nc))
+
+	wfile, wr, err := weaveCreate(nc, newHdr)
+	if err != nil {
+		return err
+	}
+
+	pr := &pruner{
+		spanWriter: spanWriter{Writer: Writer{wr}},
+		kept:       kept,
+		rewrite:    rewrite,
+	}
+
+	parser := NewParser(bufrd, pr, 0)
+	parser.fileLine = 1 // The header has already been read.
+	err = parser.ParseTo(0)
+	if err == io.EOF {
+		err = pr.finish()
+	} else if err == nil {
+		err = errors.New("weave: parse ended before end of file")
+	}
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return err
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return err
+	}
+
+	return installWeave(nc, wfile.Name(), &wr.index)
+}
+
+// without returns a copy of the header with the given deltas removed,
+// and the remaining deltas renumbered.  Also returns the original
+// numbers of the remaining deltas, in increasing order.
+func (h *Header) without(remove []int) (*Header, []int, error) {
+	gone := make(map[int]bool)
+	for _, num := range remove {
+		gone[num] = true
+	}
+
+	present := make(map[int]bool)
+	var kept []*Delta
+	for _, d := range h.Deltas {
+		present[d.Number] = true
+		if !gone[d.Number] {
+			kept = append(kept, d)
+		}
+	}
+
+	for _, num := range remove {
+		if !present[num] {
+			return nil, nil, fmt.Errorf("weave: delta %d not present", num)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, nil, errors.New("weave: cannot remove every delta")
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Number < kept[j].Number
+	})
+
+	newHdr := &Header{
+		Version: h.Version,
+	}
+	var numbers []int
+	for i, d := range kept {
+		numbers = append(numbers, d.Number)
+
+		nd := *d
+		nd.Number = i + 1
+		newHdr.Deltas = append(newHdr.Deltas, &nd)
+	}
+
+	return newHdr, numbers, nil
+}
+
+// A lineState tracks the insert and delete markers that are open at a
+// given point in a weave.  Within a linear history, every plain line
+// is visible in a contiguous range of deltas, which can be computed
+// from these markers.
+type lineState struct {
+	inserts []int
+	deletes []int
+}
+
+func (s *lineState) Insert(delta int) error {
+	s.inserts = append(s.inserts, delta)
+	return nil
+}
+
+func (s *lineState) Delete(delta int) error {
+	s.deletes = append(s.deletes, delta)
+	return nil
+}
+
+func (s *lineState) End(delta int) error {
+	var ok bool
+	if s.deletes, ok = removeDelta(s.deletes, delta); ok {
+		return nil
+	}
+	if s.inserts, ok = removeDelta(s.inserts, delta); ok {
+		return nil
+	}
+	return fmt.Errorf("weave: end of delta %d that is not open", delta)
+}
+
+// span returns the range of deltas [ins, del) that the current line
+// is visible in.  A 'del' of zero means the line has not been
+// deleted, and an 'ins' of zero means the line is not visible in any
+// delta.
+func (s *lineState) span() (ins, del int) {
+	for _, d := range s.inserts {
+		if d > ins {
+			ins = d
+		}
+	}
+
+	// Deletes by the inserting delta, or older ones, do not apply
+	// to this line.
+	for _, d := range s.deletes {
+		if d > ins && (del == 0 || d < del) {
+			del = d
+		}
+	}
+
+	return
+}
+
+// removeDelta removes the most recently pushed occurrence of 'delta'
+// from the list.  Returns false if it was not present.
+func removeDelta(list []int, delta int) ([]int, bool) {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] == delta {
+			return append(list[:i], list[i+1:]...), true
+		}
+	}
+	return list, false
+}
+
+// A pruner is a Sink that rewrites a weave, leaving out some of the
+// deltas.  Rather than trying to adjust the existing markers, it
+// computes the range of remaining deltas each line is visible in, and
+// generates new markers for it.
+type pruner struct {
+	spanWriter
+	state   lineState
+	kept    []int // The original numbers of the kept deltas, sorted.
+	rewrite func(text string) (string, error)
+}
+
+func (p *pruner) Insert(delta int) error { return p.state.Insert(delta) }
+func (p *pruner) Delete(delta int) error { return p.state.Delete(delta) }
+func (p *pruner) End(delta int) error    { return p.state.End(delta) }
+
+func (p *pruner) Plain(text string, keep bool) error {
+	ins, del := p.state.span()
+	if ins == 0 {
+		// Not visible in any delta.
+		return nil
+	}
+
+	ins = p.renumber(ins)
+	if del != 0 {
+		del = p.renumber(del)
+	}
+	if ins == 0 || ins == del {
+		// Only visible in deltas that have been removed.
+		return nil
+	}
+
+	if p.rewrite != nil {
+		var err error
+		text, err = p.rewrite(text)
+		if err != nil {
+			return err
+		}
+	}
+	return p.line(text, ins, del)
+}
+
+// renumber returns the new number of the oldest remaining delta that
+// is not older than the given one.  Returns zero if there is none.
+func (p *pruner) renumber(delta int) int {
+	pos := sort.SearchInts(p.kept, delta)
+	if pos == len(p.kept) {
+		return 0
+	}
+	return pos + 1
+}
+
+// finish is called at the end of the input.
+func (p *pruner) finish() error {
+	if len(p.state.inserts) != 0 || len(p.state.deletes) != 0 {
+		return errors.New("weave: unterminated delta at end of file")
+	}
+	return p.closeMarkers()
+}
+
+// A spanWriter writes the lines of a weave given the range of deltas
+// [ins, del) each one is visible in, generating the markers for them.
+type spanWriter struct {
+	Writer
+	curIns, curDel int // The markers currently open in the output.
+}
+
+// line writes a line visible in deltas [ins, del).  A 'del' of zero
+// means the line is still visible in the latest delta.
+func (w *spanWriter) line(text string, ins, del int) error {
+	if ins != w.curIns {
+		if err := w.closeMarkers(); err != nil {
+			return err
+		}
+		if err := w.Writer.Insert(ins); err != nil {
+			return err
+		}
+		w.curIns = ins
+	}
+
+	if del != w.curDel {
+		if w.curDel != 0 {
+			if err := w.Writer.End(w.curDel); err != nil {
+				return err
+			}
+		}
+		if del != 0 {
+			if err := w.Writer.Delete(del); err != nil {
+				return err
+			}
+		}
+		w.curDel = del
+	}
+
+	return w.Writer.Plain(text, true)
+}
+
+// closeMarkers closes any markers that are open in the output.
+func (w *spanWriter) closeMarkers() error {
+	if w.curDel != 0 {
+		if err := w.Writer.End(w.curDel); err != nil {
+			return err
+		}
+		w.curDel = 0
+	}
+	if w.curIns != 0 {
+		if err := w.Writer.End(w.curIns); err != nil {
+			return err
+		}
+		w.curIns = 0
+	}
+	return nil
+}
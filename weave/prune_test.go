@@ -0,0 +1,167 @@
+package weave_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestRemoveDeltas(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i <= 30; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Remove a few, including the first, and some adjacent ones.
+	remove := []int{1, 4, 5, 6, 12, 20, 29}
+	err = weave.RemoveDeltas(&data.NC, remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Renumber(remove)
+
+	for delta := range data.Deltas {
+		err = data.Check(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make sure we can still add to the pruned file.
+	data.Scramble()
+	err = data.SaveDelta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then remove randomly, until only one is left.
+	for len(data.Deltas) > 1 {
+		remove = []int{rand.Intn(len(data.Deltas)) + 1}
+		err = weave.RemoveDeltas(&data.NC, remove)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Renumber(remove)
+
+		for delta := range data.Deltas {
+			err = data.Check(delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = weave.RemoveDeltas(&data.NC, []int{1})
+	if err == nil {
+		t.Fatal("Should not be able to remove every delta")
+	}
+}
+
+// Rewriting the lines while removing deltas changes them in every
+// delta they are visible in.
+func TestRemoveDeltasRewrite(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i <= 10; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remove := []int{2, 5, 6}
+	data.Renumber(remove)
+	for _, nums := range data.Deltas {
+		for i := range nums {
+			nums[i] *= 2
+		}
+	}
+
+	err = weave.RemoveDeltasRewrite(&data.NC, remove, func(h *weave.Header) error {
+		for _, d := range h.Deltas {
+			hash := sha256.New()
+			for _, num := range data.Deltas[d.Number] {
+				fmt.Fprintf(hash, "%d\n", num)
+			}
+			d.Digest = hex.EncodeToString(hash.Sum(nil))
+		}
+		return nil
+	}, func(text string) (string, error) {
+		num, err := strconv.Atoi(text)
+		return strconv.Itoa(num * 2), err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for delta := range data.Deltas {
+		err = data.Check(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, problems, err := weave.VerifyChain(&data.NC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Rewritten weave has problems: %v", problems)
+	}
+}
+
+// Renumber adjusts the DataSet to match a weave that has had the
+// given deltas removed.
+func (d *DataSet) Renumber(remove []int) {
+	for _, num := range remove {
+		delete(d.Deltas, num)
+	}
+
+	var nums []int
+	for num := range d.Deltas {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	deltas := make(map[int][]int)
+	for i, num := range nums {
+		deltas[i+1] = d.Deltas[num]
+	}
+	d.Deltas = deltas
+}
@@ -2,30 +2,38 @@ package weave
 
 import (
 	"bufio"
-	"compress/gzip"
 	"io"
-	"os"
 )
 
 // weaveOpen opens a weave file for reading, based on a given naming
-// convention.  On success, returns the opened File, a reader on that
-// file (which will either be the same file, or a gzip.Reader), and
-// nil.  Otherwise, an error is returned
-func weaveOpen(nc NamingConvention) (*os.File, io.Reader, error) {
-	file, err := os.Open(nc.MainFile())
+// convention.  The compression and encryption of the file are
+// determined from its contents.  On success, returns a Closer that
+// will close the file, a reader of the decompressed contents of the
+// file, and nil.  Otherwise, an error is returned.
+func weaveOpen(nc NamingConvention) (io.Closer, io.Reader, error) {
+	file, err := openRaw(nc, nc.MainFile())
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if nc.IsCompressed() {
-		gz, err := gzip.NewReader(file)
-		if err != nil {
-			file.Close()
-			return nil, nil, err
-		}
-		return file, gz, nil
+	rd, err := NewCodecReader(file.reader())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
 	}
-	return file, file, nil
+
+	return &weaveFile{file: file, rd: rd}, rd, nil
+}
+
+// A weaveFile closes both the decompressor and the file under it.
+type weaveFile struct {
+	file *rawFile
+	rd   io.ReadCloser
+}
+
+func (w *weaveFile) Close() error {
+	w.rd.Close()
+	return w.file.Close()
 }
 
 // ReadHeader reads the header from the weave file described by the
@@ -46,9 +54,36 @@ func ReadHeader(nc NamingConvention) (*Header, error) {
 // The 'line' function will be called on each line of text from the
 // delta.  If 'line' returns a non-nil error, it will be propagated up
 // through the call to ReadDelta, otherwise, ReadDelta will return any
-// error encountered in reading.
+// error encountered in reading.  When the whole delta has been read,
+// its contents are checked against the digest in the header, and a
+// *DigestError is returned if they don't match.  Since the lines have
+// already been given to 'line', callers must not use what they have
+// read if this happens.
 func ReadDelta(nc NamingConvention, delta int, line func(text string) error) error {
-	return ReadGeneral(nc, delta, deltaSink(line))
+	hdr, err := ReadHeader(nc)
+	if err != nil {
+		return err
+	}
+
+	check := newDigestCheck(nc, hdr, []int{delta})
+	sink := deltaSink(func(text string) error {
+		check.add(delta, text)
+		return line(text)
+	})
+
+	// With an index, only the parts of the file containing this
+	// delta need to be read.
+	if idx := loadIndex(nc); idx != nil {
+		err = idx.readDelta(nc, delta, sink)
+	} else {
+		err = ReadGeneral(nc, delta, sink)
+	}
+	if err == io.EOF {
+		if err2 := check.verify(); err2 != nil {
+			return err2
+		}
+	}
+	return err
 }
 
 // ReadGeneral reads a delta using the specified Sink.
@@ -0,0 +1,120 @@
+package weave
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// A Repair describes a problem left behind by a write that was
+// interrupted, as found by Recover.
+type Repair struct {
+	Name    string // The file with the problem.
+	Problem string // What is wrong with it.
+	Action  string // What is done about it, in the passive voice.
+	Done    bool   // Whether the action was taken.
+}
+
+func (r Repair) String() string {
+	if r.Done {
+		return fmt.Sprintf("%s: %s, %s", r.Name, r.Problem, r.Action)
+	}
+	return fmt.Sprintf("%s: %s, would be %s", r.Name, r.Problem, r.Action)
+}
+
+// How many unused temp file numbers in a row Recover looks past
+// before deciding there are no more temp files.
+const tempSlack = 10
+
+// Recover looks for the remains of writes to the weave file that were
+// interrupted, such as by the process being killed.  If the main file
+// is missing, but the backup is present, the backup is restored as
+// the main file.  Temp files are removed.  This must only be called
+// while nothing else is writing the weave file, as its temp files
+// would be removed.  If 'repair' is false, the problems are only
+// reported.
+func Recover(nc NamingConvention, repair bool) ([]Repair, error) {
+	var repairs []Repair
+
+	_, err := os.Stat(nc.MainFile())
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(nc.BackupFile()); err == nil {
+			r := Repair{
+				Name:    nc.MainFile(),
+				Problem: "missing",
+				Action:  "restored from " + nc.BackupFile(),
+			}
+			if repair {
+				err = os.Rename(nc.BackupFile(), nc.MainFile())
+				if err != nil {
+					return repairs, err
+				}
+				syncDir(nc.MainFile())
+				r.Done = true
+			}
+			repairs = append(repairs, r)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	misses := 0
+	seen := make(map[string]bool)
+	for n := 0; misses < tempSlack; n++ {
+		found := false
+		for _, compressed := range []bool{false, true} {
+			name := nc.TempFile(n, compressed)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if _, err := os.Lstat(name); err != nil {
+				continue
+			}
+			found = true
+
+			r := Repair{
+				Name:    name,
+				Problem: "stale temporary file",
+				Action:  "removed",
+			}
+			if repair {
+				err := os.Remove(name)
+				if err != nil {
+					return repairs, err
+				}
+				r.Done = true
+			}
+			repairs = append(repairs, r)
+		}
+		if found {
+			misses = 0
+		} else {
+			misses++
+		}
+	}
+
+	return repairs, nil
+}
+
+// syncDir flushes the directory holding the named file to disk, so
+// that a file renamed into it will still be there after a crash.
+// Filesystems that can't sync directories are ignored.
+func syncDir(name string) error {
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if errors.Is(err, syscall.EINVAL) {
+		err = nil
+	}
+	if err2 := dir.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
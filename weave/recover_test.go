@@ -0,0 +1,82 @@
+package weave_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestRecover(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 3; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The backup is a copy of the previous surefile.
+	if _, err := os.Stat(data.NC.BackupFile()); err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err := weave.Recover(&data.NC, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 0 {
+		t.Fatalf("Clean weave has repairs: %v", repairs)
+	}
+
+	// Interrupt a write just after the main file has been moved to
+	// the backup, leaving some temp files around.
+	err = os.Rename(data.NC.MainFile(), data.NC.BackupFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	temps := []string{data.NC.TempFile(0, true), data.NC.TempFile(1, false), data.NC.TempFile(4, true)}
+	for _, name := range temps {
+		err = ioutil.WriteFile(name, []byte("partial"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repairs, err = weave.Recover(&data.NC, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 4 || repairs[0].Name != data.NC.MainFile() || repairs[0].Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+	if _, err := os.Stat(data.NC.MainFile()); !os.IsNotExist(err) {
+		t.Fatal("Dry run restored the main file")
+	}
+
+	repairs, err = weave.Recover(&data.NC, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 4 || !repairs[3].Done {
+		t.Fatalf("Unexpected repairs: %v", repairs)
+	}
+	for _, name := range temps {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("Temp file %q not removed", name)
+		}
+	}
+	checkAll(t, data)
+}
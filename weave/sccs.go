@@ -0,0 +1,584 @@
+package weave
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCCS s-files store their deltas in the same weave format as weave
+// files, with the serial numbers of the SCCS deltas used in the
+// markers.  Only the header differs.  An s-file begins with a
+// checksum line, followed by a table of the deltas (newest first),
+// then a list of users, flags, and some descriptive text, before the
+// body.  Only linear histories can be represented by weave files, so
+// the deltas of an s-file being imported must be numbered
+// sequentially, each based on the previous one.
+//
+// The name, tags and statistics of each delta are kept in the SCCS
+// comments of the delta.  The first comment line is the name of the
+// delta, and the others are of the form "tag key=value" or "stat
+// key=value".  Since SCCS dates are only to the second, the exact
+// time is kept in a "time" comment, and the digest, chain value and
+// signature (see chain.go) in "digest", "chain" and "signature"
+// comments.  When importing an s-file not written by gosure, the
+// first comment line is used as the name, and any other comment lines
+// are kept in the "comment" tag.
+
+// The user recorded in s-file deltas, unless the delta has a "user"
+// tag.
+const sccsUser = "gosure"
+
+// The format of dates in s-files.  SCCS records local time, but
+// gosure always writes UTC.
+const sccsTime = "06/01/02 15:04:05"
+
+// sccsMaxCount is the largest line count that can be recorded in the
+// delta table.  Larger counts are recorded as this value.
+const sccsMaxCount = 99999
+
+var sccsDeltaRe = regexp.MustCompile(`^\x01d ([A-Z]) ([\d.]+) (\d+/\d+/\d+) (\d+:\d+:\d+) (\S+) (\d+) (\d+)$`)
+
+// ExportSCCS writes the weave file as an SCCS s-file.  The body of the
+// weave is copied directly, but the header is replaced with an SCCS
+// header describing the same deltas.
+func ExportSCCS(nc NamingConvention, w io.Writer) error {
+	// The checksum at the start of the s-file covers the whole
+	// body, so the weave is read twice.  The first pass computes
+	// the checksum, and the counts of lines in each delta.
+	hdr, counts, sum, err := scanSCCS(nc)
+	if err != nil {
+		return err
+	}
+
+	var head bytes.Buffer
+	err = writeSCCSHeader(&head, hdr, counts)
+	if err != nil {
+		return err
+	}
+	for _, b := range head.Bytes() {
+		sum += uint32(b)
+	}
+
+	_, err = fmt.Fprintf(w, "\x01h%05d\n", sum&0xffff)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(head.Bytes())
+	if err != nil {
+		return err
+	}
+
+	file, rd, err := weaveOpen(nc)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bufrd := bufio.NewReader(rd)
+	_, err = LoadHeader(bufrd)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, bufrd)
+	return err
+}
+
+// sccsCounts holds the counts of lines inserted, deleted, and
+// unchanged by each delta, indexed by delta number.
+type sccsCounts struct {
+	lineState
+	inserted  []int
+	deleted   []int
+	unchanged []int // Differences, summed by finish.
+}
+
+func (c *sccsCounts) Plain(text string, keep bool) error {
+	ins, del := c.span()
+	if ins == 0 {
+		return nil
+	}
+	if ins >= len(c.inserted) || del >= len(c.inserted) {
+		return fmt.Errorf("weave: delta %d not in header", ins)
+	}
+
+	c.inserted[ins]++
+	end := len(c.inserted)
+	if del != 0 {
+		c.deleted[del]++
+		end = del
+	}
+
+	// The line is unchanged in every delta after the one that
+	// inserted it, until it is deleted.
+	c.unchanged[ins+1]++
+	c.unchanged[end]--
+	return nil
+}
+
+// finish computes the unchanged counts from the differences.
+func (c *sccsCounts) finish() {
+	total := 0
+	for i := range c.unchanged {
+		total += c.unchanged[i]
+		c.unchanged[i] = total
+	}
+}
+
+// scanSCCS reads the weave file, returning its header, the line
+// counts of each delta, and the sum of the bytes of the body.
+func scanSCCS(nc NamingConvention) (*Header, *sccsCounts, uint32, error) {
+	file, rd, err := weaveOpen(nc)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+
+	bufrd := bufio.NewReader(rd)
+	hdr, err := LoadHeader(bufrd)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for i, d := range hdr.Deltas {
+		if d.Number != i+1 {
+			return nil, nil, 0, fmt.Errorf("weave: delta %d is not numbered sequentially", d.Number)
+		}
+	}
+
+	n := len(hdr.Deltas) + 1
+	counts := &sccsCounts{
+		inserted:  make([]int, n),
+		deleted:   make([]int, n),
+		unchanged: make([]int, n+1),
+	}
+
+	var sum sumWriter
+	err = NewParser(io.TeeReader(bufrd, &sum), counts, 0).ParseTo(0)
+	if err == nil {
+		err = errors.New("weave: parse ended before end of file")
+	}
+	if err != io.EOF {
+		return nil, nil, 0, err
+	}
+	counts.finish()
+
+	return hdr, counts, uint32(sum), nil
+}
+
+// A sumWriter adds up the bytes written to it, as the s-file checksum
+// does.
+type sumWriter uint32
+
+func (s *sumWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		*s += sumWriter(b)
+	}
+	return len(p), nil
+}
+
+// writeSCCSHeader writes the header of an s-file, other than the
+// checksum line.
+func writeSCCSHeader(w io.Writer, hdr *Header, counts *sccsCounts) error {
+	for i := len(hdr.Deltas) - 1; i >= 0; i-- {
+		d := hdr.Deltas[i]
+
+		user := sccsUser
+		if u := d.Tags["user"]; u != "" && !strings.ContainsAny(u, " \t\n") {
+			user = u
+		}
+
+		fmt.Fprintf(w, "\x01s %05d/%05d/%05d\n",
+			sccsCount(counts.inserted[d.Number]),
+			sccsCount(counts.deleted[d.Number]),
+			sccsCount(counts.unchanged[d.Number]))
+		fmt.Fprintf(w, "\x01d D 1.%d %s %s %d %d\n", d.Number,
+			d.Time.UTC().Format(sccsTime), user, d.Number, d.Number-1)
+
+		comments := []string{d.Name}
+		for _, k := range sortedKeys(d.Tags) {
+			comments = append(comments, fmt.Sprintf("tag %s=%s", k, d.Tags[k]))
+		}
+		var stats []string
+		for k := range d.Stats {
+			stats = append(stats, k)
+		}
+		sort.Strings(stats)
+		for _, k := range stats {
+			comments = append(comments, fmt.Sprintf("stat %s=%d", k, d.Stats[k]))
+		}
+		comments = append(comments, "time "+d.Time.UTC().Format(time.RFC3339Nano))
+		for _, c := range []struct{ key, value string }{
+			{"digest", d.Digest},
+			{"chain", d.Chain},
+			{"signature", d.Signature},
+		} {
+			if c.value != "" {
+				comments = append(comments, c.key+" "+c.value)
+			}
+		}
+
+		for _, c := range comments {
+			if strings.ContainsAny(c, "\n\x01") {
+				return fmt.Errorf("weave: delta %d: %q cannot be written to an s-file", d.Number, c)
+			}
+			fmt.Fprintf(w, "\x01c %s\n", c)
+		}
+		fmt.Fprintf(w, "\x01e\n")
+	}
+
+	_, err := fmt.Fprintf(w, "\x01u\n\x01U\n\x01t\n\x01T\n")
+	return err
+}
+
+func sccsCount(n int) int {
+	if n > sccsMaxCount {
+		return sccsMaxCount
+	}
+	return n
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ImportSCCS reads an SCCS s-file, and writes its deltas as a new
+// weave file.  Any existing weave file becomes the backup file.  The
+// checksum of the s-file is verified.
+func ImportSCCS(nc NamingConvention, rd io.Reader) error {
+	sr := &sccsReader{
+		rd: bufio.NewReader(rd),
+	}
+
+	line, err := sr.rd.ReadString('\n')
+	if err != nil {
+		return sccsError(err)
+	}
+	if len(line) != 8 || !strings.HasPrefix(line, "\x01h") {
+		return errors.New("weave: not an SCCS file")
+	}
+	expect, err := strconv.Atoi(line[2:7])
+	if err != nil {
+		return errors.New("weave: not an SCCS file")
+	}
+
+	hdr, err := sr.readHeader()
+	if err != nil {
+		return err
+	}
+
+	wfile, wr, err := weaveCreate(nc, hdr)
+	if err != nil {
+		return err
+	}
+
+	err = sr.copyBody(wr, len(hdr.Deltas))
+	if err == nil && int(sr.sum&0xffff) != expect {
+		err = fmt.Errorf("weave: SCCS checksum mismatch, got %05d, expect %05d", sr.sum&0xffff, expect)
+	}
+	if err != nil {
+		abandonWeave(wfile, wr)
+		return err
+	}
+
+	err = finishWeave(wfile, wr)
+	if err != nil {
+		return err
+	}
+
+	return installWeave(nc, wfile.Name(), &wr.index)
+}
+
+// An sccsReader reads the lines of an s-file, after the checksum line,
+// adding up their bytes.
+type sccsReader struct {
+	rd   *bufio.Reader
+	sum  uint32
+	line int
+}
+
+// next returns the next line, without its newline.
+func (sr *sccsReader) next() (string, error) {
+	line, err := sr.rd.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		return "", errors.New("weave: last line of SCCS file is missing its newline")
+	}
+	if err != nil {
+		return "", err
+	}
+	sr.line++
+	for i := 0; i < len(line); i++ {
+		sr.sum += uint32(line[i])
+	}
+	return line[:len(line)-1], nil
+}
+
+func sccsError(err error) error {
+	if err == io.EOF {
+		return errors.New("weave: unexpected end of SCCS file")
+	}
+	return err
+}
+
+// readHeader reads the header of the s-file, up to the start of the
+// body, returning the equivalent weave header.
+func (sr *sccsReader) readHeader() (*Header, error) {
+	hdr := NewHeader()
+
+	var d *Delta
+	var comments []string
+	var user, sid string
+	inUsers := false
+	inText := false
+
+	for {
+		line, err := sr.next()
+		if err != nil {
+			return nil, sccsError(err)
+		}
+
+		// The users, and the descriptive text, are not needed.
+		if inUsers {
+			inUsers = line != "\x01U"
+			continue
+		}
+		if inText {
+			if line == "\x01T" {
+				break
+			}
+			continue
+		}
+
+		if len(line) < 2 || line[0] != '\x01' {
+			return nil, fmt.Errorf("weave: SCCS line %d: unexpected text in header", sr.line+1)
+		}
+
+		switch line[1] {
+		case 's', 'm':
+			// Line counts and MR numbers are not needed.
+		case 'u':
+			inUsers = true
+		case 'f':
+			if strings.HasPrefix(line, "\x01f e 1") {
+				return nil, errors.New("weave: encoded SCCS files are not supported")
+			}
+		case 't':
+			inText = true
+		case 'd':
+			m := sccsDeltaRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("weave: SCCS line %d: invalid delta %q", sr.line+1, line)
+			}
+			if m[1] != "D" {
+				return nil, fmt.Errorf("weave: SCCS delta %s is of type %q, only regular deltas are supported", m[2], m[1])
+			}
+			when, err := parseSCCSTime(m[3] + " " + m[4])
+			if err != nil {
+				return nil, err
+			}
+			serial, _ := strconv.Atoi(m[6])
+			pred, _ := strconv.Atoi(m[7])
+			if pred != serial-1 {
+				return nil, fmt.Errorf("weave: SCCS delta %s is not based on the previous delta", m[2])
+			}
+
+			d = &Delta{
+				Number: serial,
+				Tags:   make(map[string]string),
+				Time:   when,
+			}
+			sid, user = m[2], m[5]
+			comments = nil
+		case 'i', 'x', 'g':
+			if len(strings.TrimSpace(line[2:])) > 0 {
+				return nil, errors.New("weave: SCCS deltas with included or excluded deltas are not supported")
+			}
+		case 'c':
+			comments = append(comments, strings.TrimPrefix(line[2:], " "))
+		case 'e':
+			if d == nil {
+				return nil, fmt.Errorf("weave: SCCS line %d: end of delta without delta", sr.line+1)
+			}
+			sccsComments(d, comments, sid, user)
+			hdr.Deltas = append(hdr.Deltas, d)
+			d = nil
+		default:
+			return nil, fmt.Errorf("weave: SCCS line %d: unexpected line %q", sr.line+1, line)
+		}
+	}
+
+	if len(hdr.Deltas) == 0 {
+		return nil, errors.New("weave: SCCS file has no deltas")
+	}
+
+	// The deltas are listed newest first.
+	sort.Slice(hdr.Deltas, func(i, j int) bool {
+		return hdr.Deltas[i].Number < hdr.Deltas[j].Number
+	})
+	for i, d := range hdr.Deltas {
+		if d.Number != i+1 {
+			return nil, fmt.Errorf("weave: SCCS deltas are not numbered sequentially (%d)", d.Number)
+		}
+	}
+
+	return &hdr, nil
+}
+
+// sccsComments sets the name, tags and statistics of a delta from its
+// SCCS comments.
+func sccsComments(d *Delta, comments []string, sid, user string) {
+	d.Name = sid
+	if len(comments) > 0 {
+		d.Name = comments[0]
+		comments = comments[1:]
+	}
+
+	var other []string
+	for _, c := range comments {
+		if strings.HasPrefix(c, "tag ") {
+			if f := strings.SplitN(c[4:], "=", 2); len(f) == 2 {
+				d.Tags[f[0]] = f[1]
+				continue
+			}
+		}
+		if strings.HasPrefix(c, "stat ") {
+			if f := strings.SplitN(c[5:], "=", 2); len(f) == 2 {
+				if v, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+					if d.Stats == nil {
+						d.Stats = make(map[string]int64)
+					}
+					d.Stats[f[0]] = v
+					continue
+				}
+			}
+		}
+		if f := strings.SplitN(c, " ", 2); len(f) == 2 {
+			switch f[0] {
+			case "time":
+				if when, err := time.Parse(time.RFC3339Nano, f[1]); err == nil {
+					d.Time = when
+					continue
+				}
+			case "digest":
+				if isDigest(f[1]) {
+					d.Digest = f[1]
+					continue
+				}
+			case "chain":
+				if isDigest(f[1]) {
+					d.Chain = f[1]
+					continue
+				}
+			case "signature":
+				if sig, err := base64.StdEncoding.DecodeString(f[1]); err == nil && len(sig) == ed25519.SignatureSize {
+					d.Signature = f[1]
+					continue
+				}
+			}
+		}
+		other = append(other, c)
+	}
+	if len(other) > 0 {
+		d.Tags["comment"] = strings.Join(other, " ")
+	}
+
+	// Keep the details that gosure wouldn't have written itself.
+	if _, ok := d.Tags["user"]; !ok && user != sccsUser {
+		d.Tags["user"] = user
+	}
+	if sid != fmt.Sprintf("1.%d", d.Number) {
+		d.Tags["sid"] = sid
+	}
+}
+
+// isDigest reports whether the text is a hex SHA-256 digest, so that
+// other comments that happen to start with "digest" or "chain" are
+// kept as comments.
+func isDigest(text string) bool {
+	raw, err := hex.DecodeString(text)
+	return err == nil && len(raw) == sha256.Size
+}
+
+// parseSCCSTime parses a date from an s-file.  Two digit years are
+// taken to be between 1969 and 2068, as SCCS does.
+func parseSCCSTime(text string) (time.Time, error) {
+	layout := sccsTime
+	if strings.Index(text, "/") == 4 {
+		layout = "2006/01/02 15:04:05"
+	}
+	when, err := time.Parse(layout, text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("weave: invalid SCCS date %q", text)
+	}
+	if layout == sccsTime && when.Year() >= 2069 {
+		when = when.AddDate(-100, 0, 0)
+	}
+	return when, nil
+}
+
+// copyBody copies the body of the s-file to the weave, making sure
+// that the markers are sensible.
+func (sr *sccsReader) copyBody(w io.Writer, deltas int) error {
+	var state lineState
+
+	for {
+		line, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(line) > 0 && line[0] == '\x01' {
+			if len(line) < 4 || line[2] != ' ' {
+				return fmt.Errorf("weave: SCCS line %d: invalid control line %q", sr.line+1, line)
+			}
+			delta, err := strconv.Atoi(line[3:])
+			if err != nil || delta < 1 || delta > deltas {
+				return fmt.Errorf("weave: SCCS line %d: invalid delta in %q", sr.line+1, line)
+			}
+
+			switch line[1] {
+			case 'I':
+				err = state.Insert(delta)
+			case 'D':
+				err = state.Delete(delta)
+			case 'E':
+				err = state.End(delta)
+			default:
+				err = fmt.Errorf("weave: SCCS line %d: unknown control line %q", sr.line+1, line)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = io.WriteString(w, line+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(state.inserts) != 0 || len(state.deletes) != 0 {
+		return errors.New("weave: unterminated delta at end of SCCS file")
+	}
+	return nil
+}
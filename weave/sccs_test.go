@@ -0,0 +1,181 @@
+package weave_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"davidb.org/x/gosure/weave"
+)
+
+// A weave written as an s-file can be read back, with the same
+// deltas.
+func TestSCCSRoundTrip(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 10; i++ {
+		data.Scramble()
+		data.Tags = map[string]string{"rev": fmt.Sprintf("%d", i)}
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = weave.RewriteHeader(&data.NC, func(h *weave.Header) error {
+		return h.SetStats(3, map[string]int64{"files": 17})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = weave.ExportSCCS(&data.NC, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "\x01h") ||
+		!strings.Contains(buf.String(), "\x01d D 1.10 ") {
+		t.Fatalf("Not an s-file: %q", buf.String()[:100])
+	}
+
+	hdr, err := weave.ReadHeader(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data.NC.Base = "imported"
+	err = weave.ImportSCCS(&data.NC, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(t, data)
+
+	hdr2, err := weave.ReadHeader(&data.NC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(hdr, hdr2) {
+		t.Fatalf("Header mismatch:\n%+v\n%+v", hdr, hdr2)
+	}
+
+	// A corrupted s-file should be detected.
+	var buf2 bytes.Buffer
+	err = weave.ExportSCCS(&data.NC, &buf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := bytes.Replace(buf2.Bytes(), []byte("\n42\n"), []byte("\n43\n"), 1)
+	err = weave.ImportSCCS(&data.NC, bytes.NewReader(bad))
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Corrupt s-file not detected: %v", err)
+	}
+}
+
+// An s-file written by SCCS can be imported.
+func TestSCCSImport(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	src, err := os.Open("testdata/s.legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	nc := weave.SimpleNaming{
+		Path: tdir,
+		Base: "legacy",
+		Ext:  "weave",
+	}
+	err = weave.ImportSCCS(&nc, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := weave.ReadHeader(&nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.Deltas) != 3 {
+		t.Fatalf("Expecting 3 deltas, got %d", len(hdr.Deltas))
+	}
+
+	d := hdr.Deltas[2]
+	if d.Name != "Replace the second line." ||
+		d.Tags["comment"] != "Reviewed by bob." ||
+		d.Tags["user"] != "alice" ||
+		!d.Time.Equal(time.Date(1998, 3, 4, 12, 30, 0, 0, time.UTC)) {
+		t.Fatalf("Delta 3 not imported correctly: %+v", d)
+	}
+
+	expect := map[int][]string{
+		1: {"first", "second"},
+		2: {"first", "second", "third"},
+		3: {"first", "new second", "third"},
+	}
+	for delta, lines := range expect {
+		var got []string
+		err := weave.ReadDelta(&nc, delta, func(text string) error {
+			got = append(got, text)
+			return nil
+		})
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, lines) {
+			t.Fatalf("Delta %d: got %q, expect %q", delta, got, lines)
+		}
+	}
+
+	_, problems, err := weave.Validate(&nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Imported weave has problems: %v", problems)
+	}
+
+	// Exporting it again should give the same line counts.
+	var buf bytes.Buffer
+	err = weave.ExportSCCS(&nc, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := ioutil.ReadFile("testdata/s.legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := sccsCounts(buf.String()), sccsCounts(string(orig)); !reflect.DeepEqual(a, b) {
+		t.Fatalf("Line counts %q, expect %q", a, b)
+	}
+}
+
+func sccsCounts(text string) []string {
+	var counts []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "\x01s ") {
+			counts = append(counts, line)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,237 @@
+package weave
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// A Problem describes a single problem found while validating a
+// weave file.
+type Problem struct {
+	Line  int    // Line of the weave file, or 0 if not specific to a line.
+	Delta int    // The delta involved, or 0 if not specific to a delta.
+	Msg   string // Description of the problem.
+}
+
+func (p Problem) String() string {
+	text := p.Msg
+	if p.Delta != 0 {
+		text = fmt.Sprintf("delta %d: %s", p.Delta, text)
+	}
+	if p.Line != 0 {
+		text = fmt.Sprintf("line %d: %s", p.Line, text)
+	}
+	return text
+}
+
+// Validate checks the structure of the weave file described by the
+// naming convention.  It returns the header (if it could be read), and
+// a list of the problems found.  The error result is only used when
+// the file could not be read at all.
+func Validate(nc NamingConvention) (*Header, []Problem, error) {
+	file, rd, err := weaveOpen(nc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return ValidateReader(rd)
+}
+
+// ValidateReader checks the structure of the weave data read from
+// 'rd'.  The checks made are:
+//
+//   - The header is valid, of a known version, and the deltas it
+//     describes have unique, sequential numbers.
+//   - Every control line is well formed, and refers to a delta in
+//     the header.
+//   - Every insert and delete is ended, and no end refers to a delta
+//     that isn't open.
+//   - Inserts are properly nested, with each insert being newer than
+//     the inserts it is within.  Deletes may span inserts.
+//   - Every line of text is part of some delta.
+func ValidateReader(rd io.Reader) (*Header, []Problem, error) {
+	v := validator{
+		source:  bufio.NewReader(rd),
+		known:   make(map[int]bool),
+		unknown: make(map[int]bool),
+		open:    make(map[int]byte),
+	}
+
+	err := v.run()
+	if err != nil {
+		return v.header, nil, err
+	}
+
+	return v.header, v.problems, nil
+}
+
+type validator struct {
+	source   *bufio.Reader
+	header   *Header
+	problems []Problem
+	line     int
+
+	known    map[int]bool // Deltas described by the header.
+	unknown  map[int]bool // Deltas reported as not in the header.
+	open     map[int]byte // Open deltas, and whether 'I' or 'D'.
+	inserts  []int        // The stack of open inserts.
+	reported bool         // Has the current run of stray text been reported.
+}
+
+func (v *validator) problem(delta int, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Line:  v.line,
+		Delta: delta,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) run() error {
+	line, err := v.source.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	v.line = 1
+
+	if len(line) < 2 || line[0] != 1 || line[1] != 't' {
+		v.problem(0, "%v", ErrInvalidHeader)
+		return nil
+	}
+
+	var header Header
+	err = json.Unmarshal(line[2:], &header)
+	if err != nil {
+		v.problem(0, "unable to decode header: %v", err)
+		return nil
+	}
+	v.header = &header
+	v.checkHeader()
+
+	for {
+		line, err := v.source.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				v.line++
+				v.problem(0, "last line is missing its newline")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		v.line++
+		line = line[:len(line)-1]
+
+		if len(line) == 0 || line[0] != '\x01' {
+			if len(v.inserts) == 0 && !v.reported {
+				v.problem(0, "text is not part of any delta")
+				v.reported = true
+			}
+			continue
+		}
+		v.reported = false
+
+		v.control(line)
+	}
+
+	var open []int
+	for delta := range v.open {
+		open = append(open, delta)
+	}
+	sort.Ints(open)
+	for _, delta := range open {
+		v.problem(delta, "still open at end of file")
+	}
+
+	return nil
+}
+
+// checkHeader makes sure the header version is known, and that the
+// numbers of the deltas in the header are sane.
+func (v *validator) checkHeader() {
+	if v.header.Version < 1 || v.header.Version > HeaderVersion {
+		v.problem(0, "unsupported header version %d", v.header.Version)
+	}
+
+	for i, d := range v.header.Deltas {
+		if v.known[d.Number] {
+			v.problem(d.Number, "appears more than once in header")
+			continue
+		}
+		v.known[d.Number] = true
+
+		if d.Number != i+1 {
+			v.problem(d.Number, "is entry %d in the header, deltas should be numbered sequentially", i+1)
+		}
+	}
+}
+
+// control checks a single control line.
+func (v *validator) control(line []byte) {
+	if len(line) < 4 || line[2] != ' ' {
+		v.problem(0, "malformed control line %q", line)
+		return
+	}
+
+	kind := line[1]
+	if kind != 'I' && kind != 'D' && kind != 'E' {
+		v.problem(0, "unknown control line %q", line)
+		return
+	}
+
+	delta, err := strconv.Atoi(string(line[3:]))
+	if err != nil || delta <= 0 {
+		v.problem(0, "invalid delta number in control line %q", line)
+		return
+	}
+
+	if !v.known[delta] && !v.unknown[delta] {
+		v.problem(delta, "is not described in the header")
+		v.unknown[delta] = true
+	}
+
+	switch kind {
+	case 'I', 'D':
+		if prior, ok := v.open[delta]; ok {
+			v.problem(delta, "%s while %s of the same delta is still open",
+				markerName(kind), markerName(prior))
+			return
+		}
+		v.open[delta] = kind
+
+		if kind == 'I' {
+			if n := len(v.inserts); n > 0 && v.inserts[n-1] >= delta {
+				v.problem(delta, "insert is within insert of newer delta %d", v.inserts[n-1])
+			}
+			v.inserts = append(v.inserts, delta)
+		}
+	case 'E':
+		prior, ok := v.open[delta]
+		if !ok {
+			v.problem(delta, "end of delta that is not open")
+			return
+		}
+		delete(v.open, delta)
+
+		if prior == 'I' {
+			n := len(v.inserts)
+			if v.inserts[n-1] != delta {
+				v.problem(delta, "end of insert while insert of delta %d is still open",
+					v.inserts[n-1])
+			}
+			v.inserts, _ = removeDelta(v.inserts, delta)
+		}
+	}
+}
+
+func markerName(kind byte) string {
+	if kind == 'I' {
+		return "insert"
+	}
+	return "delete"
+}
@@ -0,0 +1,145 @@
+package weave_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"davidb.org/x/gosure/weave"
+)
+
+func TestValidateGood(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 100)
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i <= 20; i++ {
+		data.Scramble()
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkValid(t, &data.NC)
+
+	// Pruning generates markers differently, so check that as
+	// well.
+	err = weave.RemoveDeltas(&data.NC, []int{2, 3, 7, 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkValid(t, &data.NC)
+}
+
+func checkValid(t *testing.T, nc weave.NamingConvention) {
+	hdr, problems, err := weave.Validate(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr == nil {
+		t.Fatal("No header returned")
+	}
+	if len(problems) > 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
+
+const validHeader = `{"version":1,"deltas":[{"name":"a","number":1},{"name":"b","number":2}]}`
+
+var validateTests = []struct {
+	body     string
+	problems []weave.Problem
+}{
+	{"\x01I 1\na\n\x01D 2\nb\n\x01E 2\n\x01E 1\n\x01I 2\nc\n\x01E 2\n", nil},
+	{"\x01I 1\na\n\x01E 1\n\x01E 1\n", []weave.Problem{
+		{Line: 5, Delta: 1, Msg: "end of delta that is not open"},
+	}},
+	{"\x01I 1\na\n", []weave.Problem{
+		{Line: 3, Delta: 1, Msg: "still open at end of file"},
+	}},
+	{"\x01I 1\n\x01I 3\na\n\x01E 3\n\x01E 1\n", []weave.Problem{
+		{Line: 3, Delta: 3, Msg: "is not described in the header"},
+	}},
+	{"\x01I 2\n\x01I 1\na\n\x01E 1\n\x01E 2\n", []weave.Problem{
+		{Line: 3, Delta: 1, Msg: "insert is within insert of newer delta 2"},
+	}},
+	{"\x01I 1\n\x01I 2\na\n\x01E 1\n\x01E 2\n", []weave.Problem{
+		{Line: 5, Delta: 1, Msg: "end of insert while insert of delta 2 is still open"},
+	}},
+	{"a\nb\n\x01I 1\nc\n\x01E 1\nd\n", []weave.Problem{
+		{Line: 2, Msg: "text is not part of any delta"},
+		{Line: 7, Msg: "text is not part of any delta"},
+	}},
+	{"\x01I x\n\x01X 1\n\x01I\n", []weave.Problem{
+		{Line: 2, Msg: "invalid delta number in control line \"\\x01I x\""},
+		{Line: 3, Msg: "unknown control line \"\\x01X 1\""},
+		{Line: 4, Msg: "malformed control line \"\\x01I\""},
+	}},
+	{"\x01I 1\n\x01D 1\na\n\x01E 1\n\x01E 1\n", []weave.Problem{
+		{Line: 3, Delta: 1, Msg: "delete while insert of the same delta is still open"},
+		{Line: 6, Delta: 1, Msg: "end of delta that is not open"},
+	}},
+}
+
+func TestValidateBad(t *testing.T) {
+	for _, vt := range validateTests {
+		src := bytes.NewBufferString("\x01t" + validHeader + "\n" + vt.body)
+		_, problems, err := weave.ValidateReader(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(problems, vt.problems) {
+			t.Fatalf("Validate %q:\ngot: %v\nexpect: %v", vt.body, problems, vt.problems)
+		}
+	}
+
+	src := bytes.NewBufferString("\x01t{\"version\":1,\"deltas\":[{\"number\":1},{\"number\":1}]}\n")
+	_, problems, err := weave.ValidateReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []weave.Problem{
+		{Line: 1, Delta: 1, Msg: "appears more than once in header"},
+	}
+	if !reflect.DeepEqual(problems, expect) {
+		t.Fatalf("Bad header:\ngot: %v\nexpect: %v", problems, expect)
+	}
+
+	_, problems, err = weave.ValidateReader(bytes.NewBufferString("asure-2.0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 {
+		t.Fatalf("Expecting a header problem, got: %v", problems)
+	}
+}
+
+// The parser should report errors, rather than panicking, on a
+// corrupt weave.
+func TestParserErrors(t *testing.T) {
+	bodies := map[string]string{
+		"\x01I 1\na\n\x01E 2\n": "weave: line 4: end of delta 2, which is not open",
+		"\x01I 1\na\n\x01E x\n": "weave: line 4: invalid delta number in control line \"\\x01E x\"",
+	}
+
+	for body, msg := range bodies {
+		src := bytes.NewBufferString("\x01t" + validHeader + "\n" + body)
+		err := weave.NewParser(src, weave.Writer{Writer: ioutil.Discard}, 1).ParseTo(0)
+		if err == nil || err.Error() != msg {
+			t.Fatalf("Parse %q: got %v, expect %q", body, err, msg)
+		}
+	}
+}
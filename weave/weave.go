@@ -16,6 +16,7 @@ package weave
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"regexp"
@@ -55,6 +56,7 @@ type Parser struct {
 	dstate    deltaState // States of all open deltas.
 	keeping   bool       // Are we currently keeping records?
 	lineNo    int
+	fileLine  int    // Line number in the weave file itself.
 	isPending bool   // Is there a pending line?
 	pending   string // The pending line.
 }
@@ -91,6 +93,7 @@ func (p *Parser) ParseTo(lineno int) error {
 			return err
 		}
 		line = line[:len(line)-1]
+		p.fileLine++
 
 		if len(line) == 0 || line[0] != '\x01' {
 			// Textual line.  Count line numbers for the
@@ -127,8 +130,8 @@ func (p *Parser) ParseTo(lineno int) error {
 
 		thisDelta, err := strconv.Atoi(string(line[3:]))
 		if err != nil {
-			// TODO: This could be more informative
-			return err
+			return fmt.Errorf("weave: line %d: invalid delta number in control line %q",
+				p.fileLine, line)
 		}
 
 		switch line[1] {
@@ -137,33 +140,24 @@ func (p *Parser) ParseTo(lineno int) error {
 			if err != nil {
 				return err
 			}
-			p.pop(thisDelta)
+			err = p.pop(thisDelta)
+			if err != nil {
+				return err
+			}
 		case 'I':
 			err = p.Sink.Insert(thisDelta)
 			if err != nil {
 				return err
 			}
 
-			// Do this insert if this insert is at least
-			// as old as the request delta.
-			if p.Delta >= thisDelta {
-				p.push(thisDelta, stKeep)
-			} else {
-				p.push(thisDelta, stSkip)
-			}
+			p.push(thisDelta, p.insertMode(thisDelta))
 		case 'D':
 			err = p.Sink.Delete(thisDelta)
 			if err != nil {
 				return err
 			}
 
-			// Do this delete if this delete is newer than
-			// current.  If not, don't account for it.
-			if p.Delta >= thisDelta {
-				p.push(thisDelta, stSkip)
-			} else {
-				p.push(thisDelta, stNext)
-			}
+			p.push(thisDelta, p.deleteMode(thisDelta))
 		}
 		p.updateKeep()
 	}
@@ -194,8 +188,29 @@ const (
 	stNext
 )
 
-// Remove the given numbered state.
-func (p *Parser) pop(delta int) {
+// insertMode returns the mode for an insert of the given delta.
+func (p *Parser) insertMode(delta int) stateMode {
+	// Do this insert if this insert is at least as old as the
+	// request delta.
+	if p.Delta >= delta {
+		return stKeep
+	}
+	return stSkip
+}
+
+// deleteMode returns the mode for a delete of the given delta.
+func (p *Parser) deleteMode(delta int) stateMode {
+	// Do this delete if this delete is newer than current.  If
+	// not, don't account for it.
+	if p.Delta >= delta {
+		return stSkip
+	}
+	return stNext
+}
+
+// Remove the given numbered state.  It is an error to remove a state
+// that is not present.
+func (p *Parser) pop(delta int) error {
 	found := -1
 	for i := range p.dstate {
 		if p.dstate[i].delta == delta {
@@ -204,7 +219,8 @@ func (p *Parser) pop(delta int) {
 		}
 	}
 	if found == -1 {
-		panic("State of pop not present")
+		return fmt.Errorf("weave: line %d: end of delta %d, which is not open",
+			p.fileLine, delta)
 	}
 
 	ln := len(p.dstate)
@@ -212,6 +228,7 @@ func (p *Parser) pop(delta int) {
 		copy(p.dstate[found:ln-1], p.dstate[found+1:ln])
 	}
 	p.dstate = p.dstate[:ln-1]
+	return nil
 }
 
 // Add a new state.  It will be inserted in the proper place in the
@@ -49,6 +49,46 @@ func TestDeltas(t *testing.T) {
 	}
 }
 
+// Test deltas that only add, only delete, or remove everything.
+func TestEdits(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "weave-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	data := NewDataSet(tdir, 10)
+
+	err = data.SaveNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edits := [][]int{
+		{100, 101, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{100, 101, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 102},
+		{0, 1, 2, 3, 102},
+		{},
+		{5, 5, 5},
+		{5, 6, 5, 6, 5},
+	}
+
+	for i, edit := range edits {
+		data.Data = edit
+		err = data.SaveDelta()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for delta := 1; delta <= i+2; delta++ {
+			err = data.Check(delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
 type DataSet struct {
 	Data   []int
 	Name   string